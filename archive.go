@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archives. When archive_depth is set, the members of zip and tar archives,
+// plain or compressed with gzip, bzip2 or xz, are indexed as documents of
+// their own, with fullpath the path of the archive, ARCHIVE_SEPARATOR and
+// the path of the member, as in /data/a.zip!/docs/readme.txt, and archive
+// the path of the archive containing them. Archives inside archives are
+// expanded too, up to archive_depth levels. The archive document is sent
+// last, with the amount of members in members, so an archive whose
+// document is in the index was completely indexed.
+
+// Separates the path of an archive from the path of its members
+const ARCHIVE_SEPARATOR = "!/"
+
+// Archives inside archives, and members indexed by their metadata, are read
+// in memory up to this size
+const ARCHIVE_NESTED_MAX_SIZE = 64 * 1024 * 1024
+
+// archiveExtensions are the archive formats, by the end of their name, with
+// the decompressor of the tar formats
+var archiveExtensions = []struct {
+	ext        string
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}{
+	{".zip", nil},
+	{".tar", func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }},
+	{".tar.gz", gzipReader},
+	{".tgz", gzipReader},
+	{".tar.bz2", bzip2Reader},
+	{".tbz2", bzip2Reader},
+	{".tbz", bzip2Reader},
+	{".tar.xz", xzReader},
+	{".txz", xzReader},
+}
+
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func bzip2Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+// archiveFormat returns the position in archiveExtensions of the format of
+// the file name, -1 if it is not an archive
+func archiveFormat(name string) int {
+	name = strings.ToLower(name)
+	for i, a := range archiveExtensions {
+		if strings.HasSuffix(name, a.ext) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isArchived tells whether s is a member of an archive
+func isArchived(s Source) bool {
+	return s.Archive != ""
+}
+
+// containerPath is the path of the file on disk holding p, the outermost
+// archive of a member, or p itself
+func containerPath(p string) string {
+	if i := strings.Index(p, ARCHIVE_SEPARATOR); i >= 0 {
+		return p[:i]
+	}
+	return p
+}
+
+// memberPath is the fullpath of the member name of archive, clean and
+// without leading slashes
+func memberPath(archive string, name string) string {
+	return archive + ARCHIVE_SEPARATOR + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// archiveReader expands archives into documents
+type archiveReader struct {
+	h       hash.Hash
+	g       *Gotrovi
+	extract bool
+	// members bigger than this are indexed without content
+	maxSize int64
+	fn      func(doc *FileDescriptionDoc)
+}
+
+// excluded applies the extension and folder name exclude settings to a
+// member
+func (a *archiveReader) excluded(name string, isDir bool) bool {
+	exclude := a.g.conf.Exclude
+	if isDir {
+		for _, f := range exclude.Folder {
+			if path.Base(name) == f {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ext := range exclude.Extension {
+		if path.Ext(name) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// member reads a member of archive from r and sends its document, and those
+// of its own members if it is an archive and depth allows it
+func (a *archiveReader) member(archive string, name string, info os.FileInfo, r io.Reader, depth int) {
+	p := memberPath(archive, name)
+	doc := &FileDescriptionDoc{
+		FileName: path.Base(p),
+		FullName: p,
+		Path:     filepath.Dir(p),
+		IsFolder: info.IsDir(),
+		Date:     fileDate(info.ModTime()),
+		Mode:     info.Mode().String(),
+		Archive:  archive,
+	}
+	if info.IsDir() {
+		a.fn(doc)
+		return
+	}
+	doc.Size = info.Size()
+	doc.Extension = path.Ext(doc.FileName)
+
+	nested := depth > 1 && archiveFormat(doc.FileName) >= 0
+	limit := a.maxSize
+	if nested || metadataOnly(doc.FileName) {
+		limit = ARCHIVE_NESTED_MAX_SIZE
+	}
+	// the content is kept up to limit, the rest is only hashed
+	a.h.Reset()
+	var content bytes.Buffer
+	_, err := io.Copy(io.MultiWriter(a.h, &limitedWriter{w: &content, n: limit}), r)
+	if err != nil {
+		Warning.Println("Unable to read", p, ":", err)
+		return
+	}
+	doc.Hash = fmt.Sprintf("%x", a.h.Sum(nil))
+	a.h.Reset()
+	data := content.Bytes()
+	if int64(len(data)) < doc.Size || int64(len(data)) > limit {
+		Trace.Println("Indexing", p, "without content, bigger than", limit)
+		data = nil
+	}
+
+	if nested && data != nil {
+		doc.Members, err = a.expand(p, doc.FileName, bytes.NewReader(data), int64(len(data)), depth-1)
+		if err != nil {
+			Warning.Println("Unable to read the archive", p, ":", err)
+		}
+		a.fn(doc)
+		return
+	}
+	if data != nil && (int64(len(data)) <= a.maxSize || metadataOnly(doc.FileName)) {
+		setContent(doc, p, data, a.extract)
+	}
+	a.fn(doc)
+}
+
+// expand sends the documents of the members of the archive p, named name,
+// returning how many it has
+func (a *archiveReader) expand(p string, name string, r io.ReaderAt, size int64, depth int) (int, error) {
+	format := archiveFormat(name)
+	if format < 0 {
+		return 0, fmt.Errorf("%s is not an archive", name)
+	}
+	members := 0
+
+	decompress := archiveExtensions[format].decompress
+	if decompress == nil {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range zr.File {
+			info := f.FileInfo()
+			if a.excluded(f.Name, info.IsDir()) {
+				continue
+			}
+			members = members + 1
+			if info.IsDir() {
+				a.member(p, f.Name, info, nil, depth)
+				continue
+			}
+			fr, err := f.Open()
+			if err != nil {
+				Warning.Println("Unable to read", memberPath(p, f.Name), ":", err)
+				continue
+			}
+			a.member(p, f.Name, info, fr, depth)
+			fr.Close()
+		}
+		return members, nil
+	}
+
+	dr, err := decompress(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return members, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		info := hdr.FileInfo()
+		if a.excluded(hdr.Name, info.IsDir()) {
+			continue
+		}
+		members = members + 1
+		a.member(p, hdr.Name, info, tr, depth)
+	}
+}
+
+// encodeArchive builds the documents of the archive p and its members,
+// calling fn for each, the archive last. Its content is not extracted.
+func (gotrovi *Gotrovi) encodeArchive(h hash.Hash, info os.FileInfo, p string, extract bool, fn func(doc *FileDescriptionDoc)) error {
+	sum, err := hashFile(h, p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	doc := &FileDescriptionDoc{
+		FileName:  info.Name(),
+		FullName:  p,
+		Path:      filepath.Dir(p),
+		Size:      info.Size(),
+		Extension: filepath.Ext(info.Name()),
+		Hash:      sum,
+		Date:      fileDate(info.ModTime()),
+		Mode:      info.Mode().String(),
+	}
+	a := &archiveReader{h: h, g: gotrovi, extract: extract, maxSize: gotrovi.conf.Exclude.Size, fn: fn}
+	start := time.Now()
+	doc.Members, err = a.expand(p, info.Name(), f, info.Size(), gotrovi.conf.ArchiveDepth)
+	if err != nil {
+		Warning.Println("Unable to read the archive", p, ":", err)
+		doc.Attachment = &Attachment{Error: err.Error()}
+	}
+	Trace.Println("Read", doc.Members, "members of", p, "in", time.Since(start))
+	fn(doc)
+	return nil
+}
+
+// limitedWriter writes up to n bytes to w and discards the rest, so a
+// reader can be copied whole while keeping only its start. It keeps one
+// byte more to tell when the limit was passed.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n >= 0 {
+		keep := b
+		if int64(len(keep)) > l.n+1 {
+			keep = keep[:l.n+1]
+		}
+		l.w.Write(keep)
+		l.n = l.n - int64(len(keep))
+	}
+	return len(b), nil
+}
+
+// isExpanded tells whether the members of the file p are indexed
+func (gotrovi *Gotrovi) isExpanded(p string) bool {
+	return gotrovi.conf.ArchiveDepth > 0 && archiveFormat(p) >= 0
+}
+
+// dropMembers deletes the members indexed from a previous version of the
+// archive p, before the new ones are sent
+func (gotrovi *Gotrovi) dropMembers(p string) {
+	st, ok := gotrovi.state.get(p)
+	if !ok || st.Members == 0 || st.Generation != gotrovi.backend.Generation() {
+		return
+	}
+	err := gotrovi.backend.DeleteMembers(p)
+	if err != nil {
+		Error.Println("Unable to delete the members of", p, ":", err)
+	}
+}
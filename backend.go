@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+)
+
+const BACKEND_ES = "elasticsearch"
+const BACKEND_LOCAL = "local"
+
+// Folder inside GOTROVI_SETTINGS_FOLDER holding the local index
+const LOCAL_INDEX_FOLDER = "index"
+
+// searchFunc is called for each hit of a search, total is the amount of
+// documents matching, including those left out by the limit and offset
+type searchFunc func(total int, e SearchHit)
+
+// Backend is where gotrovi stores the file documents and runs the searches.
+// Documents are identified by the full path of the file. The features a
+// backend may lack are in the smaller interfaces below, which the commands
+// needing them look for with a type assertion.
+type Backend interface {
+	Open() error
+	Close() error
+
+	// Index stores the documents in items. It returns the items that failed
+	// temporarily and should be retried, and the items that failed for good.
+	Index(items []bulkItem) (retry []bulkItem, failed []bulkItem)
+	// Refresh makes the indexed documents visible to searches
+	Refresh() error
+	Delete(p string) error
+	// DeleteChunks deletes the chunk documents of p numbered from on
+	DeleteChunks(p string, from int) error
+	// DeleteMembers deletes the documents of the members of the archive p
+	DeleteMembers(p string) error
+	Exists(p string) bool
+	// Get returns the stored document for p, with its extracted attachment
+	Get(p string) (*FileDescriptionDoc, error)
+	// Search runs a query using Lucene syntax, calling fn for each hit
+	// selected by opts
+	Search(query string, opts searchOptions, fn searchFunc) error
+	// ScrollAll calls fn for every file and folder in the index, the
+	// chunks collapsed into their file
+	ScrollAll(fn searchFunc) error
+	DeleteIndex() error
+	// Generation identifies the index generation documents are written to
+	Generation() string
+}
+
+// reindexer builds a new generation of the index while searches keep using
+// the current one. Forced syncs on other backends delete the index and
+// write to it directly.
+type reindexer interface {
+	// BeginReindex starts building a new generation of the index, Index
+	// writes to it while searches keep using the current one
+	BeginReindex() error
+	// ResumeReindex continues building the generation of an interrupted
+	// reindex
+	ResumeReindex(generation string) error
+	// FinishReindex makes the new generation the current one, keeping the
+	// keep most recent previous generations
+	FinishReindex(keep int) error
+	// AbortReindex drops the new generation
+	AbortReindex() error
+}
+
+// duplicateFinder groups the identical files, for gotrovi dupes
+type duplicateFinder interface {
+	// Duplicates calls fn for each group of documents matching query with
+	// the same size and hash
+	Duplicates(query string, fn func(docs []Source)) error
+}
+
+// statsReporter summarizes the index, for gotrovi stats
+type statsReporter interface {
+	// Stats summarizes the documents matching query, counting the files in
+	// each of folders
+	Stats(query string, folders []string) (*indexStats, error)
+	// FolderUsage calls fn with the amount and size of the files directly
+	// inside each folder, for the files matching query
+	FolderUsage(query string, fn func(path string, files int, size int64)) error
+}
+
+// eventRecorder keeps integrity events, for gotrovi verify --events
+type eventRecorder interface {
+	// RecordEvents stores integrity events apart from the file documents
+	RecordEvents(events []integrityEvent) error
+}
+
+// inPlaceReindex rebuilds the index of a backend without generations:
+// the index is deleted first and an aborted reindex leaves it incomplete
+type inPlaceReindex struct {
+	b Backend
+}
+
+func (r inPlaceReindex) BeginReindex() error                   { return r.b.DeleteIndex() }
+func (r inPlaceReindex) ResumeReindex(generation string) error { return nil }
+func (r inPlaceReindex) FinishReindex(keep int) error          { return nil }
+func (r inPlaceReindex) AbortReindex() error                   { return nil }
+
+// reindexer returns how the backend builds a new index
+func (gotrovi *Gotrovi) reindexer() reindexer {
+	if r, ok := gotrovi.backend.(reindexer); ok {
+		return r
+	}
+	return inPlaceReindex{gotrovi.backend}
+}
+
+// backendName is the name of the configured backend, for the messages
+func (gotrovi *Gotrovi) backendName() string {
+	if gotrovi.conf.Backend == "" {
+		return BACKEND_ES
+	}
+	return gotrovi.conf.Backend
+}
+
+func (gotrovi *Gotrovi) OpenBackend() error {
+	switch gotrovi.conf.Extractor {
+	case "", EXTRACTOR_INGEST, EXTRACTOR_LOCAL:
+	default:
+		return fmt.Errorf("unknown extractor %q, use \"%s\" or \"%s\"", gotrovi.conf.Extractor, EXTRACTOR_INGEST, EXTRACTOR_LOCAL)
+	}
+
+	switch gotrovi.conf.Backend {
+	case "", BACKEND_ES:
+		gotrovi.backend = &esBackend{conf: gotrovi.conf.ElasticSearch, ingest: !gotrovi.localExtraction()}
+	case BACKEND_LOCAL:
+		gotrovi.backend = newLocalBackend(GOTROVI_SETTINGS_FOLDER + LOCAL_INDEX_FOLDER)
+	default:
+		return fmt.Errorf("unknown backend %q, use \"%s\" or \"%s\"", gotrovi.conf.Backend, BACKEND_ES, BACKEND_LOCAL)
+	}
+
+	return gotrovi.backend.Open()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/apoorvam/goterminal"
+)
+
+// both backends have every optional capability
+var (
+	_ reindexer       = (*localBackend)(nil)
+	_ duplicateFinder = (*localBackend)(nil)
+	_ statsReporter   = (*localBackend)(nil)
+	_ eventRecorder   = (*localBackend)(nil)
+	_ reindexer       = (*esBackend)(nil)
+	_ duplicateFinder = (*esBackend)(nil)
+	_ statsReporter   = (*esBackend)(nil)
+	_ eventRecorder   = (*esBackend)(nil)
+)
+
+// testDoc is the document of a file in the conformance test
+func testDoc(p string, size int64, hash string, content string) *FileDescriptionDoc {
+	doc := &FileDescriptionDoc{
+		FileName:  filepath.Base(p),
+		FullName:  p,
+		Path:      filepath.Dir(p),
+		Size:      size,
+		Extension: filepath.Ext(p),
+		Hash:      hash,
+		Date:      "2024-05-20T12:00:00Z",
+	}
+	if content != "" {
+		doc.Attachment = &Attachment{Content: content}
+	}
+	return doc
+}
+
+// testSearch returns the paths of the hits of query, and the total
+func testSearch(t *testing.T, b Backend, query string, opts searchOptions) (string, int) {
+	var paths []string
+	total := 0
+	err := b.Search(query, opts, func(n int, hit SearchHit) {
+		total = n
+		paths = append(paths, hit.Source.FullName)
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return strings.Join(paths, " "), total
+}
+
+// testBackend checks the behaviour every backend shares, and that of the
+// optional capabilities b has. open returns a new backend on the same
+// storage, to check what survives Close.
+func testBackend(t *testing.T, b Backend, open func() Backend) {
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	big := "/r/big.txt"
+	bigDoc := testDoc(big, 100, "h3", "first part")
+	bigDoc.Chunks = 2
+	chunk := testDoc(big, 100, "h3", "second needle")
+	chunk.Chunk = 1
+	chunk.Offset = 50
+	zip := testDoc("/r/x.zip", 30, "h4", "")
+	zip.Members = 1
+	member := testDoc("/r/x.zip!/m.txt", 6, "h5", "member text")
+	member.Path = "/r/x.zip!"
+	member.Archive = "/r/x.zip"
+	folder := testDoc("/r/sub", 0, "", "")
+	folder.IsFolder = true
+	items := []bulkItem{
+		{path: "/r/a.txt", doc: testDoc("/r/a.txt", 5, "h1", "hello world"), extracted: true},
+		{path: "/r/b.txt", doc: testDoc("/r/b.txt", 5, "h1", "hello again"), extracted: true},
+		{path: "/r/sub", doc: folder, extracted: true},
+		{path: "/r/sub/c.log", doc: testDoc("/r/sub/c.log", 7, "h2", "other words"), extracted: true},
+		{path: big, doc: bigDoc, extracted: true},
+		{path: chunkID(big, 1), doc: chunk, extracted: true},
+		{path: "/r/x.zip", doc: zip, extracted: true},
+		{path: member.FullName, doc: member, extracted: true},
+	}
+	retry, failed := b.Index(items)
+	if len(retry) != 0 || len(failed) != 0 {
+		t.Fatalf("index: %d to retry, %d failed", len(retry), len(failed))
+	}
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range items {
+		if !b.Exists(item.path) {
+			t.Errorf("%s not indexed", item.path)
+		}
+	}
+	if b.Exists("/r/none.txt") {
+		t.Error("/r/none.txt indexed")
+	}
+	doc, err := b.Get("/r/a.txt")
+	if err != nil || doc.FullName != "/r/a.txt" || doc.Size != 5 || doc.Attachment == nil || doc.Attachment.Content != "hello world" {
+		t.Errorf("get: %+v %v", doc, err)
+	}
+	if _, err := b.Get("/r/none.txt"); err == nil {
+		t.Error("get of a missing document")
+	}
+
+	sorted := searchOptions{Sort: []sortField{{Field: "fullpath"}}}
+	if paths, total := testSearch(t, b, "hello", sorted); paths != "/r/a.txt /r/b.txt" || total != 2 {
+		t.Errorf("search: %s, total %d", paths, total)
+	}
+	if paths, total := testSearch(t, b, "hello", searchOptions{Sort: sorted.Sort, Offset: 1, Limit: 1}); paths != "/r/b.txt" || total != 2 {
+		t.Errorf("search page: %s, total %d", paths, total)
+	}
+	// chunks are collapsed into their file
+	if paths, _ := testSearch(t, b, "needle", sorted); paths != big {
+		t.Errorf("search in a chunk: %s", paths)
+	}
+	if paths, _ := testSearch(t, b, "ext:log", sorted); paths != "/r/sub/c.log" {
+		t.Errorf("friendly search: %s", paths)
+	}
+	if paths, _ := testSearch(t, b, "extension:\".log\"", searchOptions{Raw: true}); paths != "/r/sub/c.log" {
+		t.Errorf("raw search: %s", paths)
+	}
+	if err := b.Search("(hello", searchOptions{}, func(int, SearchHit) {}); err == nil {
+		t.Error("search of an invalid query")
+	}
+
+	// chunks are collapsed into their file
+	scrolled := make(map[string]bool)
+	err = b.ScrollAll(func(total int, hit SearchHit) {
+		scrolled[chunkID(hit.Source.FullName, hit.Source.Chunk)] = true
+	})
+	if err != nil || len(scrolled) != len(items)-1 || !scrolled[member.FullName] || scrolled[chunkID(big, 1)] {
+		t.Errorf("scroll: %v %v", scrolled, err)
+	}
+
+	if finder, ok := b.(duplicateFinder); ok {
+		var groups []string
+		err := finder.Duplicates("*", func(docs []Source) {
+			var paths []string
+			for _, s := range docs {
+				paths = append(paths, s.FullName)
+			}
+			sort.Strings(paths)
+			groups = append(groups, strings.Join(paths, " "))
+		})
+		if err != nil || len(groups) != 1 || groups[0] != "/r/a.txt /r/b.txt" {
+			t.Errorf("duplicates: %q %v", groups, err)
+		}
+	}
+	if reporter, ok := b.(statsReporter); ok {
+		stats, err := reporter.Stats("*", []string{"/r/sub"})
+		if err != nil || stats.Folders != 1 || len(stats.IndexFolders) != 1 || stats.IndexFolders[0].Count != 1 {
+			t.Errorf("stats: %+v %v", stats, err)
+		}
+		usage := make(map[string]int64)
+		err = reporter.FolderUsage("*", func(path string, files int, size int64) {
+			usage[path] = size
+		})
+		if err != nil || usage["/r/sub"] != 7 || usage["/r"] != 5+5+100+30 {
+			t.Errorf("folder usage: %v %v", usage, err)
+		}
+	}
+	if recorder, ok := b.(eventRecorder); ok {
+		err := recorder.RecordEvents([]integrityEvent{{Timestamp: "2024-05-20T12:00:00Z", Event: "corrupt", FullName: "/r/a.txt", IndexedHash: "h1", Hash: "h0"}})
+		if err != nil {
+			t.Errorf("record events: %v", err)
+		}
+	}
+
+	for _, err := range []error{b.DeleteChunks(big, 1), b.DeleteMembers("/r/x.zip"), b.Delete("/r/a.txt"), b.Delete("/r/none.txt"), b.Refresh()} {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for p, want := range map[string]bool{big: true, chunkID(big, 1): false, "/r/x.zip": true, member.FullName: false, "/r/a.txt": false, "/r/b.txt": true} {
+		if b.Exists(p) != want {
+			t.Errorf("after the deletes %s indexed %v", p, !want)
+		}
+	}
+
+	if r, ok := b.(reindexer); ok {
+		generation := b.Generation()
+		if err := r.BeginReindex(); err != nil {
+			t.Fatal(err)
+		}
+		b.Index([]bulkItem{{path: "/r/new.txt", doc: testDoc("/r/new.txt", 3, "h6", "fresh"), extracted: true}})
+		b.Refresh()
+		// other processes keep searching the current generation
+		other := open()
+		if err := other.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if paths, _ := testSearch(t, other, "fresh OR hello", sorted); paths != "/r/b.txt" {
+			t.Errorf("search during a reindex: %s", paths)
+		}
+		if err := r.FinishReindex(0); err != nil {
+			t.Fatal(err)
+		}
+		if paths, _ := testSearch(t, b, "fresh OR hello", sorted); paths != "/r/new.txt" || b.Generation() == generation {
+			t.Errorf("search after a reindex: %s, generation %s", paths, b.Generation())
+		}
+
+		if err := r.BeginReindex(); err != nil {
+			t.Fatal(err)
+		}
+		b.Index([]bulkItem{{path: "/r/lost.txt", doc: testDoc("/r/lost.txt", 3, "h7", "lost"), extracted: true}})
+		if err := r.AbortReindex(); err != nil {
+			t.Fatal(err)
+		}
+		if paths, _ := testSearch(t, b, "fresh OR lost", sorted); paths != "/r/new.txt" {
+			t.Errorf("search after an aborted reindex: %s", paths)
+		}
+	}
+
+	persisted := "/r/b.txt"
+	if _, ok := b.(reindexer); ok {
+		persisted = "/r/new.txt"
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b = open()
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Exists(persisted) {
+		t.Errorf("%s lost on close", persisted)
+	}
+	if err := b.DeleteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Exists(persisted) {
+		t.Errorf("%s left after deleting the index", persisted)
+	}
+	b.Close()
+}
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() Backend {
+		return newLocalBackend(filepath.Join(dir, LOCAL_INDEX_FOLDER))
+	}
+	testBackend(t, open(), open)
+}
+
+// testPlainBackend hides the optional capabilities of the backend it wraps
+type testPlainBackend struct {
+	Backend
+}
+
+func TestPlainBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() Backend {
+		return testPlainBackend{newLocalBackend(filepath.Join(dir, LOCAL_INDEX_FOLDER))}
+	}
+	testBackend(t, open(), open)
+
+	// forced syncs rebuild the index in place
+	GOTROVI_SETTINGS_FOLDER = dir + "/"
+	root := filepath.Join(dir, "root")
+	testIgnoreTree(t, root, map[string]string{"a.txt": "a"})
+	var g Gotrovi
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 1 << 30}, Hash: "md5"}
+	g.jobs = 2
+	g.writer = goterminal.New(ioutil.Discard)
+	g.backend = open()
+	g.backend.Open()
+	g.backend.Index([]bulkItem{{path: "/r/old.txt", doc: testDoc("/r/old.txt", 3, "h1", "old"), extracted: true}})
+	g.OpenState()
+	g.InitHash()
+	if _, ok := g.reindexer().(inPlaceReindex); !ok {
+		t.Fatalf("reindexer %T", g.reindexer())
+	}
+	if err := g.SyncForced(0); err != nil {
+		t.Fatal(err)
+	}
+	if g.backend.Exists("/r/old.txt") || !g.backend.Exists(filepath.Join(root, "a.txt")) {
+		t.Error("index not rebuilt")
+	}
+}
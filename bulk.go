@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A bulk request is sent once either limit is reached
+const BULK_MAX_DOCS = 500
+const BULK_MAX_BYTES = 10 * 1024 * 1024
+
+// Items rejected with 429 or 5xx are retried BULK_RETRY_COUNT times, waiting
+// BULK_RETRY_TIME more on each attempt
+const BULK_RETRY_COUNT = 3
+const BULK_RETRY_TIME = time.Second
+
+// errTooBig is returned by encodeFile for the compressed files whose content
+// is indexed in chunks instead
+var errTooBig = errors.New("content bigger than the exclude size")
+
+type fileJob struct {
+	info os.FileInfo
+	path string
+}
+
+type bulkItem struct {
+	path string
+	info os.FileInfo
+	doc  *FileDescriptionDoc
+	// doc already has its attachment and skips the ingest pipeline
+	extracted bool
+}
+
+// indexer is the sync pipeline: the folder walk feeds files, a pool of
+// workers hashes and encodes them, and a single sender batches the documents
+// into backend Index calls.
+type indexer struct {
+	g       *Gotrovi
+	files   chan fileJob
+	docs    chan bulkItem
+	workers sync.WaitGroup
+	sender  sync.WaitGroup
+
+	indexed int64
+	failed  int64
+}
+
+func (gotrovi *Gotrovi) startIndexer() {
+	jobs := gotrovi.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ix := &indexer{
+		g:     gotrovi,
+		files: make(chan fileJob, jobs*2),
+		docs:  make(chan bulkItem, jobs*2),
+	}
+
+	for i := 0; i < jobs; i++ {
+		ix.workers.Add(1)
+		go ix.work(gotrovi.newHash(), gotrovi.localExtraction())
+	}
+	ix.sender.Add(1)
+	go ix.send()
+
+	gotrovi.indexer = ix
+}
+
+// stopIndexer waits for every queued file to be sent, refreshes the index and
+// saves the sync state, unless they were saved less than saveEvery ago.
+// It returns an error when nothing could be indexed.
+func (gotrovi *Gotrovi) stopIndexer() error {
+	ix := gotrovi.indexer
+	if ix == nil {
+		return nil
+	}
+	gotrovi.indexer = nil
+
+	close(ix.files)
+	ix.workers.Wait()
+	close(ix.docs)
+	ix.sender.Wait()
+
+	Info.Println("Indexed", ix.indexed, "documents,", ix.failed, "failed")
+
+	var err error
+	if ix.indexed == 0 && ix.failed > 0 {
+		err = fmt.Errorf("none of the %d documents could be indexed", ix.failed)
+	}
+	gotrovi.unrefreshed = gotrovi.unrefreshed || ix.indexed > 0
+	gotrovi.unsaved = true
+	if gotrovi.saveEvery > 0 && time.Since(gotrovi.saved) < gotrovi.saveEvery {
+		return err
+	}
+	if serr := gotrovi.save(); serr != nil {
+		err = serr
+	}
+	return err
+}
+
+// save refreshes the index if documents were indexed since the last save and
+// then saves the sync state, which is never written ahead of the index
+func (gotrovi *Gotrovi) save() error {
+	gotrovi.saved = time.Now()
+	gotrovi.unsaved = false
+
+	var err error
+	if gotrovi.unrefreshed {
+		gotrovi.unrefreshed = false
+		err = gotrovi.backend.Refresh()
+		if err != nil {
+			Error.Println("Unable to refresh index:", err)
+			err = fmt.Errorf("unable to refresh index: %v", err)
+		}
+	}
+	gotrovi.saveState()
+	return err
+}
+
+func (ix *indexer) queue(info os.FileInfo, p string) {
+	ix.files <- fileJob{info: info, path: p}
+}
+
+// queueDoc sends an already built document, skipping the workers
+func (ix *indexer) queueDoc(item bulkItem) {
+	ix.docs <- item
+}
+
+func (ix *indexer) work(h hash.Hash, extract bool) {
+	defer ix.workers.Done()
+
+	size := ix.g.chunkSize()
+	decompressSize := ix.g.decompressSize()
+	// the content read at once is bounded by the exclude size too
+	max := decompressSize
+	if ix.g.conf.Exclude.Size < max {
+		max = ix.g.conf.Exclude.Size
+	}
+	chunked := size > 0 && max < decompressSize
+	for job := range ix.files {
+		if !job.info.IsDir() && ix.g.isExpanded(job.path) {
+			ix.g.dropMembers(job.path)
+			err := ix.g.encodeArchive(h, job.info, job.path, extract, func(doc *FileDescriptionDoc) {
+				ix.docs <- bulkItem{path: doc.FullName, info: job.info, doc: doc, extracted: doc.Data == ""}
+			})
+			if err != nil {
+				Error.Println("Sync", job.path, ":", err)
+				atomic.AddInt64(&ix.failed, 1)
+			}
+			continue
+		}
+		if format := ix.g.mailFormat(job.path); format != "" && !job.info.IsDir() {
+			ix.g.dropMembers(job.path)
+			err := ix.g.encodeMail(h, job.info, job.path, format, extract, func(doc *FileDescriptionDoc) {
+				ix.docs <- bulkItem{path: doc.FullName, info: job.info, doc: doc, extracted: doc.Data == ""}
+			})
+			if err != nil {
+				Error.Println("Sync", job.path, ":", err)
+				atomic.AddInt64(&ix.failed, 1)
+			}
+			continue
+		}
+		if !job.info.IsDir() && metadataOnly(job.path) {
+			doc, err := encodeMetadata(h, job.info, job.path)
+			if err != nil {
+				Error.Println("Sync", job.path, ":", err)
+				atomic.AddInt64(&ix.failed, 1)
+				continue
+			}
+			ix.docs <- bulkItem{path: job.path, info: job.info, doc: doc, extracted: true}
+			continue
+		}
+		// big files and compressed files of big content are read in chunks
+		if size == 0 || job.info.IsDir() || job.info.Size() <= ix.g.conf.Exclude.Size {
+			doc, err := encodeFile(h, job.info, job.path, extract, max, chunked)
+			if err != errTooBig {
+				if err != nil {
+					Error.Println("Sync", job.path, ":", err)
+					atomic.AddInt64(&ix.failed, 1)
+					continue
+				}
+				ix.docs <- bulkItem{path: job.path, info: job.info, doc: doc, extracted: doc.Attachment != nil}
+				continue
+			}
+		}
+		err := encodeChunks(h, job.info, job.path, size, decompressSize, func(doc *FileDescriptionDoc) {
+			ix.docs <- bulkItem{path: chunkID(job.path, doc.Chunk), info: job.info, doc: doc, extracted: true}
+		})
+		if err != nil {
+			Error.Println("Sync", job.path, ":", err)
+			atomic.AddInt64(&ix.failed, 1)
+		}
+	}
+}
+
+// encodeFile builds the document for p. The content is either extracted
+// locally or sent in Data for the ingest attachment pipeline, see
+// setContent. Compressed files are decompressed up to decompressSize bytes,
+// a bigger content being indexed by that part unless chunked is set, when
+// errTooBig is returned for it to be indexed in chunks.
+func encodeFile(h hash.Hash, info os.FileInfo, p string, extract bool, decompressSize int64, chunked bool) (*FileDescriptionDoc, error) {
+	var file FileDescriptionDoc
+
+	file.FileName = info.Name()
+	file.Path = filepath.Dir(p)
+	file.FullName = p
+	file.IsFolder = info.IsDir()
+	file.Date = fileDate(info.ModTime())
+	file.Mode = info.Mode().String()
+
+	if !info.IsDir() {
+		sum, err := hashFile(h, p)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		// compressed files are read decompressed, up to decompressSize, one
+		// more byte telling whether that is the whole content
+		var content []byte
+		r, closer, c, err := decompressedReader(f, decompressSize+1)
+		if err == nil {
+			content, err = ioutil.ReadAll(r)
+			if closer != nil {
+				closer.Close()
+			}
+		}
+		if err != nil && c != nil {
+			Warning.Println("Unable to decompress", p, ":", err)
+			c = nil
+			_, err = f.Seek(0, io.SeekStart)
+			if err == nil {
+				content, err = ioutil.ReadAll(f)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := p
+		if c != nil {
+			name = c.contentName(p)
+			if int64(len(content)) > decompressSize && chunked {
+				return nil, errTooBig
+			}
+			if int64(len(content)) > decompressSize {
+				content = content[:decompressSize]
+			} else {
+				file.UncompressedSize = int64(len(content))
+			}
+		}
+
+		setContent(&file, name, content, extract)
+		file.Size = info.Size()
+		file.Extension = filepath.Ext(info.Name())
+		file.Hash = sum
+	}
+
+	return &file, nil
+}
+
+func (ix *indexer) send() {
+	defer ix.sender.Done()
+
+	var batch []bulkItem
+	size := 0
+	for item := range ix.docs {
+		batch = append(batch, item)
+		size = size + len(item.doc.Data)
+		if item.doc.Attachment != nil {
+			size = size + len(item.doc.Attachment.Content)
+		}
+		if len(batch) >= BULK_MAX_DOCS || size >= BULK_MAX_BYTES {
+			ix.flush(batch)
+			batch = nil
+			size = 0
+		}
+	}
+	ix.flush(batch)
+}
+
+// record adds the indexed items of batch to the sync state
+func (ix *indexer) record(batch []bulkItem, retry []bulkItem, failed []bulkItem) {
+	skip := make(map[string]bool, len(retry)+len(failed))
+	for _, item := range retry {
+		skip[item.path] = true
+	}
+	for _, item := range failed {
+		skip[item.path] = true
+	}
+	generation := ix.g.backend.Generation()
+	for _, item := range batch {
+		if skip[item.path] || item.doc.Chunk > 0 || item.doc.Archive != "" {
+			continue
+		}
+		// chunks left from a bigger version of the file
+		chunks := item.doc.Chunks
+		if chunks == 0 {
+			chunks = 1
+		}
+		if old, ok := ix.g.state.getGeneration(item.path, generation); ok && old.Generation == generation && old.Chunks > chunks {
+			err := ix.g.backend.DeleteChunks(item.path, chunks)
+			if err != nil {
+				Error.Println("Unable to delete the chunks of", item.path, ":", err)
+			}
+		}
+		ix.g.state.indexed(item, generation)
+	}
+}
+
+func (ix *indexer) flush(batch []bulkItem) {
+	for attempt := 1; len(batch) > 0; attempt++ {
+		if attempt > 1 {
+			if attempt > BULK_RETRY_COUNT+1 {
+				for _, item := range batch {
+					Error.Println("Giving up on file: ", item.path)
+				}
+				atomic.AddInt64(&ix.failed, int64(len(batch)))
+				return
+			}
+			Trace.Println("Retrying", len(batch), "documents")
+			time.Sleep(time.Duration(attempt-1) * BULK_RETRY_TIME)
+		}
+		retry, failed := ix.g.backend.Index(batch)
+		ix.record(batch, retry, failed)
+		atomic.AddInt64(&ix.indexed, int64(len(batch)-len(retry)-len(failed)))
+		atomic.AddInt64(&ix.failed, int64(len(failed)))
+		batch = retry
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Checkpoints of the sync walk, so an interrupted sync can continue with
+// --resume instead of starting from scratch. The folders are walked in
+// lexical order, so the last completed path tells what is left.
+
+const CHECKPOINT_FILE = "checkpoint.json"
+
+// Minimum time between checkpoints, each one waits for the queued files to
+// be indexed
+const CHECKPOINT_TIME = 30 * time.Second
+
+var errInterrupted = errors.New("sync interrupted")
+
+type checkpoint struct {
+	Mode string `json:"mode"`
+	// index generation being built by a forced sync
+	Generation string `json:"generation,omitempty"`
+	// position in conf.Index of the folder being walked
+	Index  int    `json:"index"`
+	Folder string `json:"folder"`
+	// last path completed in Folder
+	Path    string `json:"path"`
+	Count   int    `json:"count"`
+	Updated int    `json:"updated"`
+	// new files found by update, indexed once the walk is done
+	Created []string `json:"created,omitempty"`
+
+	saved time.Time
+}
+
+func checkpointFile() string {
+	return GOTROVI_SETTINGS_FOLDER + CHECKPOINT_FILE
+}
+
+func newCheckpoint(mode string) *checkpoint {
+	return &checkpoint{Mode: mode, saved: time.Now()}
+}
+
+func loadCheckpoint(conf GotroviConf) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointFile())
+	if err != nil {
+		return nil, err
+	}
+	cp := newCheckpoint("")
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Index < len(conf.Index) && conf.Index[cp.Index].Folder != cp.Folder {
+		return nil, fmt.Errorf("the indexed folders changed since the sync was interrupted")
+	}
+	return cp, nil
+}
+
+func removeCheckpoint() {
+	err := os.Remove(checkpointFile())
+	if err != nil && !os.IsNotExist(err) {
+		Error.Println(err)
+	}
+}
+
+// startFolder moves the checkpoint to the folder about to be walked
+func (cp *checkpoint) startFolder(id int, folder string) {
+	if cp == nil || id <= cp.Index && cp.Folder != "" {
+		return
+	}
+	cp.Index = id
+	cp.Folder = folder
+	cp.Path = ""
+}
+
+// walkDone marks the walk of the n folders as completed
+func (cp *checkpoint) walkDone(n int) {
+	cp.Index = n
+	cp.Folder = ""
+	cp.Path = ""
+}
+
+// done records p as completed
+func (cp *checkpoint) done(p string) {
+	if cp == nil {
+		return
+	}
+	cp.Path = p
+	cp.Count = cp.Count + 1
+}
+
+// skip tells whether p in the folder id was completed before the checkpoint
+// and, for folders, whether all their contents were too
+func (cp *checkpoint) skip(id int, p string, isDir bool) (bool, bool) {
+	if cp == nil || id > cp.Index || cp.Path == "" {
+		return false, false
+	}
+	if id < cp.Index {
+		return true, isDir
+	}
+	if compareWalk(p, cp.Path) > 0 {
+		return false, false
+	}
+	if isDir && p != cp.Path && !strings.HasPrefix(cp.Path, p+"/") {
+		return true, true
+	}
+	return true, false
+}
+
+// compareWalk compares paths in the order filepath.Walk visits them: by
+// name inside each folder, folders before their contents
+func compareWalk(a string, b string) int {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// saveCheckpoint waits for the queued files to be indexed and records the
+// progress
+func (gotrovi *Gotrovi) saveCheckpoint() {
+	cp := gotrovi.cp
+	if cp == nil {
+		return
+	}
+	if gotrovi.indexer != nil {
+		gotrovi.stopIndexer()
+		gotrovi.startIndexer()
+	}
+
+	cp.Updated = gotrovi.summary.updated
+	cp.Created = cp.Created[:0]
+	for _, job := range gotrovi.created {
+		cp.Created = append(cp.Created, job.path)
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		Error.Println(err)
+		return
+	}
+	tmp := checkpointFile() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, checkpointFile())
+	}
+	if err != nil {
+		Error.Println("Unable to save checkpoint:", err)
+		return
+	}
+	cp.saved = time.Now()
+	Trace.Println("Checkpoint saved at", cp.Path)
+}
+
+// resumeCreated returns the new files found by the interrupted update
+func (cp *checkpoint) resumeCreated() []fileJob {
+	if cp == nil {
+		return nil
+	}
+	var jobs []fileJob
+	for _, p := range cp.Created {
+		info, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, fileJob{info: info, path: p})
+	}
+	return jobs
+}
+
+// catchInterrupt makes the first SIGINT or SIGTERM stop the sync after the
+// current file, so the queued files are indexed and a checkpoint saved. A
+// second one exits right away.
+func (gotrovi *Gotrovi) catchInterrupt() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		fmt.Fprintln(os.Stderr, "\nInterrupted, waiting for the queued files to be indexed. Interrupt again to exit right away")
+		atomic.StoreInt32(&gotrovi.interrupted, 1)
+		<-c
+		os.Exit(130)
+	}()
+}
+
+func (gotrovi *Gotrovi) isInterrupted() bool {
+	return atomic.LoadInt32(&gotrovi.interrupted) != 0
+}
+
+// exitInterrupted drains the indexer, saves the checkpoint and exits
+func (gotrovi *Gotrovi) exitInterrupted() {
+	gotrovi.stopIndexer()
+	gotrovi.saveCheckpoint()
+	err := gotrovi.backend.Close()
+	if err != nil {
+		Error.Println(err)
+	}
+	fmt.Fprintf(os.Stderr, "Sync interrupted after %d files, run it again with --resume to continue\n", gotrovi.cp.Count)
+	os.Exit(130)
+}
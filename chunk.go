@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunked indexing. When chunk_size is set, text files bigger than
+// Exclude.Size are read a chunk at a time instead of being skipped, other big
+// files are still skipped without being read. Each chunk but the first is
+// stored as its own document, with the metadata of the file, its number in
+// chunk and its byte offset in offset. The file document holds the first
+// chunk and the amount of chunks in chunks. Searches collapse the chunks of a
+// file to its best hit.
+
+// Highlighting fails on fields longer than this in Elasticsearch
+const CHUNK_MAX_SIZE = 1000000
+
+// Separates the file path from the chunk number in chunk document ids. It
+// cannot appear in a clean absolute path.
+const CHUNK_ID_SEPARATOR = "//"
+
+// The start of a big file read to tell whether it is text
+const CHUNK_SNIFF_SIZE = 8192
+
+var errNotText = errors.New("not a text file")
+
+// chunkSize is the size of the chunks big files are indexed in, 0 when
+// they are skipped
+func (gotrovi *Gotrovi) chunkSize() int {
+	size := gotrovi.conf.ChunkSize
+	if size > CHUNK_MAX_SIZE {
+		size = CHUNK_MAX_SIZE
+	}
+	return int(size)
+}
+
+// chunkID is the document id of chunk n of p, the file document for 0
+func chunkID(p string, n int) string {
+	if n == 0 {
+		return p
+	}
+	return p + CHUNK_ID_SEPARATOR + strconv.Itoa(n)
+}
+
+// isChunked tells whether s is a chunk or the file document of a chunked
+// file, whose hits are collapsed
+func isChunked(s Source) bool {
+	return s.Chunk > 0 || s.Chunks > 1
+}
+
+// isTextChunk tells whether the start of a file is text: valid UTF-8 without
+// NUL bytes, after any byte order mark
+func isTextChunk(chunk []byte) bool {
+	chunk = bytes.TrimPrefix(chunk, []byte("\xef\xbb\xbf"))
+	return utf8.Valid(chunk) && bytes.IndexByte(chunk, 0) < 0
+}
+
+// isTextFile tells whether the start of p, decompressed, is text, so that
+// only text files bigger than Exclude.Size are hashed and chunked
+func isTextFile(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r, closer, _, err := decompressedReader(f, CHUNK_SNIFF_SIZE)
+	if err != nil {
+		return false
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	buf := make([]byte, CHUNK_SNIFF_SIZE)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	if n == len(buf) {
+		// the last character may be cut
+		n = chunkCut(buf)
+	}
+	return isTextChunk(buf[:n])
+}
+
+// chunkCut returns where a full chunk buffer is cut: after its last line
+// if that keeps at least half of it, otherwise at a character boundary
+func chunkCut(b []byte) int {
+	if i := bytes.LastIndexByte(b, '\n'); i >= len(b)/2 {
+		return i + 1
+	}
+	for s := len(b) - 1; s > 0 && s >= len(b)-utf8.UTFMax; s-- {
+		if utf8.RuneStart(b[s]) {
+			if utf8.FullRune(b[s:]) {
+				return len(b)
+			}
+			return s
+		}
+	}
+	return len(b)
+}
+
+// readChunks reads r in chunks of up to size bytes, calling fn with the
+// number and offset of each. fn must not keep chunk, its buffer is reused.
+func readChunks(r io.Reader, size int, fn func(n int, offset int64, chunk []byte) error) error {
+	buf := make([]byte, size)
+	fill := 0
+	offset := int64(0)
+	for n := 0; ; n++ {
+		m, err := io.ReadFull(r, buf[fill:])
+		fill = fill + m
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if fill == 0 {
+			return nil
+		}
+		cut := fill
+		if !last {
+			cut = chunkCut(buf[:fill])
+		}
+		err = fn(n, offset, buf[:cut])
+		if err != nil {
+			return err
+		}
+		offset = offset + int64(cut)
+		fill = copy(buf, buf[cut:fill])
+		if last && fill == 0 {
+			return nil
+		}
+	}
+}
+
+// encodeChunks builds the documents of the big file p, calling fn for each
+// as they are read: the chunks first, then the file document. Files which
+// are no longer text, see isTextFile, are indexed without content.
+// Compressed files are read decompressed, up to decompressSize bytes, the
+// offsets being those of the decompressed content.
+func encodeChunks(h hash.Hash, info os.FileInfo, p string, size int, decompressSize int64, fn func(doc *FileDescriptionDoc)) error {
+	sum, err := hashFile(h, p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, closer, c, err := decompressedReader(f, decompressSize)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	ext := filepath.Ext(info.Name())
+	if c != nil {
+		ext = filepath.Ext(c.contentName(info.Name()))
+	}
+
+	file := FileDescriptionDoc{
+		FileName:  info.Name(),
+		FullName:  p,
+		Path:      filepath.Dir(p),
+		Size:      info.Size(),
+		Extension: filepath.Ext(info.Name()),
+		Hash:      sum,
+		Date:      fileDate(info.ModTime()),
+		Mode:      info.Mode().String(),
+	}
+
+	var contentType string
+	read := int64(0)
+	err = readChunks(r, size, func(n int, offset int64, chunk []byte) error {
+		read = offset + int64(len(chunk))
+		if n == 0 {
+			chunk = bytes.TrimPrefix(chunk, []byte("\xef\xbb\xbf"))
+			if !isTextChunk(chunk) {
+				file.Attachment = &Attachment{ContentType: http.DetectContentType(chunk)}
+				return errNotText
+			}
+			contentType = textContentType(ext, chunk)
+		}
+		text := strings.ToValidUTF8(string(chunk), "")
+		a := &Attachment{Content: text, ContentType: contentType, Language: detectLanguage(text)}
+		file.Chunks = n + 1
+		if n == 0 {
+			file.Attachment = a
+			return nil
+		}
+		doc := file
+		doc.Chunks = 0
+		doc.Chunk = n
+		doc.Offset = offset
+		doc.Attachment = a
+		fn(&doc)
+		return nil
+	})
+	if err == errNotText {
+		Trace.Println("Indexing", p, "without content:", err)
+	} else if err != nil {
+		return err
+	}
+	if c != nil && err == nil && read < decompressSize {
+		file.UncompressedSize = read
+	}
+	fn(&file)
+	return nil
+}
+
+// chunkCollapser passes on the hits of a search with the chunks of each file
+// collapsed into its first hit, which takes the chunk, offset and highlight
+// of the best scoring one. When sorting by score the first hit is the best,
+// otherwise the chunks of a file are next to each other as they share the
+// sort values, so only the last hit kept can still be improved.
+type chunkCollapser struct {
+	seen    map[string]bool
+	pending *SearchHit
+	emit    func(hit SearchHit)
+}
+
+func newChunkCollapser(emit func(hit SearchHit)) *chunkCollapser {
+	return &chunkCollapser{seen: make(map[string]bool), emit: emit}
+}
+
+func (c *chunkCollapser) add(hit SearchHit) {
+	s := hit.Source
+	if isChunked(s) && c.seen[s.FullName] {
+		p := c.pending
+		if p != nil && p.Source.FullName == s.FullName && hit.Score > p.Score {
+			p.Score = hit.Score
+			p.Source.Chunk = s.Chunk
+			p.Source.Offset = s.Offset
+			p.Highlight = hit.Highlight
+		}
+		return
+	}
+	c.flush()
+	if isChunked(s) {
+		c.seen[s.FullName] = true
+	}
+	c.pending = &hit
+}
+
+// flush passes on the last hit kept
+func (c *chunkCollapser) flush() {
+	if c.pending != nil {
+		c.emit(*c.pending)
+		c.pending = nil
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/apoorvam/goterminal"
+)
+
+func TestChunkCut(t *testing.T) {
+	tests := []struct {
+		buf  string
+		want int
+	}{
+		{"line one\nline two\nli", 18},
+		{"one\ntwo\n", 8},
+		{"a\nbcdefghijklmnop", 17},
+		{"no newline at all", 17},
+		{"abcdefgh€", 11},
+		{"abcdefgh\xe2\x82", 8},
+		{"abcdefgh\xe2", 8},
+		{"abcdefghñ", 10},
+		{"abcdefgh\xc3", 8},
+		{"abcdefg\xf0\x9f\x98", 7},
+		{"\xe2\x82", 2},
+	}
+	for _, test := range tests {
+		if got := chunkCut([]byte(test.buf)); got != test.want {
+			t.Errorf("%q: %d, want %d", test.buf, got, test.want)
+		}
+	}
+}
+
+type testChunk struct {
+	n      int
+	offset int64
+	text   string
+}
+
+func testReadChunks(t *testing.T, text string, size int) []testChunk {
+	var chunks []testChunk
+	err := readChunks(strings.NewReader(text), size, func(n int, offset int64, chunk []byte) error {
+		chunks = append(chunks, testChunk{n, offset, string(chunk)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestReadChunks(t *testing.T) {
+	tests := []struct {
+		text string
+		size int
+		want []testChunk
+	}{
+		{"", 8, nil},
+		{"short", 8, []testChunk{{0, 0, "short"}}},
+		{"abcdefgh", 8, []testChunk{{0, 0, "abcdefgh"}}},
+		{"abcdefghijklmnop", 8, []testChunk{{0, 0, "abcdefgh"}, {1, 8, "ijklmnop"}}},
+		{"one\ntwo\nthree\nfour\n", 10, []testChunk{{0, 0, "one\ntwo\n"}, {1, 8, "three\n"}, {2, 14, "four\n"}}},
+		{"aaaaaaaaaaaaaaaaaaaa", 8, []testChunk{{0, 0, "aaaaaaaa"}, {1, 8, "aaaaaaaa"}, {2, 16, "aaaa"}}},
+		{"añoñoñoñoñ", 8, []testChunk{{0, 0, "añoño"}, {1, 7, "ñoñoñ"}}},
+		{"añoñoñoñoño", 8, []testChunk{{0, 0, "añoño"}, {1, 7, "ñoñoñ"}, {2, 15, "o"}}},
+	}
+	for _, test := range tests {
+		got := testReadChunks(t, test.text, test.size)
+		if len(got) != len(test.want) {
+			t.Errorf("%q by %d: %+v, want %+v", test.text, test.size, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q by %d: chunk %d %+v, want %+v", test.text, test.size, i, got[i], test.want[i])
+			}
+		}
+	}
+
+	// chunks join back into the text, each valid UTF-8 and cut after a
+	// line when there is one in its second half
+	text := strings.Repeat("canción 😀 está\n", 50) + strings.Repeat("ü", 300)
+	var joined bytes.Buffer
+	for i, c := range testReadChunks(t, text, 64) {
+		if c.n != i || c.offset != int64(joined.Len()) || len(c.text) > 64 || !utf8.ValidString(c.text) {
+			t.Errorf("chunk %d: %+v", i, c)
+		}
+		if c.offset+int64(len(c.text)) < int64(len(text)) && strings.Contains(c.text[len(c.text)/2:], "\n") && !strings.HasSuffix(c.text, "\n") {
+			t.Errorf("chunk %d not cut at its last line: %q", i, c.text)
+		}
+		joined.WriteString(c.text)
+	}
+	if joined.String() != text {
+		t.Errorf("chunks joined differ from the text")
+	}
+}
+
+func TestSyncUpdateShrunk(t *testing.T) {
+	settings, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(settings)
+	GOTROVI_SETTINGS_FOLDER = settings + "/"
+	root := filepath.Join(settings, "root")
+	line := "a line of the log file\n"
+	// smaller than the exclude size compressed
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(strings.Repeat(line, 20)))
+	w.Close()
+	testIgnoreTree(t, root, map[string]string{
+		"big.log":    strings.Repeat(line, 20),
+		"old.log.gz": gz.String(),
+		"disk.iso":   "CD001" + strings.Repeat("\x00\x01\x02\xff", 100),
+	})
+	p := filepath.Join(root, "big.log")
+
+	var g Gotrovi
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 64}, ChunkSize: 100, Backend: BACKEND_LOCAL, Hash: "md5"}
+	g.jobs = 2
+	g.writer = goterminal.New(ioutil.Discard)
+	g.OpenBackend()
+	g.OpenState()
+	g.InitHash()
+	g.SyncForced(0)
+	g.cp = nil
+
+	chunks := func() int {
+		n := 1
+		for g.backend.Exists(chunkID(p, n)) {
+			n = n + 1
+		}
+		return n
+	}
+	// 4 lines in each chunk
+	if n := chunks(); n != 5 {
+		t.Fatalf("%d chunks indexed, want 5", n)
+	}
+	if g.backend.Exists(filepath.Join(root, "disk.iso")) {
+		t.Error("big binary file indexed")
+	}
+	if gz.Len() > 64 || !g.backend.Exists(chunkID(filepath.Join(root, "old.log.gz"), 4)) {
+		t.Errorf("compressed file of %d bytes not chunked", gz.Len())
+	}
+
+	testIgnoreTree(t, root, map[string]string{"big.log": strings.Repeat(line, 8)})
+	g.startIndexer()
+	g.SyncUpdate(false)
+	g.stopIndexer()
+	if n := chunks(); n != 2 {
+		t.Errorf("%d chunks after the file shrank, want 2", n)
+	}
+	if g.backend.Exists(chunkID(p, 2)) || g.backend.Exists(chunkID(p, 4)) {
+		t.Error("chunks of the bigger file left")
+	}
+
+	os.Remove(p)
+	g.startIndexer()
+	g.SyncUpdate(false)
+	g.stopIndexer()
+	if g.backend.Exists(p) || g.backend.Exists(chunkID(p, 1)) {
+		t.Error("chunks of the deleted file left")
+	}
+}
+
+func TestChunkExclusion(t *testing.T) {
+	root, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// a character cut at the end of the part read is still text
+	cut := strings.Repeat("a", CHUNK_SNIFF_SIZE-1) + "ñ and more"
+	testIgnoreTree(t, root, map[string]string{
+		"big.log":   strings.Repeat("a line of the log file\n", 20),
+		"cut.txt":   cut,
+		"disk.iso":  "CD001" + strings.Repeat("\x00\x01\x02\xff", 100),
+		"latin.txt": strings.Repeat("caf\xe9 ", 20),
+		"small.bin": "\x00\x01",
+		"log.gz":    string(testCompress(t, "gzip")),
+	})
+	tests := map[string]bool{
+		"big.log":   false,
+		"cut.txt":   false,
+		"disk.iso":  true,
+		"latin.txt": true,
+		"small.bin": false,
+		"log.gz":    false,
+	}
+
+	var g Gotrovi
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 16}, ChunkSize: 100}
+	for name, excluded := range tests {
+		p := filepath.Join(root, name)
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := g.exclusion(0, info, p)
+		if (r != nil) != excluded || r != nil && r.text != "exclude.size 16" {
+			t.Errorf("%s excluded by %v, want %v", name, r, excluded)
+		}
+	}
+}
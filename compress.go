@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressed files. Files compressed with gzip, bzip2, xz or zstd, found by
+// their magic bytes, are decompressed as they are read and indexed by their
+// content, under the name without the compression extension, so
+// app.log.gz is indexed as the text of app.log. size stays the size on
+// disk, uncompressed_size records the decompressed size.
+
+// Decompressed bytes read from a compressed file, unless decompress_size
+// is set
+const DECOMPRESS_MAX_SIZE = 64 * 1024 * 1024
+
+// Bytes of the header of a file needed to tell its compression
+const COMPRESSION_HEADER_SIZE = 10
+
+type compression struct {
+	name  string
+	magic []byte
+	// extensions removed from the name to get that of the content
+	ext        []string
+	decompress func(r io.Reader) (io.ReadCloser, error)
+	// checks the header further than the magic bytes, if not nil
+	header func(head []byte) bool
+}
+
+var compressions = []compression{
+	{"gzip", []byte{0x1f, 0x8b}, []string{".gz", ".gzip"}, gzipReader, nil},
+	{"bzip2", []byte("BZh"), []string{".bz2", ".bzip2"}, bzip2Reader, bzip2Header},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0}, []string{".xz"}, xzReader, nil},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, []string{".zst", ".zstd"}, zstdReader, nil},
+}
+
+// bzip2Header tells whether head is followed by the block size, 1 to 9, and
+// the magic of the first block, as "BZh" alone starts many text files
+func bzip2Header(head []byte) bool {
+	return len(head) >= 10 && head[3] >= '1' && head[3] <= '9' && bytes.Equal(head[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59})
+}
+
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xr), nil
+}
+
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// compressionOf returns the compression of a file starting with head, nil
+// if it is not compressed
+func compressionOf(head []byte) *compression {
+	for i, c := range compressions {
+		if bytes.HasPrefix(head, c.magic) && (c.header == nil || c.header(head)) {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+// contentName is the name of the compressed file p without the extension
+// of c, p if it has none
+func (c *compression) contentName(p string) string {
+	for _, ext := range c.ext {
+		if strings.HasSuffix(strings.ToLower(p), ext) {
+			return p[:len(p)-len(ext)]
+		}
+	}
+	return p
+}
+
+func (gotrovi *Gotrovi) decompressSize() int64 {
+	if gotrovi.conf.DecompressSize > 0 {
+		return gotrovi.conf.DecompressSize
+	}
+	return DECOMPRESS_MAX_SIZE
+}
+
+// decompressedReader wraps r in a decompressor if it is compressed, reading
+// up to max decompressed bytes. The compression is nil otherwise.
+func decompressedReader(r io.Reader, max int64) (io.Reader, io.Closer, *compression, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(COMPRESSION_HEADER_SIZE)
+	c := compressionOf(head)
+	if c == nil {
+		return br, nil, nil, nil
+	}
+	dr, err := c.decompress(br)
+	if err != nil {
+		return nil, nil, c, err
+	}
+	return io.LimitReader(dr, max), dr, c, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const testCompressed = "hello compressed world\n"
+
+// testBzip2 is testCompressed compressed with bzip2, which the standard
+// library only reads
+const testBzip2 = "425a68393141592653598a37738f000004d180001040000e46d88020003100d0014f40693d2390f748a22248cd5b3eb5f1772453850908a37738f0"
+
+// testCompress compresses testCompressed with the compression name
+func testCompress(t *testing.T, name string) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch name {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "bzip2":
+		data, _ := hex.DecodeString(testBzip2)
+		return data
+	case "xz":
+		w, err = xz.NewWriter(&b)
+	case "zstd":
+		w, err = zstd.NewWriter(&b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testCompressed)
+	w.Close()
+	return b.Bytes()
+}
+
+func TestCompressionOf(t *testing.T) {
+	for _, name := range []string{"gzip", "bzip2", "xz", "zstd"} {
+		c := compressionOf(testCompress(t, name))
+		if c == nil || c.name != name {
+			t.Errorf("%s: detected as %v", name, c)
+		}
+	}
+	for _, head := range []string{"", "BZh", "BZh is how this text file starts", "BZh91AY&SX", "BZh01AY&SY", "\x1f", "plain text"} {
+		if c := compressionOf([]byte(head)); c != nil {
+			t.Errorf("%q: detected as %s", head, c.name)
+		}
+	}
+}
+
+func TestDecompressedReader(t *testing.T) {
+	for _, name := range []string{"gzip", "bzip2", "xz", "zstd"} {
+		for _, max := range []int64{DECOMPRESS_MAX_SIZE, 5} {
+			r, closer, c, err := decompressedReader(bytes.NewReader(testCompress(t, name)), max)
+			if err != nil || c == nil || c.name != name {
+				t.Errorf("%s: %v %v", name, c, err)
+				continue
+			}
+			data, err := ioutil.ReadAll(r)
+			closer.Close()
+			want := testCompressed
+			if int64(len(want)) > max {
+				want = want[:max]
+			}
+			if err != nil || string(data) != want {
+				t.Errorf("%s up to %d: %q %v", name, max, data, err)
+			}
+		}
+	}
+
+	r, closer, c, err := decompressedReader(bytes.NewReader([]byte(testCompressed)), 5)
+	data, _ := ioutil.ReadAll(r)
+	if c != nil || closer != nil || err != nil || string(data) != testCompressed {
+		t.Errorf("plain text: %v %v %q", c, err, data)
+	}
+}
+
+func TestEncodeFileCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name           string
+		content        []byte
+		decompressSize int64
+		text           string
+		uncompressed   int64
+	}{
+		{"app.log.gz", testCompress(t, "gzip"), DECOMPRESS_MAX_SIZE, testCompressed, int64(len(testCompressed))},
+		{"app.log.xz", testCompress(t, "xz"), DECOMPRESS_MAX_SIZE, testCompressed, int64(len(testCompressed))},
+		{"app.log.zst", testCompress(t, "zstd"), 5, testCompressed[:5], 0},
+		{"broken.gz", []byte("\x1f\x8b broken"), DECOMPRESS_MAX_SIZE, "", 0},
+	}
+	for _, test := range tests {
+		p := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(p, test.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(p)
+		doc, err := encodeFile(md5.New(), info, p, true, test.decompressSize, false)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		sum := md5.Sum(test.content)
+		if doc.Hash != hex.EncodeToString(sum[:]) || doc.Size != int64(len(test.content)) || doc.UncompressedSize != test.uncompressed {
+			t.Errorf("%s: hash %s size %d uncompressed %d", test.name, doc.Hash, doc.Size, doc.UncompressedSize)
+		}
+		if test.text != "" && (doc.Attachment == nil || doc.Attachment.Content != strings.TrimSpace(test.text)) {
+			t.Errorf("%s: %+v", test.name, doc.Attachment)
+		}
+	}
+	// a content bigger than read is left to the chunks when chunking
+	p := filepath.Join(dir, "app.log.gz")
+	info, _ := os.Stat(p)
+	if doc, err := encodeFile(md5.New(), info, p, true, 5, true); err != errTooBig {
+		t.Errorf("chunked: %+v %v", doc, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pborman/getopt"
+)
+
+// gotrovi dupes: groups of identical files according to the indexed hashes
+
+type dupesGroup struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Count  int      `json:"count"`
+	Wasted int64    `json:"wasted"`
+	Files  []string `json:"files"`
+}
+
+type dupesReport struct {
+	Groups []dupesGroup `json:"groups"`
+	Files  int          `json:"files"`
+	Wasted int64        `json:"wasted"`
+	// index entries dropped by --verify
+	Stale int `json:"stale,omitempty"`
+}
+
+// humanSize formats a size in bytes with binary units
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return v * mult, nil
+}
+
+// dupesQuery builds the query selecting the candidate files
+func dupesQuery(paths []string, extensions []string, minSize int64) (string, error) {
+	query := "isfolder:false"
+	if minSize > 0 {
+		query = query + " AND size:>=" + strconv.FormatInt(minSize, 10)
+	}
+	if len(paths) != 0 {
+		dir_query, err := pathsQuery(paths)
+		if err != nil {
+			return "", err
+		}
+		query = query + " AND " + dir_query
+	}
+	if len(extensions) != 0 {
+		var ext []string
+		for _, e := range extensions {
+			for _, e := range strings.Split(e, ",") {
+				if e == "" {
+					continue
+				}
+				if !strings.HasPrefix(e, ".") {
+					e = "." + e
+				}
+				ext = append(ext, "extension:\""+e+"\"")
+			}
+		}
+		query = query + " AND (" + strings.Join(ext, " OR ") + ")"
+	}
+	return query, nil
+}
+
+// verifyGroup hashes the files of a group again, keeping those which still
+// have the indexed hash
+func (gotrovi *Gotrovi) verifyGroup(docs []Source) ([]Source, int) {
+	var verified []Source
+	stale := 0
+	for _, s := range docs {
+		// members are not on disk, they are checked with their archive
+		if isArchived(s) {
+			verified = append(verified, s)
+			continue
+		}
+		info, err := os.Stat(s.FullName)
+		if err == nil && info.Size() != s.Size {
+			err = fmt.Errorf("size changed")
+		}
+		var sum string
+		if err == nil {
+			sum, err = hashFile(gotrovi.hash, s.FullName)
+		}
+		if err == nil && sum != s.Hash {
+			err = fmt.Errorf("hash changed")
+		}
+		if err != nil {
+			Info.Println("Stale index entry", s.FullName, ":", err)
+			stale = stale + 1
+			continue
+		}
+		verified = append(verified, s)
+	}
+	return verified, stale
+}
+
+func (gotrovi *Gotrovi) Dupes(args []string) {
+	opts := getopt.New()
+	opts.SetProgram("gotrovi dupes")
+	opts.SetParameters("[paths ...]")
+	optHelp := opts.BoolLong("help", 'h', "Show this message")
+	optExt := opts.ListLong("ext", 'e', "Only files with these extensions, may be repeated or comma separated")
+	optMinSize := opts.StringLong("min-size", 's', "1", "Only files of at least this size, K, M, G and T suffixes are allowed. Default is 1")
+	optVerify := opts.BoolLong("verify", 0, "Hash the files again to rule out stale index entries")
+	optOutput := opts.StringLong("output", 'o', OUTPUT_TEXT, "Output format: \"text\" (default) or \"json\"")
+	opts.Parse(args)
+
+	if *optHelp {
+		fmt.Println("Lists groups of identical files, according to their size and indexed hash, in the given paths or the whole index")
+		opts.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if *optOutput != OUTPUT_TEXT && *optOutput != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "Unknown output format \""+*optOutput+"\", use text or json")
+		os.Exit(1)
+	}
+	minSize, err := parseSize(*optMinSize)
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+	query, err := dupesQuery(opts.Args(), *optExt, minSize)
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+	Trace.Println(query)
+
+	if *optVerify {
+		gotrovi.InitHash()
+	}
+
+	finder, ok := gotrovi.backend.(duplicateFinder)
+	if !ok {
+		Error.Println("The " + gotrovi.backendName() + " backend cannot find duplicates")
+		os.Exit(1)
+	}
+	var report dupesReport
+	err = finder.Duplicates(query, func(docs []Source) {
+		if *optVerify {
+			var stale int
+			docs, stale = gotrovi.verifyGroup(docs)
+			report.Stale = report.Stale + stale
+			if len(docs) < 2 {
+				return
+			}
+		}
+		g := dupesGroup{Hash: docs[0].Hash, Size: docs[0].Size, Count: len(docs)}
+		g.Wasted = g.Size * int64(g.Count-1)
+		for _, s := range docs {
+			g.Files = append(g.Files, s.FullName)
+		}
+		sort.Strings(g.Files)
+		report.Groups = append(report.Groups, g)
+		report.Files = report.Files + g.Count
+		report.Wasted = report.Wasted + g.Wasted
+	})
+	if err != nil {
+		Error.Println("Unable to find duplicates:", err)
+		os.Exit(1)
+	}
+
+	// most wasted space first
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Wasted != report.Groups[j].Wasted {
+			return report.Groups[i].Wasted > report.Groups[j].Wasted
+		}
+		return report.Groups[i].Files[0] < report.Groups[j].Files[0]
+	})
+
+	if *optOutput == OUTPUT_JSON {
+		if report.Groups == nil {
+			report.Groups = []dupesGroup{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+
+	for _, g := range report.Groups {
+		fmt.Printf("%s, %d files of %s, %s wasted\n", g.Hash, g.Count, humanSize(g.Size), humanSize(g.Wasted))
+		for _, f := range g.Files {
+			fmt.Println("  " + f)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d groups, %d files, %s wasted\n", len(report.Groups), report.Files, humanSize(report.Wasted))
+	if report.Stale > 0 {
+		fmt.Printf("%d stale index entries skipped, sync to update them\n", report.Stale)
+	}
+}
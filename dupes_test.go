@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testIgnoreTree(t, dir, map[string]string{"same.txt": "same", "changed.txt": "other", "a.zip": ""})
+	var g Gotrovi
+	g.conf.Hash = "md5"
+	g.InitHash()
+	sum, _ := hashFile(g.hash, filepath.Join(dir, "same.txt"))
+	docs := []Source{
+		{FullName: filepath.Join(dir, "same.txt"), Size: 4, Hash: sum},
+		{FullName: filepath.Join(dir, "changed.txt"), Size: 4, Hash: sum},
+		{FullName: filepath.Join(dir, "gone.txt"), Size: 4, Hash: sum},
+		{FullName: memberPath(filepath.Join(dir, "a.zip"), "same.txt"), Size: 4, Hash: sum, Archive: filepath.Join(dir, "a.zip")},
+	}
+	verified, stale := g.verifyGroup(docs)
+	if stale != 2 || len(verified) != 2 || verified[0] != docs[0] || verified[1] != docs[3] {
+		t.Errorf("%d stale, verified %+v", stale, verified)
+	}
+}
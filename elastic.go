@@ -0,0 +1,1476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+// Version of GOTROVI_MAPPING, stored in the index _meta. Increase it whenever
+// the mapping changes so older indexes are detected.
+const GOTROVI_MAPPING_VERSION = 8
+
+// First mapping version whose document ids are the plain paths. Older
+// indexes have query escaped ids, with + for the spaces, so updating them
+// would duplicate those documents: they have to be reindexed first.
+const GOTROVI_ID_VERSION = 8
+
+// Settings and mapping the gotrovi index is created with. filename, path and
+// fullpath are analyzed text with a keyword subfield for exact matches and
+// sorting, path and fullpath also have a tree subfield matching every parent
+// folder, so fullpath.tree:"/home/user" finds everything below /home/user.
+const GOTROVI_MAPPING = `{
+  "settings": {
+    "analysis": {
+      "analyzer": {
+        "path_tree": { "type": "custom", "tokenizer": "path_tree" }
+      },
+      "tokenizer": {
+        "path_tree": { "type": "path_hierarchy", "delimiter": "/" }
+      }
+    }
+  },
+  "mappings": {
+    "_meta": { "gotrovi_mapping_version": %d },
+    "properties": {
+      "filename": {
+        "type": "text",
+        "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } }
+      },
+      "fullpath": {
+        "type": "text",
+        "fields": {
+          "keyword": { "type": "keyword", "ignore_above": 4096 },
+          "tree": { "type": "text", "analyzer": "path_tree", "search_analyzer": "keyword" }
+        }
+      },
+      "path": {
+        "type": "text",
+        "fields": {
+          "keyword": { "type": "keyword", "ignore_above": 4096 },
+          "tree": { "type": "text", "analyzer": "path_tree", "search_analyzer": "keyword" }
+        }
+      },
+      "size": { "type": "long" },
+      "extension": { "type": "keyword" },
+      "hash": { "type": "keyword" },
+      "data": { "type": "binary" },
+      "isfolder": { "type": "boolean" },
+      "date": { "type": "date", "format": "strict_date_optional_time||epoch_millis" },
+      "mode": { "type": "keyword" },
+      "chunk": { "type": "integer" },
+      "chunks": { "type": "integer" },
+      "offset": { "type": "long" },
+      "archive": {
+        "type": "text",
+        "fields": { "keyword": { "type": "keyword", "ignore_above": 4096 } }
+      },
+      "members": { "type": "integer" },
+      "uncompressed_size": { "type": "long" },
+      "mail": {
+        "properties": {
+          "from": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "to": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "cc": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "subject": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "date": { "type": "date", "format": "strict_date_optional_time||epoch_millis" },
+          "message_id": { "type": "keyword", "ignore_above": 1024 }
+        }
+      },
+      "meta": {
+        "properties": {
+          "title": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "author": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "subject": { "type": "text" },
+          "keywords": { "type": "text" },
+          "pages": { "type": "integer" },
+          "created": { "type": "date", "format": "strict_date_optional_time||epoch_millis" },
+          "camera": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "taken": { "type": "date", "format": "strict_date_optional_time||epoch_millis" },
+          "gps": { "type": "geo_point" },
+          "width": { "type": "integer" },
+          "height": { "type": "integer" },
+          "artist": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "album": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "genre": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 1024 } } },
+          "year": { "type": "integer" },
+          "track": { "type": "integer" }
+        }
+      },
+      "attachment": {
+        "properties": {
+          "content": { "type": "text" },
+          "content_type": { "type": "keyword" },
+          "language": { "type": "keyword" },
+          "error": { "type": "keyword", "ignore_above": 1024 }
+        }
+      }
+    }
+  }
+}`
+
+type esBackend struct {
+	conf   ESConfig
+	es     *elasticsearch.Client
+	ingest bool
+	// the attachment pipeline is set
+	pipeline bool
+	// the index exists, with whatever mapping version
+	created bool
+	// generation being built by a reindex, empty to write through the alias
+	target string
+	// index the alias points to
+	generation string
+	// the server is OpenSearch rather than Elasticsearch
+	opensearch bool
+	// the index the alias points to has ids older than GOTROVI_ID_VERSION
+	oldIDs bool
+	// wildcard queries take case_insensitive, from 7.10 and in OpenSearch
+	caseInsensitive bool
+}
+
+type indexAliases struct {
+	Aliases map[string]json.RawMessage `json:"aliases"`
+}
+
+type indexMeta struct {
+	Mappings struct {
+		Meta struct {
+			Version int `json:"gotrovi_mapping_version"`
+		} `json:"_meta"`
+	} `json:"mappings"`
+}
+
+type bulkItemResult struct {
+	Id     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+// addresses are the urls of the cluster nodes, or else host and port
+func (b *esBackend) addresses() []string {
+	if len(b.conf.URLs) != 0 {
+		return b.conf.URLs
+	}
+	return []string{"http://" + b.conf.Host + ":" + strconv.Itoa(b.conf.Port)}
+}
+
+// authTransport adds the credentials to every request sent to the cluster
+type authTransport struct {
+	base     http.RoundTripper
+	username string
+	password string
+	apiKey   string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.apiKey == "" && t.username == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	} else {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// transport builds the http transport every request to the cluster goes
+// through, with the TLS settings and credentials of the configuration
+func (b *esBackend) transport() (http.RoundTripper, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: b.conf.InsecureSkipVerify}
+	if b.conf.CACert != "" {
+		pem, err := ioutil.ReadFile(b.conf.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", b.conf.CACert)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if b.conf.ClientCert != "" || b.conf.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(b.conf.ClientCert, b.conf.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsConf
+
+	apiKey := b.conf.APIKey
+	if strings.Contains(apiKey, ":") {
+		apiKey = base64.StdEncoding.EncodeToString([]byte(apiKey))
+	}
+	return &authTransport{base: base, username: b.conf.Username, password: b.conf.Password, apiKey: apiKey}, nil
+}
+
+// esInfo is the response of the root endpoint, OpenSearch tells its
+// distribution in the version
+type esInfo struct {
+	Version struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+}
+
+func (b *esBackend) Open() (err error) {
+	tr, err := b.transport()
+	if err != nil {
+		Error.Println("Invalid ElasticSearch TLS settings:", err)
+		return err
+	}
+	cfg := elasticsearch.Config{
+		Addresses: b.addresses(),
+		Transport: tr,
+	}
+
+	b.es, err = elasticsearch.NewClient(cfg)
+
+	if err != nil {
+		Error.Println("Error connecting to ElasticSearch " + strings.Join(cfg.Addresses, ", "))
+		Error.Println(err)
+		return err
+	}
+	res, err := b.es.Info()
+
+	Trace.Println(res)
+
+	if err != nil {
+		Trace.Println("Error connecting to ElasticSearch " + strings.Join(cfg.Addresses, ", "))
+		Trace.Println(err)
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("ElasticSearch returned %s", res.Status())
+	}
+	var info esInfo
+	err = json.NewDecoder(res.Body).Decode(&info)
+	if err != nil {
+		return err
+	}
+	b.opensearch = info.Version.Distribution == "opensearch"
+	b.caseInsensitive = b.opensearch || versionAtLeast(info.Version.Number, 7, 10)
+	if b.opensearch {
+		Info.Println("Connected to OpenSearch", info.Version.Number)
+	} else {
+		Info.Println("Connected to ElasticSearch", info.Version.Number)
+	}
+
+	return b.checkMapping()
+}
+
+// versionAtLeast tells whether the version number is major.minor or later
+func versionAtLeast(number string, major int, minor int) bool {
+	var m, n int
+	fmt.Sscanf(number, "%d.%d", &m, &n)
+	return m > major || m == major && n >= minor
+}
+
+// checkMapping looks up the mapping version of an existing index and warns
+// when it was created by an older gotrovi
+func (b *esBackend) checkMapping() error {
+	req := esapi.IndicesGetMappingRequest{Index: []string{GOTROVI_ES_INDEX}}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		Trace.Println("Index " + GOTROVI_ES_INDEX + " not found, it will be created on sync")
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		Error.Println(string(body))
+		return fmt.Errorf("unable to get mapping of index %s: %s", GOTROVI_ES_INDEX, res.Status())
+	}
+	b.created = true
+
+	var data map[string]indexMeta
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return err
+	}
+	for index, m := range data {
+		b.generation = index
+		b.oldIDs = m.Mappings.Meta.Version < GOTROVI_ID_VERSION
+		if m.Mappings.Meta.Version < GOTROVI_MAPPING_VERSION {
+			Warning.Printf("Index %s has mapping version %d, current version is %d\n", GOTROVI_ES_INDEX, m.Mappings.Meta.Version, GOTROVI_MAPPING_VERSION)
+			if b.oldIDs {
+				fmt.Fprintf(os.Stderr, "The index was created by an older gotrovi with other document ids, it cannot be updated. Run \"gotrovi -s forced\" to reindex\n")
+			} else {
+				fmt.Fprintf(os.Stderr, "The index was created by an older gotrovi, some queries may not work. Run \"gotrovi -s forced\" to reindex\n")
+			}
+		} else if m.Mappings.Meta.Version > GOTROVI_MAPPING_VERSION {
+			Warning.Printf("Index %s has mapping version %d, newer than %d\n", GOTROVI_ES_INDEX, m.Mappings.Meta.Version, GOTROVI_MAPPING_VERSION)
+		}
+	}
+	return nil
+}
+
+// The GOTROVI_ES_INDEX alias points to the current generation of the index,
+// named GOTROVI_ES_INDEX-<timestamp>. A reindex builds a new generation and
+// moves the alias once it is complete.
+func generationName() string {
+	return GOTROVI_ES_INDEX + "-" + time.Now().UTC().Format("20060102150405")
+}
+
+// writeIndex is where documents are indexed
+func (b *esBackend) writeIndex() string {
+	if b.target != "" {
+		return b.target
+	}
+	return GOTROVI_ES_INDEX
+}
+
+// createIndex creates a generation with GOTROVI_MAPPING, pointing the alias to
+// it if alias is set
+func (b *esBackend) createIndex(name string, alias bool) error {
+	Trace.Println("Creating index " + name)
+
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(fmt.Sprintf(GOTROVI_MAPPING, GOTROVI_MAPPING_VERSION)), &body)
+	if err != nil {
+		return err
+	}
+	if alias {
+		body["aliases"] = map[string]interface{}{GOTROVI_ES_INDEX: map[string]interface{}{}}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req := esapi.IndicesCreateRequest{
+		Index: name,
+		Body:  bytes.NewReader(data),
+	}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		body, _ := ioutil.ReadAll(res.Body)
+		Error.Println(string(body))
+		return fmt.Errorf("unable to create index %s: %s", name, res.Status())
+	}
+	return nil
+}
+
+// aliases returns the indexes matching the names with their aliases
+func (b *esBackend) aliases(names ...string) (map[string]indexAliases, error) {
+	ignore := true
+	req := esapi.IndicesGetAliasRequest{Index: names, IgnoreUnavailable: &ignore}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data := make(map[string]indexAliases)
+	if res.StatusCode == 404 {
+		return data, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.IsError() {
+		Error.Println(string(body))
+		return nil, fmt.Errorf("unable to get aliases: %s", res.Status())
+	}
+	err = json.Unmarshal(body, &data)
+	return data, err
+}
+
+func (b *esBackend) BeginReindex() error {
+	name := generationName()
+	err := b.createIndex(name, false)
+	if err != nil {
+		return err
+	}
+	Info.Println("Building index " + name)
+	b.target = name
+	return nil
+}
+
+func (b *esBackend) ResumeReindex(generation string) error {
+	indexes, err := b.aliases(generation)
+	if err != nil {
+		return err
+	}
+	if _, ok := indexes[generation]; !ok {
+		return fmt.Errorf("index %s not found", generation)
+	}
+	Info.Println("Resuming index " + generation)
+	b.target = generation
+	return nil
+}
+
+func (b *esBackend) AbortReindex() error {
+	name := b.target
+	b.target = ""
+	if name == "" {
+		return nil
+	}
+	Info.Println("Deleting incomplete index " + name)
+	return b.deleteIndexes(name)
+}
+
+func (b *esBackend) FinishReindex(keep int) error {
+	name := b.target
+	if name == "" {
+		return nil
+	}
+	err := b.Refresh()
+	if err != nil {
+		return err
+	}
+
+	indexes, err := b.aliases(GOTROVI_ES_INDEX, GOTROVI_ES_INDEX+"-*")
+	if err != nil {
+		return err
+	}
+
+	actions := []map[string]interface{}{
+		{"add": map[string]string{"index": name, "alias": GOTROVI_ES_INDEX}},
+	}
+	var previous []string
+	for index, a := range indexes {
+		switch {
+		case index == name:
+		case index == GOTROVI_ES_INDEX:
+			// index created before gotrovi used aliases, it has to go for the alias to take its name
+			actions = append(actions, map[string]interface{}{"remove_index": map[string]string{"index": index}})
+		default:
+			if _, ok := a.Aliases[GOTROVI_ES_INDEX]; ok {
+				actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": GOTROVI_ES_INDEX}})
+			}
+			previous = append(previous, index)
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	req := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(body)}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		body, _ := ioutil.ReadAll(res.Body)
+		Error.Println(string(body))
+		return fmt.Errorf("unable to move alias %s to %s: %s", GOTROVI_ES_INDEX, name, res.Status())
+	}
+	Info.Println("Alias " + GOTROVI_ES_INDEX + " moved to " + name)
+	b.target = ""
+	b.created = true
+	b.generation = name
+	b.oldIDs = false
+
+	// the generation names sort by creation time
+	sort.Sort(sort.Reverse(sort.StringSlice(previous)))
+	if len(previous) <= keep {
+		return nil
+	}
+	Info.Println("Deleting previous indexes", previous[keep:])
+	return b.deleteIndexes(previous[keep:]...)
+}
+
+func (b *esBackend) deleteIndexes(names ...string) error {
+	req := esapi.IndicesDeleteRequest{Index: names}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() && res.StatusCode != 404 {
+		return fmt.Errorf("unable to delete index %s: %s", strings.Join(names, ", "), res.Status())
+	}
+	return nil
+}
+
+func (b *esBackend) Close() error {
+	return nil
+}
+
+func (b *esBackend) initializePipelineAttachment() error {
+
+	// configure Elastic
+	// files the attachment processor fails on are indexed without content,
+	// recording the error
+	body := "{ \"description\" : \"Extract attachment information\", \"processors\" : [ { \"attachment\" : { \"field\" : \"data\" }, \"remove\": { \"field\": \"data\" } } ], \"on_failure\" : [ { \"set\" : { \"field\" : \"attachment.error\", \"value\" : \"{{ _ingest.on_failure_message }}\" } }, { \"remove\" : { \"field\" : \"data\", \"ignore_missing\" : true } } ] }"
+
+	req := esapi.IngestPutPipelineRequest{DocumentID: "attachment", Body: strings.NewReader(body)}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("put pipeline returned %s", res)
+	}
+	return nil
+}
+
+func (b *esBackend) DeleteIndex() error {
+	Trace.Println("Deleting index " + GOTROVI_ES_INDEX)
+	// Delete every generation to start from scratch, which also removes the
+	// alias, then the index of older gotrovi versions named as the alias
+	err := b.deleteIndexes(GOTROVI_ES_INDEX + "-*")
+	if err == nil {
+		err = b.deleteIndexes(GOTROVI_ES_INDEX)
+	}
+	if err != nil {
+		Error.Println(err)
+		return err
+	}
+	b.created = false
+	b.generation = ""
+	return nil
+}
+
+func (b *esBackend) Generation() string {
+	if b.target != "" {
+		return b.target
+	}
+	return b.generation
+}
+
+func (b *esBackend) Refresh() error {
+	req := esapi.IndicesRefreshRequest{Index: []string{b.writeIndex()}}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("refresh of %s returned %s", b.writeIndex(), res.Status())
+	}
+	return nil
+}
+
+// docRequest performs a request on the document for p in index, the alias
+// for reads and writeIndex for writes. The esapi requests cannot be used
+// directly because esapi has issues handling forward slashes
+func (b *esBackend) docRequest(method string, index string, p string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "/"+index+"/_doc/"+url.PathEscape(p), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// set the request header Content-Type for json
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return b.es.Perform(req)
+}
+
+// errOldIDs is returned by the writes to an index older than
+// GOTROVI_ID_VERSION
+var errOldIDs = errors.New("the index has document ids of an older gotrovi, run \"gotrovi -s forced\" to reindex")
+
+func (b *esBackend) Delete(p string) error {
+	if b.oldIDs && b.target == "" {
+		return errOldIDs
+	}
+	resp, err := b.docRequest(http.MethodDelete, b.writeIndex(), p)
+	if err != nil {
+		Error.Println(err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return fmt.Errorf("unable to delete %s: %s", p, resp.Status)
+	}
+	return nil
+}
+
+// DeleteMembers deletes by query the documents whose fullpath starts with
+// the archive p
+func (b *esBackend) DeleteMembers(p string) error {
+	return b.deleteByQuery(map[string]interface{}{"prefix": map[string]string{"fullpath.keyword": p + ARCHIVE_SEPARATOR}})
+}
+
+// DeleteChunks deletes by query the chunk documents of p from on
+func (b *esBackend) DeleteChunks(p string, from int) error {
+	return b.deleteByQuery(map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]string{"fullpath.keyword": p}},
+				map[string]interface{}{"range": map[string]interface{}{"chunk": map[string]int{"gte": from}}},
+			},
+		},
+	})
+}
+
+// deleteByQuery deletes the documents matching query from writeIndex, so
+// that a reindex does not delete them from the generation searched
+func (b *esBackend) deleteByQuery(query map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return err
+	}
+	res, err := b.es.DeleteByQuery([]string{b.writeIndex()}, bytes.NewReader(body), b.es.DeleteByQuery.WithConflicts("proceed"))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("delete by query returned %s", res.Status())
+	}
+	return nil
+}
+
+func (b *esBackend) Exists(p string) (exists bool) {
+	resp, err := b.docRequest(http.MethodGet, GOTROVI_ES_INDEX, p)
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200
+}
+
+func (b *esBackend) Get(p string) (*FileDescriptionDoc, error) {
+	resp, err := b.docRequest(http.MethodGet, GOTROVI_ES_INDEX, p)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unable to get %s: %s", p, resp.Status)
+	}
+	var data struct {
+		Source FileDescriptionDoc `json:"_source"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data.Source, nil
+}
+
+func retryable(status int) bool {
+	return status == 429 || status >= 500
+}
+
+// needsPipeline tells whether some item of batch is left to the attachment
+// pipeline to extract
+func needsPipeline(batch []bulkItem) bool {
+	for _, item := range batch {
+		if !item.extracted {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *esBackend) Index(batch []bulkItem) ([]bulkItem, []bulkItem) {
+	if b.oldIDs && b.target == "" {
+		Error.Println(errOldIDs)
+		return nil, batch
+	}
+	if b.ingest && !b.pipeline && needsPipeline(batch) {
+		err := b.initializePipelineAttachment()
+		if err != nil {
+			Error.Println("Unable to set the attachment pipeline:", err)
+			return nil, batch
+		}
+		b.pipeline = true
+	}
+	if !b.created && b.target == "" {
+		name := generationName()
+		err := b.createIndex(name, true)
+		if err != nil {
+			Error.Println(err)
+			return nil, batch
+		}
+		b.created = true
+		b.generation = name
+	}
+
+	var buf bytes.Buffer
+	var sent []bulkItem
+	var failed []bulkItem
+	for _, item := range batch {
+		id, _ := json.Marshal(item.path)
+		body, err := json.Marshal(item.doc)
+		if err != nil {
+			Error.Println("Sync", item.path, ":", err)
+			failed = append(failed, item)
+			continue
+		}
+		if b.ingest && !item.extracted {
+			fmt.Fprintf(&buf, "{ \"index\" : { \"_id\" : %s, \"pipeline\" : \"attachment\" } }\n", id)
+		} else {
+			fmt.Fprintf(&buf, "{ \"index\" : { \"_id\" : %s } }\n", id)
+		}
+		buf.Write(body)
+		buf.WriteByte('\n')
+		sent = append(sent, item)
+	}
+	if len(sent) == 0 {
+		return nil, failed
+	}
+	batch = sent
+
+	req := esapi.BulkRequest{
+		Index: b.writeIndex(),
+		Body:  &buf,
+	}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		Error.Println("Bulk request failed:", err)
+		return batch, failed
+	}
+	defer res.Body.Close()
+
+	if retryable(res.StatusCode) {
+		Warning.Println("Bulk request rejected:", res.Status())
+		return batch, failed
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		Error.Println(err)
+		return batch, failed
+	}
+	if res.IsError() {
+		Error.Println("ES returned Error", res.Status())
+		Error.Println(string(body))
+		return nil, append(failed, batch...)
+	}
+
+	var data bulkResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		Error.Println(err)
+		return batch, failed
+	}
+
+	var retry []bulkItem
+	for i, item := range data.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, r := range item {
+			switch {
+			case r.Status < 300:
+			case retryable(r.Status):
+				retry = append(retry, batch[i])
+			default:
+				Error.Println("ES returned Error with file: ", batch[i].path)
+				Error.Println("Error: ", string(r.Error))
+				failed = append(failed, batch[i])
+			}
+		}
+	}
+	return retry, failed
+}
+
+// Hits fetched by each request of a search
+const ES_PAGE_SIZE = 1000
+
+// Time the point in time of a search is kept between its requests
+const ES_KEEP_ALIVE = "1m"
+
+// esSortFields maps the sort fields to the fields ES sorts on
+var esSortFields = map[string]string{
+	SORT_SCORE:  "_score",
+	"filename":  "filename.keyword",
+	"fullpath":  "fullpath.keyword",
+	"path":      "path.keyword",
+	"size":      "size",
+	"date":      "date",
+	"extension": "extension",
+}
+
+// openPIT opens a point in time of the index, so the pages of a search see
+// the same documents while a sync runs. ES older than 7.10 and OpenSearch
+// older than 2.4 have no point in time, the search then pages over the live
+// index. OpenSearch has its own point in time API under _search.
+func (b *esBackend) openPIT() (string, error) {
+	endpoint := "/_pit"
+	if b.opensearch {
+		endpoint = "/_search/point_in_time"
+	}
+	req, err := http.NewRequest(http.MethodPost, "/"+GOTROVI_ES_INDEX+endpoint+"?keep_alive="+ES_KEEP_ALIVE, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := b.es.Perform(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("unable to open point in time: %s", res.Status)
+	}
+	var data struct {
+		Id    string `json:"id"`
+		PitId string `json:"pit_id"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	if b.opensearch {
+		return data.PitId, err
+	}
+	return data.Id, err
+}
+
+func (b *esBackend) closePIT(id string) {
+	body, _ := json.Marshal(map[string]string{"id": id})
+	endpoint := "/_pit"
+	if b.opensearch {
+		body, _ = json.Marshal(map[string][]string{"pit_id": {id}})
+		endpoint = "/_search/point_in_time"
+	}
+	req, err := http.NewRequest(http.MethodDelete, endpoint, bytes.NewReader(body))
+	if err != nil {
+		Error.Println(err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res, err := b.es.Perform(req)
+	if err != nil {
+		Warning.Println("Unable to close point in time:", err)
+		return
+	}
+	res.Body.Close()
+}
+
+// esTextFields are analyzed, wildcards are matched against their lowercased
+// terms
+var esTextFields = map[string]bool{"filename": true, "fullpath": true, "path": true, "attachment.content": true}
+
+// esQuery compiles a parsed query to the query DSL. Wildcards ignoring case
+// are case sensitive before 7.10.
+func (b *esBackend) esQuery(n *QueryNode) map[string]interface{} {
+	switch n.Kind {
+	case QUERY_BOOL:
+		bq := make(map[string]interface{})
+		for occur, clauses := range map[string][]*QueryNode{"must": n.Must, "should": n.Should, "must_not": n.MustNot} {
+			if len(clauses) == 0 {
+				continue
+			}
+			var queries []interface{}
+			for _, c := range clauses {
+				queries = append(queries, b.esQuery(c))
+			}
+			bq[occur] = queries
+		}
+		return map[string]interface{}{"bool": bq}
+	case QUERY_EXISTS:
+		return map[string]interface{}{"exists": map[string]string{"field": n.Field}}
+	case QUERY_TERM:
+		return map[string]interface{}{"match": map[string]string{n.Field: n.Value}}
+	case QUERY_PHRASE:
+		return map[string]interface{}{"match_phrase": map[string]string{n.Field: n.Value}}
+	case QUERY_WILDCARD:
+		v := n.Value
+		if esTextFields[n.Field] {
+			v = strings.ToLower(v)
+		}
+		w := map[string]interface{}{"value": v}
+		if n.CaseInsensitive && b.caseInsensitive {
+			w["case_insensitive"] = true
+		}
+		return map[string]interface{}{"wildcard": map[string]interface{}{n.Field: w}}
+	case QUERY_RANGE:
+		r := make(map[string]string)
+		if n.Lower != "" {
+			if n.IncludeLower {
+				r["gte"] = n.Lower
+			} else {
+				r["gt"] = n.Lower
+			}
+		}
+		if n.Upper != "" {
+			if n.IncludeUpper {
+				r["lte"] = n.Upper
+			} else {
+				r["lt"] = n.Upper
+			}
+		}
+		return map[string]interface{}{"range": map[string]interface{}{n.Field: r}}
+	}
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+// esSearchQuery compiles query to the query DSL. Only raw queries, in
+// Lucene syntax, are passed to Elasticsearch as is.
+func (b *esBackend) esSearchQuery(query string, raw bool) (map[string]interface{}, error) {
+	if raw {
+		return map[string]interface{}{"query_string": map[string]interface{}{"query": query}}, nil
+	}
+	n, err := parseSearchQuery(query, false)
+	if err != nil {
+		return nil, err
+	}
+	return b.esQuery(n), nil
+}
+
+// Search pages through the hits with search_after, sorted by opts.Sort and
+// then by fullpath, which is unique
+func (b *esBackend) Search(query string, opts searchOptions, fn searchFunc) error {
+	var sortBy []interface{}
+	for _, f := range opts.Sort {
+		order := "asc"
+		if f.Desc {
+			order = "desc"
+		}
+		sortBy = append(sortBy, map[string]interface{}{esSortFields[f.Field]: map[string]string{"order": order}})
+	}
+	if len(opts.Sort) == 0 {
+		sortBy = append(sortBy, map[string]interface{}{"_score": map[string]string{"order": "desc"}})
+	}
+	sortBy = append(sortBy, map[string]interface{}{"fullpath.keyword": map[string]string{"order": "asc"}})
+	sortBy = append(sortBy, map[string]interface{}{"chunk": map[string]string{"order": "asc", "missing": "_first", "unmapped_type": "integer"}})
+
+	q, err := b.esSearchQuery(query, opts.Raw)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"query":            q,
+		"sort":             sortBy,
+		"track_total_hits": true,
+		"_source":          []string{"filename", "fullpath", "path", "size", "isfolder", "date", "extension", "hash", "mode", "chunk", "chunks", "offset", "archive", "members", "uncompressed_size", "mail", "meta"},
+		// files, counting chunked files once, for the total
+		"aggs": map[string]interface{}{
+			"files": map[string]interface{}{"cardinality": map[string]interface{}{"field": "fullpath.keyword", "precision_threshold": ES_CARDINALITY_PRECISION}},
+		},
+	}
+	if opts.Highlight {
+		body["highlight"] = map[string]interface{}{"fields": map[string]interface{}{"attachment.content": map[string]interface{}{}}}
+		// the scores pick the best highlight among the chunks of a file
+		body["track_scores"] = true
+	}
+
+	index := []string{GOTROVI_ES_INDEX}
+	pit, err := b.openPIT()
+	if err == nil {
+		index = nil
+		defer func() { b.closePIT(pit) }()
+	} else {
+		Warning.Println("Searching without a point in time, the pages may change if the index is updated meanwhile:", err)
+	}
+
+	skip := opts.Offset
+	sent := 0
+	total := 0
+	collapse := newChunkCollapser(func(hit SearchHit) {
+		if skip > 0 {
+			skip = skip - 1
+			return
+		}
+		if opts.Limit > 0 && sent >= opts.Limit {
+			return
+		}
+		fn(total, hit)
+		sent = sent + 1
+	})
+	for {
+		size := ES_PAGE_SIZE
+		if opts.Limit > 0 && skip+opts.Limit-sent < size {
+			size = skip + opts.Limit - sent
+		}
+		body["size"] = size
+		if pit != "" {
+			body["pit"] = map[string]string{"id": pit, "keep_alive": ES_KEEP_ALIVE}
+		}
+
+		var data SearchResult
+		err := b.searchBody(index, body, &data)
+		if err != nil {
+			return err
+		}
+		if data.PitId != "" {
+			pit = data.PitId
+		}
+		if files, ok := data.Aggregations["files"]; ok {
+			// the count is approximate beyond the precision threshold
+			total = data.Hits.Total.Value
+			if files.Value <= ES_CARDINALITY_PRECISION {
+				total = int(files.Value)
+			}
+			delete(body, "aggs")
+		}
+
+		for _, hit := range data.Hits.Hits {
+			collapse.add(hit)
+		}
+
+		hits := data.Hits.Hits
+		if len(hits) < size || opts.Limit > 0 && sent >= opts.Limit {
+			collapse.flush()
+			return nil
+		}
+		body["search_after"] = hits[len(hits)-1].Sort
+	}
+}
+
+// Files counted exactly by the total of a search, which is approximate beyond
+const ES_CARDINALITY_PRECISION = 40000
+
+// Composite aggregation pages, and files returned for each duplicates group
+const ES_COMPOSITE_SIZE = 1000
+const ES_DUPLICATES_FILES = 100
+
+type compositeBucket struct {
+	Key      map[string]interface{} `json:"key"`
+	DocCount int                    `json:"doc_count"`
+	Files    struct {
+		Hits SearchHits `json:"hits"`
+	} `json:"files"`
+	Size esValue `json:"size"`
+}
+
+type compositeResult struct {
+	Aggregations map[string]struct {
+		AfterKey map[string]interface{} `json:"after_key"`
+		Buckets  []compositeBucket      `json:"buckets"`
+	} `json:"aggregations"`
+}
+
+// searchBody runs a search in index with a json body, decoding the response
+// in data. index is empty for searches on a point in time.
+func (b *esBackend) searchBody(index []string, body interface{}, data interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	Trace.Println(string(buf))
+	req := esapi.SearchRequest{
+		Index: index,
+		Body:  bytes.NewReader(buf),
+	}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		Error.Println(string(resBody))
+		return fmt.Errorf("ES returned Error %s", res.Status())
+	}
+	return json.Unmarshal(resBody, data)
+}
+
+// composite pages through a composite aggregation on field over query,
+// calling fn for each bucket
+func (b *esBackend) composite(query map[string]interface{}, field string, sub map[string]interface{}, fn func(bucket compositeBucket)) error {
+	var after map[string]interface{}
+	for {
+		agg := map[string]interface{}{
+			"size":    ES_COMPOSITE_SIZE,
+			"sources": []interface{}{map[string]interface{}{field: map[string]interface{}{"terms": map[string]string{"field": field}}}},
+		}
+		if after != nil {
+			agg["after"] = after
+		}
+		aggs := map[string]interface{}{"composite": agg}
+		if sub != nil {
+			aggs["aggs"] = sub
+		}
+		body := map[string]interface{}{
+			"size":  0,
+			"query": query,
+			"aggs":  map[string]interface{}{"groups": aggs},
+		}
+
+		var data compositeResult
+		err := b.searchBody([]string{GOTROVI_ES_INDEX}, body, &data)
+		if err != nil {
+			return err
+		}
+		groups := data.Aggregations["groups"]
+		for _, bucket := range groups.Buckets {
+			fn(bucket)
+		}
+		if len(groups.Buckets) < ES_COMPOSITE_SIZE || groups.AfterKey == nil {
+			return nil
+		}
+		after = groups.AfterKey
+	}
+}
+
+// esFiles matches the files on disk, leaving out the chunks of chunked files
+// and the members of archives
+var esFiles = map[string]interface{}{
+	"bool": map[string]interface{}{
+		"filter": map[string]interface{}{"term": map[string]bool{"isfolder": false}},
+		"must_not": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"chunk": map[string]int{"gt": 0}}},
+			map[string]interface{}{"exists": map[string]string{"field": "archive"}},
+		},
+	},
+}
+
+// Duplicates first finds the sizes shared by several files, then the
+// hashes shared by several files among those sizes
+func (b *esBackend) Duplicates(query string, fn func(docs []Source)) error {
+	q, err := b.esSearchQuery(query, false)
+	if err != nil {
+		return err
+	}
+	filter := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":   q,
+			"filter": esFiles,
+		},
+	}
+
+	var sizes []interface{}
+	err = b.composite(filter, "size", nil, func(bucket compositeBucket) {
+		if bucket.DocCount > 1 {
+			sizes = append(sizes, bucket.Key["size"])
+		}
+	})
+	if err != nil {
+		return err
+	}
+	Trace.Println("Sizes shared by several files:", len(sizes))
+
+	files := map[string]interface{}{
+		"files": map[string]interface{}{
+			"top_hits": map[string]interface{}{
+				"size":    ES_DUPLICATES_FILES,
+				"_source": []string{"filename", "fullpath", "path", "size", "isfolder", "date", "extension", "hash", "mode", "archive"},
+			},
+		},
+	}
+	for start := 0; start < len(sizes); start += ES_COMPOSITE_SIZE {
+		end := start + ES_COMPOSITE_SIZE
+		if end > len(sizes) {
+			end = len(sizes)
+		}
+		candidates := map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":   filter,
+				"filter": map[string]interface{}{"terms": map[string]interface{}{"size": sizes[start:end]}},
+			},
+		}
+		err = b.composite(candidates, "hash", files, func(bucket compositeBucket) {
+			if bucket.DocCount < 2 {
+				return
+			}
+			if bucket.DocCount > ES_DUPLICATES_FILES {
+				Warning.Println("Hash", bucket.Key["hash"], "has", bucket.DocCount, "files, only", ES_DUPLICATES_FILES, "listed")
+			}
+			docs := make([]Source, 0, len(bucket.Files.Hits.Hits))
+			for _, hit := range bucket.Files.Hits.Hits {
+				docs = append(docs, hit.Source)
+			}
+			fn(docs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// esValue is the result of a metric aggregation
+type esValue struct {
+	Value         float64 `json:"value"`
+	ValueAsString string  `json:"value_as_string"`
+}
+
+type esTermsBucket struct {
+	Key      string  `json:"key"`
+	DocCount int     `json:"doc_count"`
+	Size     esValue `json:"size"`
+}
+
+type esTerms struct {
+	SumOtherDocCount int             `json:"sum_other_doc_count"`
+	Buckets          []esTermsBucket `json:"buckets"`
+}
+
+type esStatsResult struct {
+	Aggregations struct {
+		Folders struct {
+			DocCount int `json:"doc_count"`
+		} `json:"folders"`
+		Files struct {
+			DocCount int     `json:"doc_count"`
+			Size     esValue `json:"size"`
+			Oldest   esValue `json:"oldest"`
+			Newest   esValue `json:"newest"`
+			Failed   struct {
+				DocCount int `json:"doc_count"`
+			} `json:"failed"`
+			Largest struct {
+				Hits SearchHits `json:"hits"`
+			} `json:"largest"`
+			IndexFolders struct {
+				Buckets map[string]esTermsBucket `json:"buckets"`
+			} `json:"index_folders"`
+			Extensions   esTerms `json:"extensions"`
+			ContentTypes esTerms `json:"content_types"`
+			Languages    esTerms `json:"languages"`
+		} `json:"files"`
+	} `json:"aggregations"`
+}
+
+// statsTerms converts the buckets of a terms aggregation, the documents of
+// the remaining terms are added up as STATS_OTHER, total being the size of
+// all the files
+func statsTerms(terms esTerms, total int64) []statsCount {
+	counts := []statsCount{}
+	for _, bucket := range terms.Buckets {
+		counts = append(counts, statsCount{Key: bucket.Key, Count: bucket.DocCount, Size: int64(bucket.Size.Value)})
+		total = total - int64(bucket.Size.Value)
+	}
+	if terms.SumOtherDocCount > 0 {
+		counts = append(counts, statsCount{Key: STATS_OTHER, Count: terms.SumOtherDocCount, Size: total})
+	}
+	return counts
+}
+
+// Stats runs a single search with the aggregations on the files of query
+func (b *esBackend) Stats(query string, folders []string) (*indexStats, error) {
+	q, err := b.esSearchQuery(query, false)
+	if err != nil {
+		return nil, err
+	}
+	sumSize := map[string]interface{}{"size": map[string]interface{}{"sum": map[string]string{"field": "size"}}}
+	terms := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"terms": map[string]interface{}{"field": field, "size": STATS_TOP, "missing": ""},
+			"aggs":  sumSize,
+		}
+	}
+	inFolders := make(map[string]interface{})
+	for _, f := range folders {
+		inFolders[f] = map[string]interface{}{"match": map[string]string{"path.tree": f}}
+	}
+
+	body := map[string]interface{}{
+		"size":  0,
+		"query": q,
+		"aggs": map[string]interface{}{
+			"folders": map[string]interface{}{"filter": map[string]interface{}{"term": map[string]bool{"isfolder": true}}},
+			"files": map[string]interface{}{
+				"filter": esFiles,
+				"aggs": map[string]interface{}{
+					"size":   sumSize["size"],
+					"oldest": map[string]interface{}{"min": map[string]string{"field": "date"}},
+					"newest": map[string]interface{}{"max": map[string]string{"field": "date"}},
+					"failed": map[string]interface{}{"filter": map[string]interface{}{"exists": map[string]string{"field": "attachment.error"}}},
+					"largest": map[string]interface{}{
+						"top_hits": map[string]interface{}{
+							"size":    STATS_LARGEST,
+							"sort":    []interface{}{map[string]string{"size": "desc"}},
+							"_source": []string{"fullpath", "size"},
+						},
+					},
+					"index_folders": map[string]interface{}{"filters": map[string]interface{}{"filters": inFolders}, "aggs": sumSize},
+					"extensions":    terms("extension"),
+					"content_types": terms("attachment.content_type"),
+					"languages":     terms("attachment.language"),
+				},
+			},
+		},
+	}
+
+	var data esStatsResult
+	err = b.searchBody([]string{GOTROVI_ES_INDEX}, body, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	files := data.Aggregations.Files
+	stats := &indexStats{
+		Files:            files.DocCount,
+		Folders:          data.Aggregations.Folders.DocCount,
+		Size:             int64(files.Size.Value),
+		ExtractionFailed: files.Failed.DocCount,
+		Largest:          []statsFile{},
+		IndexFolders:     []statsCount{},
+	}
+	if files.DocCount > 0 {
+		stats.Oldest = files.Oldest.ValueAsString
+		stats.Newest = files.Newest.ValueAsString
+	}
+	for _, hit := range files.Largest.Hits.Hits {
+		stats.Largest = append(stats.Largest, statsFile{FullName: hit.Source.FullName, Size: hit.Source.Size})
+	}
+	for _, f := range folders {
+		bucket := files.IndexFolders.Buckets[f]
+		stats.IndexFolders = append(stats.IndexFolders, statsCount{Key: f, Count: bucket.DocCount, Size: int64(bucket.Size.Value)})
+	}
+	stats.Extensions = statsTerms(files.Extensions, stats.Size)
+	stats.ContentTypes = statsTerms(files.ContentTypes, stats.Size)
+	stats.Languages = statsTerms(files.Languages, stats.Size)
+	return stats, nil
+}
+
+// FolderUsage pages through a composite aggregation on the folders of the
+// files, adding up their sizes
+func (b *esBackend) FolderUsage(query string, fn func(path string, files int, size int64)) error {
+	q, err := b.esSearchQuery(query, false)
+	if err != nil {
+		return err
+	}
+	filter := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":   q,
+			"filter": esFiles,
+		},
+	}
+	size := map[string]interface{}{"size": map[string]interface{}{"sum": map[string]string{"field": "size"}}}
+	return b.composite(filter, "path.keyword", size, func(bucket compositeBucket) {
+		path, _ := bucket.Key["path.keyword"].(string)
+		fn(path, bucket.DocCount, int64(bucket.Size.Value))
+	})
+}
+
+func (b *esBackend) ScrollAll(fn searchFunc) error {
+	return b.Search("*", searchOptions{Sort: []sortField{{Field: "fullpath"}}}, fn)
+}
+
+// Index of the integrity events recorded by verify. Its name must not match
+// the GOTROVI_ES_INDEX-* generations, which DeleteIndex removes.
+const GOTROVI_ES_EVENTS_INDEX = "gotrovi_events"
+
+const GOTROVI_EVENTS_MAPPING = `{
+  "mappings": {
+    "properties": {
+      "timestamp": { "type": "date" },
+      "host": { "type": "keyword" },
+      "event": { "type": "keyword" },
+      "fullpath": { "type": "keyword" },
+      "size": { "type": "long" },
+      "date": { "type": "date", "format": "strict_date_optional_time||epoch_millis" },
+      "indexed_hash": { "type": "keyword" },
+      "hash": { "type": "keyword" },
+      "error": { "type": "text" }
+    }
+  }
+}`
+
+// createEventsIndex creates GOTROVI_ES_EVENTS_INDEX unless it exists
+func (b *esBackend) createEventsIndex() error {
+	exists := esapi.IndicesExistsRequest{Index: []string{GOTROVI_ES_EVENTS_INDEX}}
+	res, err := exists.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		return nil
+	}
+
+	Trace.Println("Creating index " + GOTROVI_ES_EVENTS_INDEX)
+	req := esapi.IndicesCreateRequest{
+		Index: GOTROVI_ES_EVENTS_INDEX,
+		Body:  strings.NewReader(GOTROVI_EVENTS_MAPPING),
+	}
+	res, err = req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		body, _ := ioutil.ReadAll(res.Body)
+		Error.Println(string(body))
+		return fmt.Errorf("unable to create index %s: %s", GOTROVI_ES_EVENTS_INDEX, res.Status())
+	}
+	return nil
+}
+
+func (b *esBackend) RecordEvents(events []integrityEvent) error {
+	err := b.createEventsIndex()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, e := range events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("{ \"index\" : {} }\n")
+		buf.Write(body)
+		buf.WriteByte('\n')
+	}
+
+	req := esapi.BulkRequest{
+		Index: GOTROVI_ES_EVENTS_INDEX,
+		Body:  &buf,
+	}
+	res, err := req.Do(context.Background(), b.es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		Error.Println(string(body))
+		return fmt.Errorf("ES returned Error %s", res.Status())
+	}
+	var data bulkResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return err
+	}
+	if data.Errors {
+		Error.Println(string(body))
+		return fmt.Errorf("some events were not recorded")
+	}
+	return nil
+}
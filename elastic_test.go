@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testES is a fake Elasticsearch server answering searches with hits, with
+// or without point in time support, with an index of mapping version
+// mapping if not 0
+type testES struct {
+	pit     bool
+	hits    []SearchHit
+	mapping int
+	// status of the refresh requests, 200 if 0
+	refresh int
+
+	lock     sync.Mutex
+	requests []string
+	searches []map[string]interface{}
+}
+
+func (s *testES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/":
+		w.Write([]byte(`{"version": {"number": "7.9.3"}}`))
+	case strings.HasSuffix(r.URL.Path, "/_mapping"):
+		if s.mapping == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"gotrovi-20240101000000": {"mappings": {"_meta": {"gotrovi_mapping_version": %d}}}}`, s.mapping)
+	case strings.HasSuffix(r.URL.Path, "/_pit") && s.pit:
+		if r.Method == http.MethodDelete {
+			w.Write([]byte(`{"succeeded": true}`))
+		} else {
+			w.Write([]byte(`{"id": "testpit"}`))
+		}
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		var search map[string]interface{}
+		json.Unmarshal(body, &search)
+		s.searches = append(s.searches, search)
+		var res SearchResult
+		res.Hits.Hits = s.hits
+		res.Hits.Total.Value = len(s.hits)
+		res.Aggregations = map[string]esValue{"files": {Value: float64(len(s.hits))}}
+		if s.pit {
+			res.PitId = "testpit"
+		}
+		json.NewEncoder(w).Encode(res)
+	case strings.HasSuffix(r.URL.Path, "/_refresh"):
+		if s.refresh != 0 {
+			w.WriteHeader(s.refresh)
+		}
+		w.Write([]byte(`{}`))
+	case strings.Contains(r.URL.Path, "/_doc/") || strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+		w.Write([]byte(`{}`))
+	default:
+		// the _pit endpoint of ES older than 7.10 is taken for an index
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "no handler found"}`))
+	}
+}
+
+func TestESSearchPIT(t *testing.T) {
+	var warnings bytes.Buffer
+	warning := Warning
+	Warning = log.New(&warnings, "", 0)
+	defer func() { Warning = warning }()
+
+	for _, pit := range []bool{true, false} {
+		es := &testES{pit: pit, hits: []SearchHit{
+			{Source: Source{FullName: "/a/one.txt"}, Sort: []interface{}{1, "/a/one.txt"}},
+			{Source: Source{FullName: "/a/two.txt"}, Sort: []interface{}{1, "/a/two.txt"}},
+		}}
+		srv := httptest.NewServer(es)
+		b := &esBackend{conf: ESConfig{URLs: []string{srv.URL}}}
+		err := b.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		warnings.Reset()
+		var found []string
+		err = b.Search("hello", searchOptions{}, func(total int, hit SearchHit) {
+			found = append(found, hit.Source.FullName)
+		})
+		srv.Close()
+		if err != nil || strings.Join(found, " ") != "/a/one.txt /a/two.txt" {
+			t.Errorf("pit %v: %v %v", pit, found, err)
+			continue
+		}
+
+		requests := strings.Join(es.requests, ", ")
+		if len(es.searches) != 1 {
+			t.Fatalf("pit %v: %s", pit, requests)
+		}
+		_, withPIT := es.searches[0]["pit"]
+		if pit {
+			if !withPIT || !strings.Contains(requests, " /_search") || !strings.Contains(requests, "DELETE /_pit") || warnings.Len() != 0 {
+				t.Errorf("with point in time: %s, warnings %q", requests, warnings.String())
+			}
+		} else {
+			if withPIT || !strings.Contains(requests, " /"+GOTROVI_ES_INDEX+"/_search") || !strings.Contains(warnings.String(), "without a point in time") {
+				t.Errorf("without point in time: %s, warnings %q", requests, warnings.String())
+			}
+		}
+	}
+}
+
+func TestESOldIDs(t *testing.T) {
+	for _, version := range []int{GOTROVI_ID_VERSION - 1, GOTROVI_MAPPING_VERSION} {
+		es := &testES{mapping: version}
+		srv := httptest.NewServer(es)
+		b := &esBackend{conf: ESConfig{URLs: []string{srv.URL}}}
+		err := b.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := []bulkItem{{path: "/a/b c.txt", doc: &FileDescriptionDoc{FullName: "/a/b c.txt"}, extracted: true}}
+		_, failed := b.Index(batch)
+		err = b.Delete("/a/b c.txt")
+		srv.Close()
+
+		requests := strings.Join(es.requests, ", ")
+		if version < GOTROVI_ID_VERSION {
+			if len(failed) != 1 || err != errOldIDs || strings.Contains(requests, "_bulk") || strings.Contains(requests, "DELETE") {
+				t.Errorf("version %d: failed %d, %v, %s", version, len(failed), err, requests)
+			}
+		} else if err == errOldIDs || !strings.Contains(requests, "_bulk") {
+			t.Errorf("version %d: %v, %s", version, err, requests)
+		}
+	}
+}
+
+func TestESReindexWrites(t *testing.T) {
+	es := &testES{mapping: GOTROVI_MAPPING_VERSION}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+	b := &esBackend{conf: ESConfig{URLs: []string{srv.URL}}}
+	err := b.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.target = GOTROVI_ES_INDEX + "-20240102000000"
+	es.requests = nil
+
+	// deletes go to the generation being built, reads to the alias
+	if err := b.Delete("/a/b.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := b.DeleteChunks("/a/big.log", 2); err != nil {
+		t.Error(err)
+	}
+	if err := b.DeleteMembers("/a/c.zip"); err != nil {
+		t.Error(err)
+	}
+	b.Exists("/a/b.txt")
+	want := []string{
+		"DELETE /" + b.target + "/_doc//a/b.txt",
+		"POST /" + b.target + "/_delete_by_query",
+		"POST /" + b.target + "/_delete_by_query",
+		"GET /" + GOTROVI_ES_INDEX + "/_doc//a/b.txt",
+	}
+	if got := strings.Join(es.requests, ", "); got != strings.Join(want, ", ") {
+		t.Errorf("requests %s, want %s", got, strings.Join(want, ", "))
+	}
+}
+
+func TestESRefresh(t *testing.T) {
+	for _, status := range []int{0, http.StatusServiceUnavailable} {
+		es := &testES{refresh: status}
+		srv := httptest.NewServer(es)
+		b := &esBackend{conf: ESConfig{URLs: []string{srv.URL}}}
+		err := b.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Refresh()
+		srv.Close()
+		if status == 0 && err != nil || status != 0 && (err == nil || !strings.Contains(err.Error(), "503")) {
+			t.Errorf("refresh returning %d: %v", status, err)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// In-process replacement for the ingest attachment plugin. The extracted
+// text goes into the same attachment.* fields the plugin fills.
+
+const EXTRACTOR_INGEST = "ingest"
+const EXTRACTOR_LOCAL = "local"
+
+// Same limit used by the ingest attachment plugin
+const INDEXED_CHARS = 100000
+
+type Attachment struct {
+	Content     string `json:"content,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Language    string `json:"language,omitempty"`
+	// why the text could not be extracted, the file is indexed without it
+	Error string `json:"error,omitempty"`
+}
+
+type textExtractor func(content []byte) (string, error)
+
+type extractorType struct {
+	contentType string
+	extract     textExtractor
+}
+
+var extractors = map[string]extractorType{
+	".pdf":   {"application/pdf", extractPDF},
+	".docx":  {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", extractDOCX},
+	".xlsx":  {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", extractXLSX},
+	".pptx":  {"application/vnd.openxmlformats-officedocument.presentationml.presentation", extractPPTX},
+	".odt":   {"application/vnd.oasis.opendocument.text", extractODF},
+	".ods":   {"application/vnd.oasis.opendocument.spreadsheet", extractODF},
+	".odp":   {"application/vnd.oasis.opendocument.presentation", extractODF},
+	".html":  {"text/html; charset=UTF-8", extractHTML},
+	".htm":   {"text/html; charset=UTF-8", extractHTML},
+	".xhtml": {"application/xhtml+xml", extractHTML},
+	".rtf":   {"application/rtf", extractRTF},
+	".epub":  {"application/epub+zip", extractEPUB},
+}
+
+func (gotrovi *Gotrovi) localExtraction() bool {
+	return gotrovi.conf.Extractor == EXTRACTOR_LOCAL || gotrovi.conf.Backend == BACKEND_LOCAL
+}
+
+// Extract returns the text, content type and language of a file
+func Extract(p string, content []byte) (*Attachment, error) {
+	a := &Attachment{}
+	var text string
+	var err error
+
+	ext := strings.ToLower(filepath.Ext(p))
+	e, ok := extractors[ext]
+	switch {
+	case ok:
+		a.ContentType = e.contentType
+		text, err = safeExtract(e.extract, content)
+	case bytes.HasPrefix(content, []byte("%PDF-")):
+		a.ContentType = "application/pdf"
+		text, err = safeExtract(extractPDF, content)
+	case bytes.HasPrefix(content, []byte("{\\rtf")):
+		a.ContentType = "application/rtf"
+		text, err = safeExtract(extractRTF, content)
+	default:
+		text, ok = decodeText(content)
+		if ok {
+			a.ContentType = textContentType(ext, content)
+		} else {
+			a.ContentType = http.DetectContentType(content)
+		}
+	}
+	if err != nil {
+		return a, err
+	}
+
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > INDEXED_CHARS {
+		text = string([]rune(text)[:INDEXED_CHARS])
+	}
+	a.Content = text
+	a.Language = detectLanguage(text)
+	return a, nil
+}
+
+// safeExtract protects the sync from extractors panicking on malformed files
+func safeExtract(fn textExtractor, content []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to extract text: %v", r)
+		}
+	}()
+	return fn(content)
+}
+
+func textContentType(ext string, content []byte) string {
+	t := mime.TypeByExtension(ext)
+	if !strings.HasPrefix(t, "text/") {
+		t = http.DetectContentType(content)
+		if !strings.HasPrefix(t, "text/") {
+			t = "text/plain; charset=UTF-8"
+		}
+	}
+	if !strings.Contains(t, "charset") {
+		t = t + "; charset=UTF-8"
+	}
+	return t
+}
+
+// decodeText returns content as a string when it looks like text: UTF-8 or
+// UTF-16 with BOM, without NUL characters
+func decodeText(content []byte) (string, bool) {
+	if len(content) >= 2 && (content[0] == 0xff && content[1] == 0xfe || content[0] == 0xfe && content[1] == 0xff) {
+		var order binary.ByteOrder = binary.LittleEndian
+		if content[0] == 0xfe {
+			order = binary.BigEndian
+		}
+		u := make([]uint16, 0, len(content)/2)
+		for i := 2; i+1 < len(content); i += 2 {
+			u = append(u, order.Uint16(content[i:]))
+		}
+		return string(utf16.Decode(u)), true
+	}
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return "", false
+	}
+	return string(content), true
+}
+
+func extractPDF(content []byte) (string, error) {
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", err
+	}
+	text, err := r.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(text)
+	return string(b), err
+}
+
+func zipFiles(content []byte) (map[string]*zip.File, []string, error) {
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]*zip.File)
+	var names []string
+	for _, f := range r.File {
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	return files, names, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(io.LimitReader(r, 64*1024*1024))
+}
+
+// xmlText concatenates the character data of the elements named in text,
+// adding a line break after the elements named in breaks
+func xmlText(content []byte, text map[string]bool, breaks map[string]bool) (string, error) {
+	var b strings.Builder
+	d := xml.NewDecoder(bytes.NewReader(content))
+	d.Strict = false
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return b.String(), err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if text == nil || text[t.Name.Local] {
+				depth++
+			}
+			if t.Name.Local == "tab" {
+				b.WriteString("\t")
+			}
+		case xml.EndElement:
+			if (text == nil || text[t.Name.Local]) && depth > 0 {
+				depth--
+			}
+			if breaks[t.Name.Local] {
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if depth > 0 {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func extractZipXML(content []byte, match func(name string) bool, text map[string]bool, breaks map[string]bool) (string, error) {
+	files, names, err := zipFiles(content)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, name := range sortNatural(names) {
+		if !match(name) {
+			continue
+		}
+		data, err := readZipFile(files[name])
+		if err != nil {
+			return "", err
+		}
+		s, err := xmlText(data, text, breaks)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+var numberRe = regexp.MustCompile(`\d+`)
+
+// sortNatural orders slide2.xml before slide10.xml
+func sortNatural(names []string) []string {
+	key := func(s string) string {
+		return numberRe.ReplaceAllStringFunc(s, func(n string) string {
+			return fmt.Sprintf("%012s", n)
+		})
+	}
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return key(sorted[i]) < key(sorted[j]) })
+	return sorted
+}
+
+func extractDOCX(content []byte) (string, error) {
+	return extractZipXML(content, func(name string) bool {
+		return name == "word/document.xml" || strings.HasPrefix(name, "word/header") || strings.HasPrefix(name, "word/footer") || name == "word/footnotes.xml"
+	}, map[string]bool{"t": true}, map[string]bool{"p": true, "br": true})
+}
+
+func extractXLSX(content []byte) (string, error) {
+	return extractZipXML(content, func(name string) bool {
+		return name == "xl/sharedStrings.xml" || (strings.HasPrefix(name, "xl/worksheets/sheet") && strings.HasSuffix(name, ".xml"))
+	}, map[string]bool{"t": true}, map[string]bool{"si": true, "row": true})
+}
+
+func extractPPTX(content []byte) (string, error) {
+	return extractZipXML(content, func(name string) bool {
+		return strings.HasPrefix(name, "ppt/slides/slide") && strings.HasSuffix(name, ".xml")
+	}, map[string]bool{"t": true}, map[string]bool{"p": true})
+}
+
+func extractODF(content []byte) (string, error) {
+	return extractZipXML(content, func(name string) bool {
+		return name == "content.xml"
+	}, nil, map[string]bool{"p": true, "h": true, "table-row": true})
+}
+
+func extractHTML(content []byte) (string, error) {
+	var b strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(content))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return b.String(), nil
+			}
+			return b.String(), z.Err()
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip++
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				if skip > 0 {
+					skip--
+				}
+			case "title":
+				b.WriteString("\n")
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+// extractRTF strips the control words of a RTF document. Destinations that
+// do not contain document text (fonts, colors, pictures...) are skipped.
+func extractRTF(content []byte) (string, error) {
+	skipDest := map[string]bool{"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true, "object": true, "header": true, "footer": true, "listtable": true, "listoverridetable": true, "rsidtbl": true, "generator": true, "xmlnstbl": true, "themedata": true, "datastore": true, "latentstyles": true}
+
+	var b strings.Builder
+	type group struct {
+		skip bool
+		uc   int
+	}
+	stack := []group{{uc: 1}}
+	pendingSkip := 0 // characters to drop after \uN
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		cur := &stack[len(stack)-1]
+		switch c {
+		case '{':
+			stack = append(stack, *cur)
+		case '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case '\r', '\n':
+		case '\\':
+			if i+1 >= len(content) {
+				break
+			}
+			n := content[i+1]
+			switch {
+			case n == '\\' || n == '{' || n == '}':
+				i++
+				if !cur.skip && pendingSkip == 0 {
+					b.WriteByte(n)
+				} else if pendingSkip > 0 {
+					pendingSkip--
+				}
+			case n == '*':
+				i++
+				cur.skip = true
+			case n == '\'':
+				i++
+				if i+2 < len(content) {
+					v, err := strconv.ParseUint(string(content[i+1:i+3]), 16, 8)
+					i += 2
+					if err == nil && !cur.skip {
+						if pendingSkip > 0 {
+							pendingSkip--
+						} else {
+							// assume windows-1252, which matches latin1 for letters
+							b.WriteRune(rune(v))
+						}
+					}
+				}
+			case n == '~':
+				i++
+				if !cur.skip {
+					b.WriteString(" ")
+				}
+			case (n >= 'a' && n <= 'z') || (n >= 'A' && n <= 'Z'):
+				j := i + 1
+				for j < len(content) && ((content[j] >= 'a' && content[j] <= 'z') || (content[j] >= 'A' && content[j] <= 'Z')) {
+					j++
+				}
+				word := string(content[i+1 : j])
+				k := j
+				if k < len(content) && (content[k] == '-' || (content[k] >= '0' && content[k] <= '9')) {
+					k++
+					for k < len(content) && content[k] >= '0' && content[k] <= '9' {
+						k++
+					}
+				}
+				param, hasParam := 0, k > j
+				if hasParam {
+					param, _ = strconv.Atoi(string(content[j:k]))
+				}
+				if k < len(content) && content[k] == ' ' {
+					k++
+				}
+				i = k - 1
+
+				switch {
+				case skipDest[word]:
+					cur.skip = true
+				case cur.skip:
+				case word == "par" || word == "line" || word == "row" || word == "sect" || word == "page":
+					b.WriteString("\n")
+				case word == "tab" || word == "cell":
+					b.WriteString("\t")
+				case word == "uc" && hasParam:
+					cur.uc = param
+				case word == "u" && hasParam:
+					if param < 0 {
+						param = param + 65536
+					}
+					b.WriteRune(rune(param))
+					pendingSkip = cur.uc
+				}
+			default:
+				i++
+			}
+		default:
+			if cur.skip {
+				break
+			}
+			if pendingSkip > 0 {
+				pendingSkip--
+				break
+			}
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		Path string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Manifest []struct {
+		Id   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IdRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// extractEPUB reads the chapters of the book in reading (spine) order
+func extractEPUB(content []byte) (string, error) {
+	files, _, err := zipFiles(content)
+	if err != nil {
+		return "", err
+	}
+	f, ok := files["META-INF/container.xml"]
+	if !ok {
+		return "", fmt.Errorf("missing META-INF/container.xml")
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return "", err
+	}
+	var container epubContainer
+	err = xml.Unmarshal(data, &container)
+	if err != nil || len(container.Rootfiles) == 0 {
+		return "", fmt.Errorf("invalid epub container: %v", err)
+	}
+
+	opf := container.Rootfiles[0].Path
+	f, ok = files[opf]
+	if !ok {
+		return "", fmt.Errorf("missing %s", opf)
+	}
+	data, err = readZipFile(f)
+	if err != nil {
+		return "", err
+	}
+	var pkg epubPackage
+	err = xml.Unmarshal(data, &pkg)
+	if err != nil {
+		return "", err
+	}
+
+	hrefs := make(map[string]string)
+	for _, item := range pkg.Manifest {
+		hrefs[item.Id] = item.Href
+	}
+	var parts []string
+	for _, ref := range pkg.Spine {
+		f, ok := files[path.Join(path.Dir(opf), hrefs[ref.IdRef])]
+		if !ok {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return "", err
+		}
+		s, err := extractHTML(data)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, "\n"), nil
+}
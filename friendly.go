@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gotrovi query language, the default for searches unless --raw is
+// given. It is the Lucene syntax parsed by ParseQuery, with terms AND'ed
+// unless OR is given, plus shorthands rewritten to the indexed fields:
+//
+//	name:*.go       filename, wildcards match the whole name
+//	ext:pdf         extension, the dot is optional
+//	size:>10M       size, K, M, G and T suffixes
+//	modified:<7d    date, ages in h, d, w, mo and y, or dates
+//	type:dir        isfolder, dir or file
+//	in:~/projects   path.tree, the folder and everything below it
+//	lang:es         attachment.language
+//	content:word    attachment.content, also for bare words
+//	from:alice      mail.from, as well as to, cc and subject
+//	sent:2024-05    mail.date, as modified
+//	camera:canon    meta.camera, as well as artist, album, genre, author
+//	                and title
+//	taken:2023      meta.taken, as modified
+//
+// The indexed field names are still accepted, unknown fields are errors.
+
+var friendlyFields = []string{"name", "ext", "size", "modified", "type", "in", "lang", "content", "from", "to", "cc", "subject", "sent", "camera", "taken", "artist", "album", "genre", "author", "title"}
+
+// ageRe matches the ages of modified, as in 7d
+var ageRe = regexp.MustCompile(`^(\d+)(h|d|w|mo|y)$`)
+
+// ParseFriendlyQuery parses q in the gotrovi query language, returning the
+// query on the indexed fields
+func ParseFriendlyQuery(q string) (*QueryNode, error) {
+	n, err := parseQuery(q, true)
+	if err != nil {
+		return nil, err
+	}
+	err = rewriteFriendly(n, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseSearchQuery parses the query of a search, in Lucene syntax if raw
+func parseSearchQuery(query string, raw bool) (*QueryNode, error) {
+	if raw {
+		return ParseQuery(query)
+	}
+	return ParseFriendlyQuery(query)
+}
+
+// knownField tells whether name is an indexed field or one of its subfields
+func knownField(name string) bool {
+	name, _ = subField(name)
+	if localNumericFields[name] {
+		return true
+	}
+	for _, f := range localTextFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// age parses an age such as 7d as the time that long before now
+func age(s string, now time.Time) (time.Time, bool) {
+	m := ageRe.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+	v, _ := strconv.Atoi(m[1])
+	switch m[2] {
+	case "h":
+		return now.Add(-time.Duration(v) * time.Hour), true
+	case "d":
+		return now.AddDate(0, 0, -v), true
+	case "w":
+		return now.AddDate(0, 0, -7*v), true
+	case "mo":
+		return now.AddDate(0, -v, 0), true
+	}
+	return now.AddDate(-v, 0, 0), true
+}
+
+func rewriteFriendly(n *QueryNode, now time.Time) error {
+	if n.Kind == QUERY_BOOL {
+		for _, clauses := range [][]*QueryNode{n.Must, n.Should, n.MustNot} {
+			for _, c := range clauses {
+				err := rewriteFriendly(c, now)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if n.Kind == QUERY_ALL {
+		return nil
+	}
+
+	errorf := func(format string, a ...interface{}) error {
+		return &QueryError{Pos: n.Pos, Msg: fmt.Sprintf(format, a...)}
+	}
+
+	switch n.Field {
+	case "", "content":
+		n.Field = "attachment.content"
+
+	case "name":
+		n.Field = "filename"
+		if n.Kind == QUERY_WILDCARD {
+			// ignoring case, as the terms of filename
+			n.Field = "filename.keyword"
+			n.CaseInsensitive = true
+		}
+
+	case "ext":
+		if n.Kind == QUERY_RANGE {
+			return errorf("ext does not take ranges")
+		}
+		n.Field = "extension"
+		if n.Value != "" {
+			n.Value = "." + strings.TrimPrefix(n.Value, ".")
+		}
+
+	case "size", "uncompressed_size":
+		var err error
+		switch n.Kind {
+		case QUERY_TERM:
+			n.Value, err = friendlySize(n.Value)
+		case QUERY_RANGE:
+			n.Lower, err = friendlySize(n.Lower)
+			if err == nil {
+				n.Upper, err = friendlySize(n.Upper)
+			}
+		case QUERY_EXISTS:
+		default:
+			err = fmt.Errorf("%s takes a size or a range", n.Field)
+		}
+		if err != nil {
+			return errorf("%v", err)
+		}
+
+	case "modified":
+		n.Field = "date"
+		err := friendlyDate(n, now)
+		if err != nil {
+			return errorf("%v", err)
+		}
+
+	case "type":
+		if n.Kind != QUERY_TERM {
+			return errorf("type is dir or file")
+		}
+		n.Field = "isfolder"
+		switch strings.ToLower(n.Value) {
+		case "dir", "folder", "d":
+			n.Value = "true"
+		case "file", "f":
+			n.Value = "false"
+		default:
+			return errorf("unknown type %q, use dir or file", n.Value)
+		}
+
+	case "in":
+		if n.Kind != QUERY_TERM && n.Kind != QUERY_PHRASE {
+			return errorf("in takes a folder")
+		}
+		dir := n.Value
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return errorf("%v", err)
+			}
+			dir = home + dir[1:]
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return errorf("%v", err)
+		}
+		n.Kind = QUERY_TERM
+		n.Field = "path.tree"
+		n.Value = dir
+
+	case "lang":
+		n.Field = "attachment.language"
+		n.Value = strings.ToLower(n.Value)
+
+	case "from", "to", "cc", "subject":
+		n.Field = "mail." + n.Field
+
+	case "sent":
+		n.Field = "mail.date"
+		err := friendlyDate(n, now)
+		if err != nil {
+			return errorf("%v", err)
+		}
+
+	case "camera", "artist", "album", "genre", "author", "title":
+		n.Field = "meta." + n.Field
+
+	case "taken":
+		n.Field = "meta.taken"
+		err := friendlyDate(n, now)
+		if err != nil {
+			return errorf("%v", err)
+		}
+
+	default:
+		if !knownField(n.Field) {
+			return errorf("unknown field %q, use %s or an indexed field", n.Field, strings.Join(friendlyFields, ", "))
+		}
+	}
+	return nil
+}
+
+// friendlySize converts a size with suffix to bytes, empty for open bounds
+func friendlySize(size string) (string, error) {
+	if size == "" {
+		return "", nil
+	}
+	v, err := parseSize(size)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(v, 10), nil
+}
+
+// friendlyDate turns the ages of modified into dates. As ages count
+// backwards, modified:<7d means a date since 7 days ago. Ages are not
+// precise enough for exclusive bounds, the bounds of the dates are
+// included. A date alone matches the whole year, month or day given.
+func friendlyDate(n *QueryNode, now time.Time) error {
+	switch n.Kind {
+	case QUERY_TERM:
+		if t, ok := age(n.Value, now); ok {
+			n.Kind = QUERY_RANGE
+			n.Lower, n.IncludeLower = fileDate(t), true
+			n.Value = ""
+			return nil
+		}
+		t, ok := parseDate(n.Value)
+		if !ok {
+			return fmt.Errorf("invalid date or age %q", n.Value)
+		}
+		var end time.Time
+		switch len(n.Value) {
+		case len("2006"):
+			end = t.AddDate(1, 0, 0)
+		case len("2006-01"):
+			end = t.AddDate(0, 1, 0)
+		case len("2006-01-02"):
+			end = t.AddDate(0, 0, 1)
+		default:
+			return nil
+		}
+		n.Kind = QUERY_RANGE
+		n.Lower, n.IncludeLower = fileDate(t), true
+		n.Upper, n.IncludeUpper = fileDate(end), false
+		n.Value = ""
+
+	case QUERY_RANGE:
+		lower, lowerAge := age(n.Lower, now)
+		upper, upperAge := age(n.Upper, now)
+		if !lowerAge && !upperAge {
+			for _, b := range []string{n.Lower, n.Upper} {
+				if _, ok := parseDate(b); b != "" && !ok {
+					return fmt.Errorf("invalid date or age %q", b)
+				}
+			}
+			return nil
+		}
+		if !lowerAge && n.Lower != "" || !upperAge && n.Upper != "" {
+			return fmt.Errorf("a range cannot mix dates and ages")
+		}
+		// the older bound is the lower, whichever order the ages are in
+		if lowerAge && upperAge && lower.Before(upper) {
+			lower, upper = upper, lower
+		}
+		newLower, newUpper := "", ""
+		if upperAge {
+			newLower = fileDate(upper)
+		}
+		if lowerAge {
+			newUpper = fileDate(lower)
+		}
+		n.Lower, n.Upper = newLower, newUpper
+		n.IncludeLower, n.IncludeUpper = true, true
+
+	case QUERY_EXISTS:
+
+	default:
+		return fmt.Errorf("modified takes a date, an age or a range")
+	}
+	return nil
+}
+
+// queryErrorMark shows where in query the syntax error err is, under it
+func queryErrorMark(query string, err error) (string, bool) {
+	qe, ok := err.(*QueryError)
+	if !ok {
+		return "", false
+	}
+	return "  " + query + "\n  " + strings.Repeat(" ", qe.Pos) + "^", true
+}
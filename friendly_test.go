@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatQuery writes n back in Lucene syntax, with every clause prefixed
+// by its occurrence and a parenthesis for every boolean query
+func formatQuery(n *QueryNode) string {
+	switch n.Kind {
+	case QUERY_BOOL:
+		var clauses []string
+		for _, c := range n.Must {
+			clauses = append(clauses, "+"+formatQuery(c))
+		}
+		for _, c := range n.Should {
+			clauses = append(clauses, formatQuery(c))
+		}
+		for _, c := range n.MustNot {
+			clauses = append(clauses, "-"+formatQuery(c))
+		}
+		return "(" + strings.Join(clauses, " ") + ")"
+	case QUERY_ALL:
+		return "*"
+	case QUERY_PHRASE:
+		return n.Field + ":\"" + n.Value + "\""
+	case QUERY_EXISTS:
+		return "_exists_:" + n.Field
+	case QUERY_RANGE:
+		open, close := "{", "}"
+		if n.IncludeLower {
+			open = "["
+		}
+		if n.IncludeUpper {
+			close = "]"
+		}
+		return n.Field + ":" + open + n.Lower + " TO " + n.Upper + close
+	}
+	return n.Field + ":" + n.Value
+}
+
+func TestFriendlyQuery(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := filepath.Abs("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"hello world", "(+attachment.content:hello +attachment.content:world)"},
+		{"a b OR c", "((+attachment.content:a +attachment.content:b) attachment.content:c)"},
+		{"a OR b c", "(attachment.content:a (+attachment.content:b +attachment.content:c))"},
+		{"a NOT b OR c", "((+attachment.content:a -attachment.content:b) attachment.content:c)"},
+		{"(a OR b) -c", "(+(attachment.content:a attachment.content:b) -attachment.content:c)"},
+		{"name:*.go", "filename.keyword:*.go"},
+		{"name:main", "filename:main"},
+		{"ext:pdf", "extension:.pdf"},
+		{"size:>10M", "size:{10485760 TO }"},
+		{"size:[1K TO 2K]", "size:[1024 TO 2048]"},
+		{"modified:<7d", "date:[2024-05-13T12:00:00Z TO ]"},
+		{"modified:>30d", "date:[ TO 2024-04-20T12:00:00Z]"},
+		{"modified:[2d TO 1w]", "date:[2024-05-13T12:00:00Z TO 2024-05-18T12:00:00Z]"},
+		{"modified:[1w TO 2d]", "date:[2024-05-13T12:00:00Z TO 2024-05-18T12:00:00Z]"},
+		{"modified:{1w TO 2d}", "date:[2024-05-13T12:00:00Z TO 2024-05-18T12:00:00Z]"},
+		{"modified:2024-03", "date:[2024-03-01T00:00:00Z TO 2024-04-01T00:00:00Z}"},
+		{"modified:[2023 TO 2024]", "date:[2023 TO 2024]"},
+		{"type:dir", "isfolder:true"},
+		{"type:file", "isfolder:false"},
+		{"in:~", "path.tree:" + home},
+		{"in:~/projects", "path.tree:" + filepath.Join(home, "projects")},
+		{"in:work", "path.tree:" + work},
+		{"lang:ES", "attachment.language:es"},
+		{"from:alice", "mail.from:alice"},
+		{"camera:canon", "meta.camera:canon"},
+		{"taken:2023", "meta.taken:[2023-01-01T00:00:00Z TO 2024-01-01T00:00:00Z}"},
+		{"path.tree:\"/a b\"", "path.tree:\"/a b\""},
+		{"*", "*"},
+	}
+	for _, test := range tests {
+		n, err := parseQuery(test.query, true)
+		if err == nil {
+			err = rewriteFriendly(n, now)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := formatQuery(n); got != test.want {
+			t.Errorf("%s: %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestFriendlyQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{"(a b", 4},
+		{"a AND", 5},
+		{"size:[1K TO", 11},
+		{"a \"b c", 2},
+		{"modified:[2024 TO 7d]", 0},
+		{"modified:[1d TO 2024-01-01]", 0},
+		{"hello size:abc", 6},
+		{"type:x", 0},
+		{"bogus:x", 0},
+		{"ext:[a TO b]", 0},
+	}
+	for _, test := range tests {
+		_, err := ParseFriendlyQuery(test.query)
+		qe, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("%s: %v, want a syntax error", test.query, err)
+			continue
+		}
+		if qe.Pos != test.pos {
+			t.Errorf("%s: error at %d, want %d: %v", test.query, qe.Pos, test.pos, err)
+		}
+	}
+}
+
+func TestFriendlyNameWildcard(t *testing.T) {
+	n, err := ParseFriendlyQuery("name:*.GO")
+	if err != nil || n.Field != "filename.keyword" || !n.CaseInsensitive {
+		t.Fatalf("%+v %v", n, err)
+	}
+	for _, version := range []string{"7.9.3", "7.10.0", "8.1.0"} {
+		b := &esBackend{caseInsensitive: versionAtLeast(version, 7, 10)}
+		q, _ := json.Marshal(b.esQuery(n))
+		want := `{"wildcard":{"filename.keyword":{"case_insensitive":true,"value":"*.GO"}}}`
+		if version == "7.9.3" {
+			want = `{"wildcard":{"filename.keyword":{"value":"*.GO"}}}`
+		}
+		if string(q) != want {
+			t.Errorf("%s: %s, want %s", version, q, want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := newLocalBackend(filepath.Join(dir, LOCAL_INDEX_FOLDER))
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var items []bulkItem
+	for _, p := range []string{"/r/x.go", "/r/Main.Go", "/r/README.md", "/r/readme.txt", "/r/other.txt"} {
+		items = append(items, bulkItem{path: p, doc: testDoc(p, 1, "h", ""), extracted: true})
+	}
+	b.Index(items)
+	b.Refresh()
+	tests := map[string]string{
+		"name:*.GO":       "/r/Main.Go /r/x.go",
+		"name:readme*":    "/r/README.md /r/readme.txt",
+		"name:README.md":  "/r/README.md",
+		"name:?EADME.*":   "/r/README.md /r/readme.txt",
+		"name:*.md OR x*": "/r/README.md",
+	}
+	for query, want := range tests {
+		if got, _ := testSearch(t, b, query, searchOptions{Sort: []sortField{{Field: "fullpath"}}}); got != want {
+			t.Errorf("%s: %s, want %s", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gookit/color"
+)
+
+// Grep mode, -g and -G. The index narrows down the candidate files, which
+// are then read from disk, or their extracted text for documents, to print
+// the matching lines with their position and context.
+
+type grepOptions struct {
+	// text to look for, -g. Empty for -G, which looks for the terms
+	// highlighted by the index
+	text     string
+	before   int
+	after    int
+	maxCount int
+}
+
+// Bytes of a file looked at to tell whether it is plain text, as grep does
+const GREP_SNIFF_SIZE = 8192
+
+// grepMatcher finds the matches of a line, as byte offset pairs
+type grepMatcher func(line string) [][]int
+
+// emRe finds the terms highlighted in the fragments returned by the index
+var emRe = regexp.MustCompile(`<em>(.*?)</em>`)
+
+// newGrepMatcher matches opts.text, or else the terms highlighted in e, both
+// ignoring case as the index does
+func newGrepMatcher(opts grepOptions, e SearchHit) grepMatcher {
+	var re *regexp.Regexp
+	if opts.text != "" {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(opts.text))
+	} else {
+		seen := make(map[string]bool)
+		var terms []string
+		for _, fragment := range e.Highlight.Field {
+			for _, m := range emRe.FindAllStringSubmatch(fragment, -1) {
+				term := strings.ToLower(m[1])
+				if term != "" && !seen[term] {
+					seen[term] = true
+					terms = append(terms, regexp.QuoteMeta(term))
+				}
+			}
+		}
+		if len(terms) == 0 {
+			return nil
+		}
+		// the longest first, so that a term is not cut by a shorter one
+		sort.SliceStable(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+		re = regexp.MustCompile(`(?i)` + strings.Join(terms, "|"))
+		return func(line string) [][]int {
+			var words [][]int
+			for _, m := range re.FindAllStringIndex(line, -1) {
+				if wordBoundary(line, m[0]) && wordBoundary(line, m[1]) {
+					words = append(words, m)
+				}
+			}
+			return words
+		}
+	}
+	return func(line string) [][]int {
+		return re.FindAllStringIndex(line, -1)
+	}
+}
+
+// wordBoundary tells whether the byte offset i of line is at the start or
+// the end of a word, as the index splits them. \b of regexp only knows
+// ASCII words.
+func wordBoundary(line string, i int) bool {
+	before, _ := utf8.DecodeLastRuneInString(line[:i])
+	after, _ := utf8.DecodeRuneInString(line[i:])
+	return i == 0 || i == len(line) || isWordRune(before) != isWordRune(after)
+}
+
+// grepReader is the text of a file on disk, closing the file and its
+// decompressor
+type grepReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *grepReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// indexedText returns the text extracted from s by the index
+func (gotrovi *Gotrovi) indexedText(s Source) (io.ReadCloser, error) {
+	doc, err := gotrovi.backend.Get(s.FullName)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Attachment == nil || doc.Attachment.Content == "" {
+		return nil, fmt.Errorf("no text indexed for %s", s.FullName)
+	}
+	return ioutil.NopCloser(strings.NewReader(doc.Attachment.Content)), nil
+}
+
+// grepText returns the text to look into: the file itself if it is plain
+// text, read as it is searched, the extracted text otherwise. The boolean
+// tells whether the text was extracted. Archive members and mail messages
+// are searched in their indexed text.
+func (gotrovi *Gotrovi) grepText(s Source) (io.ReadCloser, bool, error) {
+	if isArchived(s) || s.Mail != nil {
+		text, err := gotrovi.indexedText(s)
+		return text, true, err
+	}
+	f, err := os.Open(s.FullName)
+	if err != nil {
+		return nil, false, err
+	}
+	text := &grepReader{closers: []io.Closer{f}}
+	// compressed files are searched in their content
+	name := s.FullName
+	r, closer, c, err := decompressedReader(f, gotrovi.decompressSize())
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if c != nil {
+		name = c.contentName(name)
+		text.closers = append([]io.Closer{closer}, text.closers...)
+	}
+	br := bufio.NewReaderSize(r, GREP_SNIFF_SIZE)
+	text.Reader = br
+	_, document := extractors[strings.ToLower(filepath.Ext(name))]
+	if !document {
+		head, _ := br.Peek(GREP_SNIFF_SIZE)
+		if looksLikeText(head) {
+			return text, false, nil
+		}
+		// UTF-16 text is decoded whole
+		if bytes.HasPrefix(head, []byte("\xff\xfe")) || bytes.HasPrefix(head, []byte("\xfe\xff")) {
+			content, err := ioutil.ReadAll(br)
+			text.Close()
+			if err != nil {
+				return nil, false, err
+			}
+			decoded, _ := decodeText(content)
+			return ioutil.NopCloser(strings.NewReader(decoded)), false, nil
+		}
+	}
+	defer text.Close()
+	if indexed, err := gotrovi.indexedText(s); err == nil {
+		return indexed, true, nil
+	}
+	content, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, true, err
+	}
+	a, err := Extract(name, content)
+	if err != nil {
+		return nil, true, err
+	}
+	return ioutil.NopCloser(strings.NewReader(a.Content)), true, nil
+}
+
+// looksLikeText tells whether head, the start of a file, is UTF-8 text
+// without NUL characters. A character cut at its end is valid.
+func looksLikeText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size <= 1 {
+			return len(head) < utf8.UTFMax && !utf8.FullRune(head)
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// changedSinceIndexed tells whether the file on disk differs from the
+// indexed document, so the matches may not be the ones the index found
+func changedSinceIndexed(s Source) bool {
+	info, err := os.Stat(s.FullName)
+	return err == nil && (info.Size() != s.Size || fileDate(info.ModTime()) != s.Date)
+}
+
+// colorMatches colors the matches of line
+func colorMatches(line string, matches [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(line[last:m[0]])
+		b.WriteString(color.FgRed.Render(line[m[0]:m[1]]))
+		last = m[1]
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
+
+// grepEntry prints the matching lines of the hit e, returning whether any
+// was found
+func (gotrovi *Gotrovi) grepEntry(e SearchHit, opts grepOptions, separator bool, buf io.Writer) bool {
+	s := e.Source
+	if s.IsFolder {
+		return false
+	}
+	match := newGrepMatcher(opts, e)
+	if match == nil {
+		return false
+	}
+	pathColor := entryColor(s)
+	context := opts.before > 0 || opts.after > 0
+	// whether or not it still matches, the file may have been found by the
+	// text indexed
+	if changedSinceIndexed(s) {
+		fmt.Fprintf(buf, "%s: %s\n", pathColor(s.FullName), color.FgYellow.Render("changed since it was indexed, run an update sync"))
+	}
+	text, extracted, err := gotrovi.grepText(s)
+	if err != nil {
+		fmt.Fprintf(buf, "%s: %s\n", pathColor(s.FullName), color.FgYellow.Render(err.Error()))
+		return false
+	}
+	defer text.Close()
+
+	// the lines are printed as they are read, keeping the last ones for
+	// the context before a match
+	type grepLine struct {
+		n    int
+		text string
+	}
+	var before []grepLine
+	found := 0
+	last := -1
+	after := 0
+	print := func(l grepLine, matches [][]int) {
+		if context && last >= 0 && l.n > last+1 {
+			fmt.Fprintln(buf, color.FgCyan.Render("--"))
+		}
+		if matches != nil {
+			column := utf8.RuneCountInString(l.text[:matches[0][0]]) + 1
+			fmt.Fprintf(buf, "%s:%s:%s: %s\n", pathColor(s.FullName), color.FgGreen.Render(l.n+1), color.FgGreen.Render(column), colorMatches(l.text, matches))
+		} else {
+			fmt.Fprintf(buf, "%s-%s- %s\n", pathColor(s.FullName), color.FgGreen.Render(l.n+1), l.text)
+		}
+		last = l.n
+	}
+
+	r := bufio.NewReader(text)
+	for n := 0; ; n++ {
+		line, err := r.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(buf, "%s: %s\n", pathColor(s.FullName), color.FgYellow.Render(err.Error()))
+			}
+			break
+		}
+		l := grepLine{n: n, text: strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")}
+		// matching lines, up to maxCount
+		var matches [][]int
+		if opts.maxCount <= 0 || found < opts.maxCount {
+			matches = match(l.text)
+		}
+		switch {
+		case len(matches) != 0:
+			if found == 0 {
+				if extracted {
+					Trace.Println("Grep in the extracted text of", s.FullName)
+				}
+				if context && separator {
+					fmt.Fprintln(buf, color.FgCyan.Render("--"))
+				}
+			}
+			found = found + 1
+			for _, b := range before {
+				print(b, nil)
+			}
+			before = before[:0]
+			print(l, matches)
+			after = opts.after
+		case after > 0:
+			print(l, nil)
+			after = after - 1
+		case opts.maxCount > 0 && found >= opts.maxCount:
+			return true
+		case opts.before > 0:
+			if len(before) == opts.before {
+				before = append(before[:0], before[1:]...)
+			}
+			before = append(before, l)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return found > 0
+}
+
+// Grep prints the lines matching opts in the files found by the query
+func (gotrovi *Gotrovi) Grep(query string, paths []string, search searchOptions, opts grepOptions) {
+	var cmd *exec.Cmd
+	cmd, pager = runPager()
+	defer func() {
+		pager.Close()
+		cmd.Wait()
+	}()
+
+	files := 0
+	search.Highlight = opts.text == ""
+	_, err := gotrovi.find(query, paths, search, func(total int, e SearchHit) {
+		if gotrovi.grepEntry(e, opts, files > 0, pager) {
+			files = files + 1
+		}
+	})
+	if err != nil {
+		Error.Println("Error getting response:", err)
+		if mark, ok := queryErrorMark(query, err); ok {
+			fmt.Fprintln(os.Stderr, mark)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintf(pager, "Found in %d files\n", files)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGrepMatcherWords(t *testing.T) {
+	hit := SearchHit{Highlight: Highlight{Field: []string{"la <em>canción</em> <em>está</em> aquí", "<em>Está</em>"}}}
+	match := newGrepMatcher(grepOptions{}, hit)
+	tests := []struct {
+		line string
+		want [][]int
+	}{
+		{"está", [][]int{{0, 5}}},
+		{"Está bien, ESTÁ", [][]int{{0, 5}, {12, 17}}},
+		{"estás", nil},
+		{"canción, canciónes", [][]int{{0, 8}}},
+		{"la_canción", nil},
+		{"¿está?", [][]int{{2, 7}}},
+		{"está está", [][]int{{0, 5}, {6, 11}}},
+	}
+	for _, test := range tests {
+		if got := match(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: %v, want %v", test.line, got, test.want)
+		}
+	}
+	if newGrepMatcher(grepOptions{}, SearchHit{}) != nil {
+		t.Error("matcher without terms")
+	}
+}
+
+func TestGrepEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lines := "uno\r\ndos zorro\ntres\ncuatro\ncinco\nseis\nsiete\nañoño zorro\nnueve\n"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(lines))
+	zw.Close()
+	files := map[string][]byte{"text.txt": []byte(lines), "text.txt.gz": gz.Bytes()}
+
+	ansi := regexp.MustCompile("\x1b\\[[0-9;]*m")
+	var g Gotrovi
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(p)
+		hit := SearchHit{Source: Source{FullName: p, Size: info.Size(), Date: fileDate(info.ModTime())}}
+		tests := []struct {
+			opts grepOptions
+			want string
+		}{
+			{grepOptions{text: "zorro"}, "{p}:2:5: dos zorro\n{p}:8:7: añoño zorro\n"},
+			{grepOptions{text: "zorro", maxCount: 1, after: 1}, "{p}:2:5: dos zorro\n{p}-3- tres\n"},
+			{grepOptions{text: "ZORRO", before: 1, after: 1}, "{p}-1- uno\n{p}:2:5: dos zorro\n{p}-3- tres\n--\n{p}-7- siete\n{p}:8:7: añoño zorro\n{p}-9- nueve\n"},
+			{grepOptions{text: "o", before: 3}, "{p}:1:3: uno\n{p}:2:2: dos zorro\n{p}-3- tres\n{p}:4:6: cuatro\n{p}:5:5: cinco\n{p}-6- seis\n{p}-7- siete\n{p}:8:3: añoño zorro\n"},
+			{grepOptions{text: "lobo"}, ""},
+		}
+		for _, test := range tests {
+			var buf bytes.Buffer
+			found := g.grepEntry(hit, test.opts, false, &buf)
+			want := strings.Replace(test.want, "{p}", p, -1)
+			if got := ansi.ReplaceAllString(buf.String(), ""); got != want || found != (want != "") {
+				t.Errorf("%s %+v: %v\n%s\nwant\n%s", name, test.opts, found, got, want)
+			}
+		}
+
+		// a file changed since it was indexed is warned about even when
+		// it no longer matches
+		stale := hit
+		stale.Source.Size = stale.Source.Size + 1
+		for _, text := range []string{"zorro", "lobo"} {
+			var buf bytes.Buffer
+			g.grepEntry(stale, grepOptions{text: text}, false, &buf)
+			if got := ansi.ReplaceAllString(buf.String(), ""); !strings.HasPrefix(got, p+": changed since it was indexed") {
+				t.Errorf("%s changed, %s: %s", name, text, got)
+			}
+		}
+	}
+}
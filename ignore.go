@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pborman/getopt"
+)
+
+// Exclusion rules in the gitignore syntax. They come from exclude.patterns,
+// which apply to every indexed folder, the index exclude lists, and the
+// .gotroviignore files found in the indexed folders, plus the .gitignore files
+// when exclude.gitignore is set. As in git, the last rule matching a path
+// decides: the config first, then the files from the indexed folder down,
+// .gitignore before .gotroviignore in the same folder. A rule starting with !
+// includes again what an earlier rule excluded, but not the contents of an
+// excluded folder, which is not walked.
+
+const GOTROVI_IGNORE_FILE = ".gotroviignore"
+const GIT_IGNORE_FILE = ".gitignore"
+
+// Source of the rules from the config file
+const IGNORE_SOURCE_CONFIG = "config"
+
+type ignoreRule struct {
+	// file the rule comes from and its line, or IGNORE_SOURCE_CONFIG
+	source string
+	line   int
+	// the rule as written
+	text string
+	// folder the pattern is relative to
+	base    string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+func (r *ignoreRule) String() string {
+	if r.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", r.source, r.line, r.text)
+	}
+	return r.source + ": " + r.text
+}
+
+// match tells whether the rule matches the absolute path p
+func (r *ignoreRule) match(p string, isDir bool) bool {
+	if r.dirOnly && !isDir || r.re == nil {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// ignorePattern translates a gitignore pattern, without the ! and trailing
+// slash, to a regular expression on the path relative to its folder
+func ignorePattern(pattern string) (*regexp.Regexp, error) {
+	// a slash other than at the end anchors the pattern to its folder,
+	// otherwise it matches the name at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i = i + 2
+		case strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/') && i+2 == len(pattern):
+			b.WriteString(".*")
+			i = i + 1
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i = i + 1
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = i + 1 + end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// parseIgnoreRule parses a line of an ignore file, returning nil for blank
+// lines and comments
+func parseIgnoreRule(line string, base string, source string, n int) (*ignoreRule, error) {
+	// trailing spaces are ignored unless escaped
+	text := strings.TrimRight(line, " \t\r")
+	if strings.HasSuffix(text, `\`) && len(text) < len(strings.TrimRight(line, "\r")) {
+		text = text + " "
+	}
+	if text == "" || strings.HasPrefix(text, "#") {
+		return nil, nil
+	}
+
+	r := &ignoreRule{source: source, line: n, text: text, base: base}
+	pattern := text
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := ignorePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	r.re = re
+	return r, nil
+}
+
+// readIgnoreFile parses the rules of the ignore file p, none if it does not
+// exist
+func readIgnoreFile(p string) ([]*ignoreRule, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*ignoreRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		r, err := parseIgnoreRule(scanner.Text(), filepath.Dir(p), p, n)
+		if err != nil {
+			Warning.Printf("%s:%d: %v\n", p, n, err)
+			continue
+		}
+		if r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// ignoreCache keeps the rules of the ignore files of each folder, and those
+// of the config for each indexed folder
+type ignoreCache struct {
+	lock   sync.Mutex
+	rules  map[string][]*ignoreRule
+	config map[int][]*ignoreRule
+}
+
+// folderRules returns the rules of the ignore files in dir
+func (gotrovi *Gotrovi) folderRules(dir string) []*ignoreRule {
+	c := &gotrovi.ignores
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if rules, ok := c.rules[dir]; ok {
+		return rules
+	}
+	if c.rules == nil {
+		c.rules = make(map[string][]*ignoreRule)
+	}
+	names := []string{GOTROVI_IGNORE_FILE}
+	if gotrovi.conf.Exclude.GitIgnore {
+		names = []string{GIT_IGNORE_FILE, GOTROVI_IGNORE_FILE}
+	}
+	var rules []*ignoreRule
+	for _, name := range names {
+		r, err := readIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			Error.Println("Unable to read", filepath.Join(dir, name)+":", err)
+		}
+		rules = append(rules, r...)
+	}
+	c.rules[dir] = rules
+	return rules
+}
+
+// forgetRules drops the cached rules of dir, after its ignore files change
+func (gotrovi *Gotrovi) forgetRules(dir string) {
+	c := &gotrovi.ignores
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.rules, dir)
+}
+
+// isIgnoreFile tells whether p is an ignore file read by the sync
+func (gotrovi *Gotrovi) isIgnoreFile(p string) bool {
+	name := filepath.Base(p)
+	return name == GOTROVI_IGNORE_FILE || gotrovi.conf.Exclude.GitIgnore && name == GIT_IGNORE_FILE
+}
+
+// configRules returns the rules of the config for the indexed folder id.
+// Absolute paths in its exclude list are anchored to the folder.
+func (gotrovi *Gotrovi) configRules(id int) []*ignoreRule {
+	c := &gotrovi.ignores
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if rules, ok := c.config[id]; ok {
+		return rules
+	}
+	if c.config == nil {
+		c.config = make(map[int][]*ignoreRule)
+	}
+	folder := filepath.Clean(gotrovi.conf.Index[id].Folder)
+	var rules []*ignoreRule
+	add := func(pattern string, setting string, text string) {
+		r, err := parseIgnoreRule(pattern, folder, IGNORE_SOURCE_CONFIG, 0)
+		if err != nil {
+			Warning.Println("Invalid", setting, "pattern:", err)
+			return
+		}
+		if r != nil {
+			r.text = setting + " " + text
+			rules = append(rules, r)
+		}
+	}
+	for _, p := range gotrovi.conf.Exclude.Patterns {
+		add(p, "exclude.patterns", p)
+	}
+	for _, p := range gotrovi.conf.Index[id].Exclude {
+		pattern := p
+		if filepath.IsAbs(p) {
+			rel, err := filepath.Rel(folder, filepath.Clean(p))
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			pattern = "/" + filepath.ToSlash(rel)
+		}
+		add(pattern, "index.exclude", p)
+	}
+	c.config[id] = rules
+	return rules
+}
+
+// ignoredBy returns the last rule matching p in the indexed folder id, nil
+// when none does. The rule may be a negation which includes p.
+func (gotrovi *Gotrovi) ignoredBy(id int, p string, isDir bool) *ignoreRule {
+	var last *ignoreRule
+	check := func(rules []*ignoreRule) {
+		for _, r := range rules {
+			if r.match(p, isDir) {
+				last = r
+			}
+		}
+	}
+	check(gotrovi.configRules(id))
+
+	folder := filepath.Clean(gotrovi.conf.Index[id].Folder)
+	rel, err := filepath.Rel(folder, filepath.Dir(p))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return last
+	}
+	dir := folder
+	check(gotrovi.folderRules(dir))
+	if rel != "." {
+		for _, name := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, name)
+			check(gotrovi.folderRules(dir))
+		}
+	}
+	return last
+}
+
+// exclusion returns the rule excluding path, nil if it is indexed. The
+// legacy exclude settings are checked first and cannot be negated.
+func (gotrovi *Gotrovi) exclusion(id int, info os.FileInfo, path string) *ignoreRule {
+	config := func(setting string, value string) *ignoreRule {
+		return &ignoreRule{source: IGNORE_SOURCE_CONFIG, text: setting + " " + value}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return &ignoreRule{source: "symlink", text: "symlinks are not followed"}
+	}
+	if info.IsDir() {
+		for _, name := range gotrovi.conf.Exclude.Folder {
+			if info.Name() == name {
+				return config("exclude.folder", name)
+			}
+		}
+	} else {
+		for _, ext := range gotrovi.conf.Exclude.Extension {
+			if filepath.Ext(path) == ext {
+				return config("exclude.extension", ext)
+			}
+		}
+		// big text files are chunked instead
+		if info.Size() > gotrovi.conf.Exclude.Size && !gotrovi.isExpanded(path) && !metadataOnly(path) && gotrovi.mailFormat(path) == "" && (gotrovi.chunkSize() == 0 || !isTextFile(path)) {
+			return config("exclude.size", fmt.Sprint(gotrovi.conf.Exclude.Size))
+		}
+	}
+
+	r := gotrovi.ignoredBy(id, path, info.IsDir())
+	if r == nil || r.negate {
+		return nil
+	}
+	return r
+}
+
+type ignoreCheck struct {
+	Path     string `json:"path"`
+	Excluded bool   `json:"excluded"`
+	// excluded folder containing the path
+	Parent string `json:"parent,omitempty"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkIgnore tells whether p is excluded from the sync, walking down from
+// its indexed folder as the sync does
+func (gotrovi *Gotrovi) checkIgnore(p string) ignoreCheck {
+	check := ignoreCheck{Path: p}
+	id := gotrovi.indexForPath(p)
+	if id < 0 {
+		check.Excluded = true
+		check.Rule = "not in an indexed folder"
+		return check
+	}
+	folder := filepath.Clean(gotrovi.conf.Index[id].Folder)
+	rel, _ := filepath.Rel(folder, p)
+	if rel == "." {
+		return check
+	}
+	dir := folder
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			check.Error = err.Error()
+			return check
+		}
+		if r := gotrovi.exclusion(id, info, dir); r != nil {
+			check.Excluded = true
+			if dir != p {
+				check.Parent = dir
+			}
+			check.Source, check.Line, check.Rule = r.source, r.line, r.text
+			return check
+		}
+	}
+	return check
+}
+
+func (gotrovi *Gotrovi) CheckIgnore(args []string) {
+	opts := getopt.New()
+	opts.SetProgram("gotrovi check-ignore")
+	opts.SetParameters("paths ...")
+	optHelp := opts.BoolLong("help", 'h', "Show this message")
+	optOutput := opts.StringLong("output", 'o', OUTPUT_TEXT, "Output format: \"text\" (default) or \"json\"")
+	opts.Parse(args)
+
+	if *optHelp || opts.NArgs() == 0 {
+		fmt.Println("Tells whether the given paths are excluded from the index, and by which rule of the config, .gotroviignore or .gitignore file. The exit status is 0 when any path is excluded, 1 otherwise")
+		opts.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if *optOutput != OUTPUT_TEXT && *optOutput != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "Unknown output format \""+*optOutput+"\", use text or json")
+		os.Exit(1)
+	}
+
+	checks := []ignoreCheck{}
+	excluded := false
+	for _, arg := range opts.Args() {
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		check := gotrovi.checkIgnore(p)
+		excluded = excluded || check.Excluded
+		checks = append(checks, check)
+	}
+
+	if *optOutput == OUTPUT_JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(checks)
+	} else {
+		for _, c := range checks {
+			switch {
+			case c.Error != "":
+				fmt.Printf("%s: %s\n", c.Path, c.Error)
+			case !c.Excluded:
+				fmt.Printf("%s: not excluded\n", c.Path)
+			case c.Source == "":
+				fmt.Printf("%s: %s\n", c.Path, c.Rule)
+			default:
+				rule := &ignoreRule{source: c.Source, line: c.Line, text: c.Rule}
+				if c.Parent != "" {
+					fmt.Printf("%s: in %s, excluded by %s\n", c.Path, c.Parent, rule)
+				} else {
+					fmt.Printf("%s: excluded by %s\n", c.Path, rule)
+				}
+			}
+		}
+	}
+	if !excluded {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apoorvam/goterminal"
+)
+
+func TestIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"**/node_modules", "node_modules", true, true},
+		{"**/node_modules", "a/b/node_modules", true, true},
+		{"**/node_modules", "a/node_modules_old", true, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "x/a/b", false, false},
+		{"a/**", "a/x/y", false, true},
+		{"*.min.js", "app.min.js", false, true},
+		{"*.min.js", "static/js/app.min.js", false, true},
+		{"*.min.js", "app.js", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"build", "src/build", true, true},
+		{"build", "build", false, true},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/x/a.txt", false, false},
+		{"doc/*.txt", "src/doc/a.txt", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "a/cache", true, true},
+		{"cache/", "cache", false, false},
+		{"log[abc].txt", "logb.txt", false, true},
+		{"log[abc].txt", "logd.txt", false, false},
+		{"log[!0-9].txt", "log3.txt", false, false},
+		{"log[!0-9].txt", "logx.txt", false, true},
+		{"file?.c", "file1.c", false, true},
+		{"file?.c", "file10.c", false, false},
+		{`\#notes`, "#notes", false, true},
+		{`\!important`, "!important", false, true},
+		{`foo\ `, "foo ", false, true},
+		{`foo\*`, "foo*", false, true},
+		{`foo\*`, "foobar", false, false},
+	}
+	for _, test := range tests {
+		r, err := parseIgnoreRule(test.pattern, "/root", "test", 1)
+		if err != nil || r == nil {
+			t.Errorf("%s: %v %v", test.pattern, r, err)
+			continue
+		}
+		if got := r.match("/root/"+test.path, test.isDir); got != test.want {
+			t.Errorf("%s on %s: %v, want %v (%s)", test.pattern, test.path, got, test.want, r.re)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "!"} {
+		if r, err := parseIgnoreRule(line, "/root", "test", 1); r != nil || err != nil {
+			t.Errorf("%q: %v %v, want no rule", line, r, err)
+		}
+	}
+	if _, err := parseIgnoreRule("log[abc", "/root", "test", 1); err == nil {
+		t.Error("unterminated class accepted")
+	}
+	r, _ := parseIgnoreRule("!keep.log", "/root", "test", 1)
+	if !r.negate || !r.match("/root/a/keep.log", false) {
+		t.Errorf("!keep.log: %+v", r)
+	}
+}
+
+// testIgnoreTree creates the files of a tree with ignore files in dir
+func testIgnoreTree(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckIgnore(t *testing.T) {
+	root, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	testIgnoreTree(t, root, map[string]string{
+		".gitignore":                  "*.tmp\n",
+		".gotroviignore":              "*.log\n/build\n# comment\n!*.tmp\n",
+		"app/.gotroviignore":          "!keep.log\n",
+		"app/deep/.gotroviignore":     "keep.log\n",
+		"app/keep.log":                "",
+		"app/other.log":               "",
+		"app/deep/keep.log":           "",
+		"app/scratch.tmp":             "",
+		"app/app.min.js":              "",
+		"app/app.js":                  "",
+		"app/build/out.o":             "",
+		"build/out.o":                 "",
+		"web/node_modules/x/index.js": "",
+		"logs/skip.me":                "",
+	})
+	var g Gotrovi
+	g.conf = GotroviConf{
+		Index: []Index{{Folder: root, Exclude: []string{filepath.Join(root, "logs")}}},
+		Exclude: Exclude{
+			Size:      1 << 30,
+			Patterns:  []string{"**/node_modules", "*.min.js"},
+			GitIgnore: true,
+		},
+	}
+
+	tests := []struct {
+		path   string
+		parent string
+		source string
+		line   int
+		rule   string
+	}{
+		{"app/app.js", "", "", 0, ""},
+		{"app/keep.log", "", "", 0, ""},
+		{"app/other.log", "", ".gotroviignore", 1, "*.log"},
+		{"app/deep/keep.log", "", "app/deep/.gotroviignore", 1, "keep.log"},
+		{"app/scratch.tmp", "", "", 0, ""},
+		{"app/app.min.js", "", IGNORE_SOURCE_CONFIG, 0, "exclude.patterns *.min.js"},
+		{"app/build/out.o", "", "", 0, ""},
+		{"build/out.o", "build", ".gotroviignore", 2, "/build"},
+		{"web/node_modules/x/index.js", "web/node_modules", IGNORE_SOURCE_CONFIG, 0, "exclude.patterns **/node_modules"},
+		{"logs/skip.me", "logs", IGNORE_SOURCE_CONFIG, 0, "index.exclude " + filepath.Join(root, "logs")},
+	}
+	for _, test := range tests {
+		p := filepath.Join(root, test.path)
+		check := g.checkIgnore(p)
+		want := ignoreCheck{Path: p, Excluded: test.rule != "", Line: test.line, Rule: test.rule}
+		if test.parent != "" {
+			want.Parent = filepath.Join(root, test.parent)
+		}
+		if test.source != "" && test.source != IGNORE_SOURCE_CONFIG {
+			want.Source = filepath.Join(root, test.source)
+		} else {
+			want.Source = test.source
+		}
+		if check != want {
+			t.Errorf("%s: %+v, want %+v", test.path, check, want)
+		}
+
+		// the sync excludes the file or its folder by the same rule
+		excluded := p
+		if test.parent != "" {
+			excluded = want.Parent
+		}
+		info, err := os.Lstat(excluded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := g.exclusion(0, info, excluded)
+		if (r != nil) != check.Excluded || r != nil && (r.source != check.Source || r.line != check.Line || r.text != check.Rule) {
+			t.Errorf("%s: sync excludes it by %v, check-ignore by %+v", test.path, r, check)
+		}
+	}
+
+	if check := g.checkIgnore("/elsewhere/file"); !check.Excluded {
+		t.Errorf("file outside the indexed folders: %+v", check)
+	}
+}
+
+func TestSyncUpdateExcluded(t *testing.T) {
+	settings, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(settings)
+	GOTROVI_SETTINGS_FOLDER = settings + "/"
+	root := filepath.Join(settings, "root")
+	testIgnoreTree(t, root, map[string]string{
+		"keep.txt":       "kept",
+		"debug.log":      "excluded later",
+		"cache/data.txt": "excluded later",
+	})
+	var g Gotrovi
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 1 << 30}, Backend: BACKEND_LOCAL, Hash: "md5"}
+	g.jobs = 2
+	g.writer = goterminal.New(ioutil.Discard)
+	g.OpenBackend()
+	g.OpenState()
+	g.InitHash()
+	g.SyncForced(0)
+	g.cp = nil
+
+	testIgnoreTree(t, root, map[string]string{".gotroviignore": "*.log\ncache/\n"})
+	g.forgetRules(root)
+	g.startIndexer()
+	g.SyncUpdate(false)
+	g.stopIndexer()
+
+	for name, indexed := range map[string]bool{"keep.txt": true, ".gotroviignore": true, "debug.log": false, "cache": false, "cache/data.txt": false} {
+		p := filepath.Join(root, name)
+		found := g.backend.Exists(p)
+		if _, ok := g.state.get(p); found != indexed || ok != indexed {
+			t.Errorf("%s: indexed %v, in the state %v, want %v", name, found, ok, indexed)
+		}
+	}
+}
@@ -29,6 +29,8 @@ const CONFIG_JSON = `{
         "size": 1000000
     },
     "hash": "md5",
+    "backend": "elasticsearch",
+    "extractor": "ingest",
     "elasticsearch": {
       "host": "localhost",
       "port": 9200
@@ -110,8 +112,14 @@ func (gotrovi *Gotrovi) Install() {
 		os.Exit(1)
 	}
 
+	if gotrovi.conf.Backend == BACKEND_LOCAL {
+		fmt.Println("Using the local index, no need for Elasticsearch. Enjoy Gotrovi now")
+		Info.Println("Install Done")
+		return
+	}
+
 	Info.Println("3. Check if Elasticsearch is running and launch it if not")
-	err = gotrovi.ConnectElasticSearch()
+	err = gotrovi.OpenBackend()
 	if err != nil {
 
 		info, err := os.Stat(path + "/es_data")
@@ -186,7 +194,7 @@ func (gotrovi *Gotrovi) Install() {
 		Trace.Println(resp.ID)
 
 		fmt.Print("Waiting for ElasticSearch to be up")
-		for retry := ES_RETRY_COUNT; retry > 0 && nil != gotrovi.ConnectElasticSearch(); {
+		for retry := ES_RETRY_COUNT; retry > 0 && nil != gotrovi.OpenBackend(); {
 			time.Sleep(ES_RETRY_TIME * time.Second)
 			Trace.Println("ElasticSearch is not up yet, retrying")
 			retry = retry - 1
@@ -194,7 +202,7 @@ func (gotrovi *Gotrovi) Install() {
 		}
 
 		fmt.Println(" Ready!!")
-		err = gotrovi.ConnectElasticSearch()
+		err = gotrovi.OpenBackend()
 		if err != nil {
 			Error.Println("Unable to get ElasticSearch running. Error: ")
 			Error.Println(err)
@@ -0,0 +1,59 @@
+package main
+
+// Very small language guesser based on the most frequent words of each
+// language. It returns ISO 639-1 codes, as the ingest attachment plugin does.
+
+const LANGUAGE_SAMPLE = 20000
+const LANGUAGE_MIN_HITS = 5
+
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "that", "it", "for", "with", "as", "was", "on", "be", "this", "are", "by", "not", "or", "have", "from", "which", "you"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "se", "del", "las", "por", "un", "para", "con", "una", "su", "al", "es", "lo", "como", "más", "pero", "sus"},
+	"fr": {"le", "la", "de", "et", "les", "des", "est", "un", "une", "du", "que", "pour", "dans", "qui", "pas", "sur", "au", "avec", "ce", "il", "sont", "nous", "vous"},
+	"de": {"der", "die", "und", "in", "den", "von", "zu", "das", "mit", "sich", "des", "auf", "für", "ist", "im", "dem", "nicht", "ein", "eine", "als", "auch", "es", "an"},
+	"it": {"il", "di", "che", "e", "la", "per", "un", "in", "del", "non", "sono", "una", "della", "con", "si", "le", "da", "gli", "al", "nel", "anche", "questo", "lo"},
+	"pt": {"de", "que", "e", "o", "da", "em", "um", "para", "com", "não", "uma", "os", "no", "se", "na", "por", "mais", "as", "dos", "como", "mas", "ao", "ele"},
+	"nl": {"de", "en", "van", "het", "een", "in", "is", "dat", "op", "te", "zijn", "met", "voor", "niet", "aan", "er", "om", "ook", "als", "bij", "wordt", "maar", "door"},
+	"eo": {"la", "kaj", "de", "en", "estas", "al", "ne", "por", "kun", "mi", "vi", "ni", "ili", "tiu", "sed", "ke", "pri", "estis", "kiu", "da", "el", "se", "ankaŭ"},
+}
+
+var stopwordIndex map[string][]string
+
+func init() {
+	stopwordIndex = make(map[string][]string)
+	for lang, words := range stopwords {
+		for _, w := range words {
+			stopwordIndex[w] = append(stopwordIndex[w], lang)
+		}
+	}
+}
+
+func detectLanguage(text string) string {
+	if len(text) > LANGUAGE_SAMPLE {
+		text = text[:LANGUAGE_SAMPLE]
+	}
+
+	hits := make(map[string]int)
+	for _, t := range analyze(text) {
+		for _, lang := range stopwordIndex[t.term] {
+			hits[lang]++
+		}
+	}
+
+	best := ""
+	for lang, n := range hits {
+		if best == "" || n > hits[best] || (n == hits[best] && lang < best) {
+			best = lang
+		}
+	}
+	if best == "" || hits[best] < LANGUAGE_MIN_HITS {
+		return ""
+	}
+	// too close to call
+	for lang, n := range hits {
+		if lang != best && n*10 > hits[best]*9 {
+			return ""
+		}
+	}
+	return best
+}
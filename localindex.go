@@ -0,0 +1,1221 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Embedded full text index, used when no Elasticsearch server is available.
+// Documents and an inverted index of their text fields are kept in memory
+// and the whole index is written to disk as a gob file on Refresh, when it
+// changed since the last one. It suits personal folders rather than large
+// trees, watch mode saving it at most once every WATCH_SAVE_TIME.
+
+const LOCAL_INDEX_FILE = "index.gob"
+
+// New generation being built by a reindex
+const LOCAL_BUILDING_FILE = "index.new.gob"
+
+// Previous generations kept by a reindex, named with their replacement time
+const LOCAL_PREVIOUS_FILE = "index-%s.gob"
+const LOCAL_PREVIOUS_GLOB = "index-*.gob"
+const LOCAL_INDEX_VERSION = 2
+
+// Integrity events recorded by verify, one json object per line. DeleteIndex
+// keeps them.
+const LOCAL_EVENTS_FILE = "events.json"
+
+// Highlighted fragments, as the ES defaults
+const LOCAL_FRAGMENT_SIZE = 100
+const LOCAL_FRAGMENTS = 5
+
+// localNumericFields are compared as numbers in ranges
+var localNumericFields = map[string]bool{"size": true, "uncompressed_size": true, "meta.pages": true, "meta.width": true, "meta.height": true, "meta.year": true, "meta.track": true}
+
+// localDateFields are compared as dates in ranges
+var localDateFields = map[string]bool{"date": true, "mail.date": true, "meta.taken": true, "meta.created": true}
+
+// localKeywordFields have a keyword subfield, mirroring GOTROVI_MAPPING
+var localKeywordFields = map[string]bool{"filename": true, "path": true, "fullpath": true, "archive": true, "mail.from": true, "mail.to": true, "mail.cc": true, "mail.subject": true, "meta.title": true, "meta.author": true, "meta.camera": true, "meta.artist": true, "meta.album": true, "meta.genre": true}
+
+var localTextFields = []string{"filename", "fullpath", "path", "archive", "extension", "hash", "isfolder", "date", "mode", "attachment.content", "attachment.content_type", "attachment.language", "attachment.error", "mail.from", "mail.to", "mail.cc", "mail.subject", "mail.date", "mail.message_id", "meta.title", "meta.author", "meta.subject", "meta.keywords", "meta.created", "meta.camera", "meta.taken", "meta.gps", "meta.artist", "meta.album", "meta.genre"}
+
+type localDoc struct {
+	Source      Source
+	Content     string
+	ContentType string
+	Language    string
+	ExtractErr  string
+	Deleted     bool
+}
+
+type posting struct {
+	Doc  int32
+	Freq int32
+}
+
+type localIndexData struct {
+	Version    int
+	Generation string
+	Docs       []localDoc
+	Postings   map[string]map[string][]posting
+}
+
+type localBackend struct {
+	folder string
+	lock   sync.Mutex
+	data   localIndexData
+	ids    map[string]int32
+	live   int
+	dirty  bool
+	// a new generation is being built in LOCAL_BUILDING_FILE, the current
+	// one is kept until FinishReindex
+	reindexing bool
+}
+
+type localToken struct {
+	term  string
+	start int
+	end   int
+}
+
+func newLocalBackend(folder string) *localBackend {
+	return &localBackend{folder: folder}
+}
+
+// file is where the index is written, the new generation is kept apart
+// while it is being built
+func (b *localBackend) file() string {
+	if b.reindexing {
+		return filepath.Join(b.folder, LOCAL_BUILDING_FILE)
+	}
+	return filepath.Join(b.folder, LOCAL_INDEX_FILE)
+}
+
+func (b *localBackend) reset() {
+	b.data = localIndexData{Version: LOCAL_INDEX_VERSION, Generation: time.Now().UTC().Format(time.RFC3339Nano), Postings: make(map[string]map[string][]posting)}
+	b.ids = make(map[string]int32)
+	b.live = 0
+}
+
+func (b *localBackend) Open() error {
+	b.reset()
+
+	err := os.MkdirAll(b.folder, os.ModePerm)
+	if err != nil {
+		Error.Println("Unable to create local index folder " + b.folder)
+		return err
+	}
+
+	err = b.load()
+	if os.IsNotExist(err) {
+		Trace.Println("Local index not found, starting empty")
+		return nil
+	}
+	if err != nil {
+		Error.Println("Local index "+b.file()+" is corrupt or outdated, starting empty. Sync again to rebuild it:", err)
+		b.reset()
+	}
+	return nil
+}
+
+// load reads file() into memory
+func (b *localBackend) load() error {
+	f, err := os.Open(b.file())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&b.data)
+	if err == nil && b.data.Version != LOCAL_INDEX_VERSION {
+		err = fmt.Errorf("version %d, expected %d", b.data.Version, LOCAL_INDEX_VERSION)
+	}
+	if err != nil {
+		return err
+	}
+
+	if b.data.Generation == "" {
+		b.data.Generation = time.Now().UTC().Format(time.RFC3339Nano)
+		b.dirty = true
+	}
+
+	for i, d := range b.data.Docs {
+		if !d.Deleted {
+			b.ids[chunkID(d.Source.FullName, d.Source.Chunk)] = int32(i)
+			b.live = b.live + 1
+		}
+	}
+	Trace.Println("Loaded local index with", b.live, "documents")
+	return nil
+}
+
+func (b *localBackend) Generation() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.data.Generation
+}
+
+func (b *localBackend) Close() error {
+	return b.Refresh()
+}
+
+func (b *localBackend) DeleteIndex() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.reset()
+	previous, _ := filepath.Glob(filepath.Join(b.folder, LOCAL_PREVIOUS_GLOB))
+	previous = append(previous, filepath.Join(b.folder, LOCAL_BUILDING_FILE))
+	for _, f := range append(previous, b.file()) {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) BeginReindex() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.reset()
+	b.reindexing = true
+	b.dirty = true
+	return nil
+}
+
+func (b *localBackend) ResumeReindex(generation string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.reset()
+	b.reindexing = true
+	err := b.load()
+	if err == nil && b.data.Generation != generation {
+		err = fmt.Errorf("found generation %s", b.data.Generation)
+	}
+	if err != nil {
+		b.reindexing = false
+		b.reset()
+		b.load()
+		return fmt.Errorf("unable to resume index generation %s: %v", generation, err)
+	}
+	return nil
+}
+
+func (b *localBackend) AbortReindex() error {
+	b.lock.Lock()
+	os.Remove(filepath.Join(b.folder, LOCAL_BUILDING_FILE))
+	b.reindexing = false
+	b.dirty = false
+	b.lock.Unlock()
+
+	// back to the current generation
+	return b.Open()
+}
+
+func (b *localBackend) FinishReindex(keep int) error {
+	// write the new generation completely before replacing the current one
+	err := b.Refresh()
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	building := b.file()
+	b.reindexing = false
+	if keep > 0 {
+		previous := filepath.Join(b.folder, fmt.Sprintf(LOCAL_PREVIOUS_FILE, time.Now().UTC().Format("20060102150405")))
+		err := os.Rename(b.file(), previous)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = os.Rename(building, b.file())
+	if err != nil {
+		return err
+	}
+
+	previous, err := filepath.Glob(filepath.Join(b.folder, LOCAL_PREVIOUS_GLOB))
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(previous)))
+	if len(previous) > keep {
+		for _, f := range previous[keep:] {
+			Info.Println("Deleting previous index " + f)
+			os.Remove(f)
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) Refresh() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.dirty {
+		return nil
+	}
+
+	// drop deleted documents once they are a significant part of the index
+	if len(b.data.Docs) > 2*b.live {
+		b.compact()
+	}
+
+	tmp := b.file() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&b.data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, b.file())
+	if err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+func (b *localBackend) compact() {
+	docs := b.data.Docs
+	generation := b.data.Generation
+	b.reset()
+	b.data.Generation = generation
+	for _, d := range docs {
+		if !d.Deleted {
+			b.add(d)
+		}
+	}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// analyze splits s in lowercase words, roughly as the standard analyzer
+// does: "." and "'" between letters or digits do not break words
+func analyze(s string) []localToken {
+	var tokens []localToken
+	start := -1
+	prev := ' '
+	for i, r := range s {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			prev = r
+			continue
+		}
+		if start >= 0 && (r == '.' || r == '\'') && isWordRune(prev) {
+			next, _ := utf8.DecodeRuneInString(s[i+1:])
+			if isWordRune(next) {
+				prev = r
+				continue
+			}
+		}
+		if start >= 0 {
+			tokens = append(tokens, localToken{term: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+		prev = r
+	}
+	if start >= 0 {
+		tokens = append(tokens, localToken{term: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+// subField splits the keyword subfields of localKeywordFields and the tree
+// subfields of path and fullpath, mirroring GOTROVI_MAPPING
+func subField(name string) (string, string) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, ""
+	}
+	base, sub := name[:i], name[i+1:]
+	switch {
+	case sub == "keyword" && localKeywordFields[base]:
+	case sub == "tree" && (base == "path" || base == "fullpath"):
+	default:
+		return name, ""
+	}
+	return base, sub
+}
+
+func (d *localDoc) field(name string) (string, bool) {
+	s := d.Source
+	name, _ = subField(name)
+	switch name {
+	case "filename":
+		return s.FileName, true
+	case "fullpath":
+		return s.FullName, true
+	case "path":
+		return s.Path, true
+	case "archive":
+		return s.Archive, true
+	case "size":
+		return strconv.FormatInt(s.Size, 10), true
+	case "uncompressed_size":
+		if s.UncompressedSize == 0 {
+			return "", true
+		}
+		return strconv.FormatInt(s.UncompressedSize, 10), true
+	case "extension":
+		return s.Extension, true
+	case "hash":
+		return s.Hash, true
+	case "isfolder":
+		return strconv.FormatBool(s.IsFolder), true
+	case "date":
+		return s.Date, true
+	case "mode":
+		return s.Mode, true
+	case "attachment.content":
+		return d.Content, true
+	case "attachment.content_type":
+		return d.ContentType, true
+	case "attachment.language":
+		return d.Language, true
+	case "attachment.error":
+		return d.ExtractErr, true
+	}
+	if strings.HasPrefix(name, "mail.") {
+		m := s.Mail
+		if m == nil {
+			m = &Mail{}
+		}
+		switch name {
+		case "mail.from":
+			return m.From, true
+		case "mail.to":
+			return m.To, true
+		case "mail.cc":
+			return m.Cc, true
+		case "mail.subject":
+			return m.Subject, true
+		case "mail.date":
+			return m.Date, true
+		case "mail.message_id":
+			return m.MessageID, true
+		}
+	}
+	if strings.HasPrefix(name, "meta.") {
+		return s.Meta.field(strings.TrimPrefix(name, "meta."))
+	}
+	return "", false
+}
+
+func (b *localBackend) add(d localDoc) {
+	n := int32(len(b.data.Docs))
+	b.data.Docs = append(b.data.Docs, d)
+	b.ids[chunkID(d.Source.FullName, d.Source.Chunk)] = n
+	b.live = b.live + 1
+
+	for _, field := range localTextFields {
+		v, _ := d.field(field)
+		freqs := make(map[string]int32)
+		for _, t := range analyze(v) {
+			freqs[t.term]++
+		}
+		if len(freqs) == 0 {
+			continue
+		}
+		terms := b.data.Postings[field]
+		if terms == nil {
+			terms = make(map[string][]posting)
+			b.data.Postings[field] = terms
+		}
+		for t, f := range freqs {
+			terms[t] = append(terms[t], posting{Doc: n, Freq: f})
+		}
+	}
+}
+
+func (b *localBackend) remove(p string) bool {
+	n, ok := b.ids[p]
+	if !ok {
+		return false
+	}
+	b.data.Docs[n].Deleted = true
+	b.data.Docs[n].Content = ""
+	delete(b.ids, p)
+	b.live = b.live - 1
+	return true
+}
+
+func docFromItem(item bulkItem) localDoc {
+	d := localDoc{
+		Source: Source{
+			FileName:         item.doc.FileName,
+			FullName:         item.doc.FullName,
+			Path:             item.doc.Path,
+			Size:             item.doc.Size,
+			Extension:        item.doc.Extension,
+			Hash:             item.doc.Hash,
+			IsFolder:         item.doc.IsFolder,
+			Date:             item.doc.Date,
+			Mode:             item.doc.Mode,
+			Chunk:            item.doc.Chunk,
+			Chunks:           item.doc.Chunks,
+			Offset:           item.doc.Offset,
+			Archive:          item.doc.Archive,
+			Members:          item.doc.Members,
+			UncompressedSize: item.doc.UncompressedSize,
+			Mail:             item.doc.Mail,
+			Meta:             item.doc.Meta,
+		},
+	}
+	if item.doc.Attachment != nil {
+		d.Content = item.doc.Attachment.Content
+		d.ContentType = item.doc.Attachment.ContentType
+		d.Language = item.doc.Attachment.Language
+		d.ExtractErr = item.doc.Attachment.Error
+	}
+	return d
+}
+
+func (b *localBackend) Index(items []bulkItem) ([]bulkItem, []bulkItem) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, item := range items {
+		b.remove(item.path)
+		b.add(docFromItem(item))
+	}
+	b.dirty = true
+	return nil, nil
+}
+
+func (b *localBackend) Delete(p string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.remove(p) {
+		b.dirty = true
+	}
+	return nil
+}
+
+func (b *localBackend) DeleteChunks(p string, from int) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for n := from; n > 0 && b.remove(chunkID(p, n)); n++ {
+		b.dirty = true
+	}
+	return nil
+}
+
+func (b *localBackend) DeleteMembers(p string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for id := range b.ids {
+		if strings.HasPrefix(id, p+ARCHIVE_SEPARATOR) && b.remove(id) {
+			b.dirty = true
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) Exists(p string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.ids[p]
+	return ok
+}
+
+func (b *localBackend) Get(p string) (*FileDescriptionDoc, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n, ok := b.ids[p]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in the local index", p)
+	}
+	s := b.data.Docs[n].Source
+	d := &b.data.Docs[n]
+	return &FileDescriptionDoc{
+		FileName:         s.FileName,
+		FullName:         s.FullName,
+		Path:             s.Path,
+		Size:             s.Size,
+		Extension:        s.Extension,
+		Hash:             s.Hash,
+		IsFolder:         s.IsFolder,
+		Date:             s.Date,
+		Mode:             s.Mode,
+		Chunks:           s.Chunks,
+		Archive:          s.Archive,
+		Members:          s.Members,
+		UncompressedSize: s.UncompressedSize,
+		Mail:             s.Mail,
+		Meta:             s.Meta,
+		Attachment:       &Attachment{Content: d.Content, ContentType: d.ContentType, Language: d.Language, Error: d.ExtractErr},
+	}, nil
+}
+
+func (b *localBackend) ScrollAll(fn searchFunc) error {
+	return b.Search("*", searchOptions{Sort: []sortField{{Field: "fullpath"}}}, fn)
+}
+
+// localSortValue returns the value of the sort field f of a hit
+func localSortValue(hit *SearchHit, f string) interface{} {
+	s := &hit.Source
+	switch f {
+	case SORT_SCORE:
+		return hit.Score
+	case "filename":
+		return s.FileName
+	case "path":
+		return s.Path
+	case "size":
+		return s.Size
+	case "date":
+		if t, ok := parseDate(s.Date); ok {
+			return t.UnixNano()
+		}
+		return int64(0)
+	case "extension":
+		return s.Extension
+	}
+	return s.FullName
+}
+
+// compareValues compares two values returned by localSortValue
+func compareValues(a interface{}, b interface{}) int {
+	switch va := a.(type) {
+	case float64:
+		vb := b.(float64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+	case int64:
+		vb := b.(int64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+	case string:
+		return strings.Compare(va, b.(string))
+	}
+	return 0
+}
+
+// compareHits orders two hits by the sort fields, then by fullpath and
+// chunk
+func compareHits(a *SearchHit, b *SearchHit, fields []sortField) int {
+	for _, f := range fields {
+		c := compareValues(localSortValue(a, f.Field), localSortValue(b, f.Field))
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if c := strings.Compare(a.Source.FullName, b.Source.FullName); c != 0 {
+		return c
+	}
+	return a.Source.Chunk - b.Source.Chunk
+}
+
+func (b *localBackend) Search(query string, opts searchOptions, fn searchFunc) error {
+	q, err := parseSearchQuery(query, opts.Raw)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	scores := b.eval(q)
+	hits := make([]SearchHit, 0, len(scores))
+	for n, score := range scores {
+		hits = append(hits, SearchHit{Score: score, Source: b.data.Docs[n].Source})
+	}
+	b.lock.Unlock()
+
+	sortBy := opts.Sort
+	if len(sortBy) == 0 {
+		sortBy = []sortField{{Field: SORT_SCORE, Desc: true}}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return compareHits(&hits[i], &hits[j], sortBy) < 0
+	})
+
+	collapsed := hits[:0]
+	collapse := newChunkCollapser(func(hit SearchHit) {
+		collapsed = append(collapsed, hit)
+	})
+	for _, hit := range hits {
+		collapse.add(hit)
+	}
+	collapse.flush()
+	hits = collapsed
+
+	total := len(hits)
+	if opts.Offset < len(hits) {
+		hits = hits[opts.Offset:]
+	} else {
+		hits = nil
+	}
+	if opts.Limit > 0 && opts.Limit < len(hits) {
+		hits = hits[:opts.Limit]
+	}
+
+	for _, hit := range hits {
+		if opts.Highlight {
+			b.lock.Lock()
+			if n, ok := b.ids[chunkID(hit.Source.FullName, hit.Source.Chunk)]; ok {
+				hit.Highlight.Field = fragments(b.data.Docs[n].Content, highlightMatcher(q))
+			}
+			b.lock.Unlock()
+		}
+		fn(total, hit)
+	}
+	return nil
+}
+
+func (b *localBackend) Duplicates(query string, fn func(docs []Source)) error {
+	q, err := parseSearchQuery(query, false)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	bySize := make(map[int64][]Source)
+	for n := range b.eval(q) {
+		s := b.data.Docs[n].Source
+		if !s.IsFolder && s.Hash != "" && s.Chunk == 0 && !isArchived(s) {
+			bySize[s.Size] = append(bySize[s.Size], s)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, docs := range bySize {
+		if len(docs) < 2 {
+			continue
+		}
+		byHash := make(map[string][]Source)
+		for _, s := range docs {
+			byHash[s.Hash] = append(byHash[s.Hash], s)
+		}
+		for _, group := range byHash {
+			if len(group) > 1 {
+				fn(group)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) Stats(query string, folders []string) (*indexStats, error) {
+	q, err := parseSearchQuery(query, false)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stats := &indexStats{Largest: []statsFile{}}
+	extensions := make(map[string]*statsCount)
+	contentTypes := make(map[string]*statsCount)
+	languages := make(map[string]*statsCount)
+	inFolders := make([]statsCount, len(folders))
+	for i, f := range folders {
+		inFolders[i].Key = f
+	}
+	count := func(counts map[string]*statsCount, key string, size int64) {
+		c, ok := counts[key]
+		if !ok {
+			c = &statsCount{Key: key}
+			counts[key] = c
+		}
+		c.Count = c.Count + 1
+		c.Size = c.Size + size
+	}
+
+	for n := range b.eval(q) {
+		d := &b.data.Docs[n]
+		s := d.Source
+		if s.IsFolder {
+			stats.Folders = stats.Folders + 1
+			continue
+		}
+		if s.Chunk > 0 || isArchived(s) {
+			continue
+		}
+		stats.Files = stats.Files + 1
+		stats.Size = stats.Size + s.Size
+		if stats.Oldest == "" || compareBound(s.Date, stats.Oldest, "date") < 0 {
+			stats.Oldest = s.Date
+		}
+		if stats.Newest == "" || compareBound(s.Date, stats.Newest, "date") > 0 {
+			stats.Newest = s.Date
+		}
+		if d.ExtractErr != "" {
+			stats.ExtractionFailed = stats.ExtractionFailed + 1
+		}
+		count(extensions, s.Extension, s.Size)
+		count(contentTypes, d.ContentType, s.Size)
+		count(languages, d.Language, s.Size)
+		for i, f := range folders {
+			if s.Path == f || strings.HasPrefix(s.Path, strings.TrimSuffix(f, "/")+"/") {
+				inFolders[i].Count = inFolders[i].Count + 1
+				inFolders[i].Size = inFolders[i].Size + s.Size
+			}
+		}
+
+		stats.Largest = append(stats.Largest, statsFile{FullName: s.FullName, Size: s.Size})
+		sort.Slice(stats.Largest, func(i, j int) bool { return stats.Largest[i].Size > stats.Largest[j].Size })
+		if len(stats.Largest) > STATS_LARGEST {
+			stats.Largest = stats.Largest[:STATS_LARGEST]
+		}
+	}
+
+	stats.IndexFolders = inFolders
+	stats.Extensions = topCounts(extensions, STATS_TOP)
+	stats.ContentTypes = topCounts(contentTypes, STATS_TOP)
+	stats.Languages = topCounts(languages, STATS_TOP)
+	return stats, nil
+}
+
+func (b *localBackend) FolderUsage(query string, fn func(path string, files int, size int64)) error {
+	q, err := parseSearchQuery(query, false)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	usage := make(map[string]*statsCount)
+	for n := range b.eval(q) {
+		s := b.data.Docs[n].Source
+		if s.IsFolder || s.Chunk > 0 || isArchived(s) {
+			continue
+		}
+		u, ok := usage[s.Path]
+		if !ok {
+			u = &statsCount{Key: s.Path}
+			usage[s.Path] = u
+		}
+		u.Count = u.Count + 1
+		u.Size = u.Size + s.Size
+	}
+	b.lock.Unlock()
+
+	for _, u := range usage {
+		fn(u.Key, u.Count, u.Size)
+	}
+	return nil
+}
+
+func (b *localBackend) RecordEvents(events []integrityEvent) error {
+	f, err := os.OpenFile(filepath.Join(b.folder, LOCAL_EVENTS_FILE), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range events {
+		err = enc.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (b *localBackend) all() map[int32]float64 {
+	r := make(map[int32]float64, b.live)
+	for _, n := range b.ids {
+		r[n] = 1
+	}
+	return r
+}
+
+func queryFields(field string) []string {
+	if field == "" || field == "*" {
+		return localTextFields
+	}
+	return []string{field}
+}
+
+func (b *localBackend) termDocs(field string, term string, r map[int32]float64) {
+	list := b.data.Postings[field][term]
+	if len(list) == 0 {
+		return
+	}
+	idf := math.Log(1 + float64(b.live)/float64(len(list)))
+	for _, p := range list {
+		if b.data.Docs[p.Doc].Deleted {
+			continue
+		}
+		r[p.Doc] += (1 + math.Log(float64(p.Freq))) * idf
+	}
+}
+
+func intersect(a map[int32]float64, b map[int32]float64) map[int32]float64 {
+	r := make(map[int32]float64)
+	for n, s := range a {
+		if s2, ok := b[n]; ok {
+			r[n] = s + s2
+		}
+	}
+	return r
+}
+
+func containsPhrase(tokens []localToken, phrase []localToken) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		j := 0
+		for j < len(phrase) && tokens[i+j].term == phrase[j].term {
+			j++
+		}
+		if j == len(phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardRegexp translates a Lucene wildcard (* and ?, \ escapes) to a regexp
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Date formats accepted in date ranges, interpreted as UTC as ES does
+var localDateFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, f := range localDateFormats {
+		t, err := time.Parse(f, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func compareBound(v string, bound string, field string) int {
+	if localDateFields[field] {
+		a, okA := parseDate(v)
+		b, okB := parseDate(bound)
+		if okA && okB {
+			switch {
+			case a.Before(b):
+				return -1
+			case a.After(b):
+				return 1
+			}
+			return 0
+		}
+	}
+	if localNumericFields[field] {
+		a, _ := strconv.ParseFloat(v, 64)
+		b, err := strconv.ParseFloat(bound, 64)
+		if err == nil {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(v, bound)
+}
+
+func (b *localBackend) scan(fn func(d *localDoc) bool) map[int32]float64 {
+	r := make(map[int32]float64)
+	for _, n := range b.ids {
+		if fn(&b.data.Docs[n]) {
+			r[n] = 1
+		}
+	}
+	return r
+}
+
+// evalSubField matches the keyword subfields exactly and the tree subfields
+// against the folder and every folder below it
+func (b *localBackend) evalSubField(q *QueryNode, sub string) map[int32]float64 {
+	var re *regexp.Regexp
+	if q.Kind == QUERY_WILDCARD && q.CaseInsensitive {
+		re = wildcardRegexp(strings.ToLower(q.Value))
+	} else if q.Kind == QUERY_WILDCARD {
+		re = wildcardRegexp(q.Value)
+	}
+	folder := strings.TrimSuffix(q.Value, "/") + "/"
+	return b.scan(func(d *localDoc) bool {
+		v, _ := d.field(q.Field)
+		if q.CaseInsensitive {
+			v = strings.ToLower(v)
+		}
+		switch {
+		case re != nil:
+			return re.MatchString(v)
+		case sub == "tree":
+			return v == q.Value || strings.HasPrefix(v, folder)
+		}
+		return v == q.Value
+	})
+}
+
+func (b *localBackend) eval(q *QueryNode) map[int32]float64 {
+	r := make(map[int32]float64)
+
+	if _, sub := subField(q.Field); sub != "" {
+		switch q.Kind {
+		case QUERY_TERM, QUERY_PHRASE, QUERY_WILDCARD:
+			return b.evalSubField(q, sub)
+		}
+	}
+
+	switch q.Kind {
+	case QUERY_ALL:
+		return b.all()
+
+	case QUERY_EXISTS:
+		return b.scan(func(d *localDoc) bool {
+			v, _ := d.field(q.Field)
+			return v != ""
+		})
+
+	case QUERY_TERM:
+		if localNumericFields[q.Field] {
+			return b.scan(func(d *localDoc) bool {
+				v, _ := d.field(q.Field)
+				return v != "" && compareBound(v, q.Value, q.Field) == 0
+			})
+		}
+		for _, field := range queryFields(q.Field) {
+			for _, t := range analyze(q.Value) {
+				b.termDocs(field, t.term, r)
+			}
+		}
+
+	case QUERY_PHRASE:
+		phrase := analyze(q.Value)
+		if len(phrase) == 0 {
+			return r
+		}
+		for _, field := range queryFields(q.Field) {
+			var c map[int32]float64
+			for _, t := range phrase {
+				docs := make(map[int32]float64)
+				b.termDocs(field, t.term, docs)
+				if c == nil {
+					c = docs
+				} else {
+					c = intersect(c, docs)
+				}
+			}
+			for n, s := range c {
+				v, _ := b.data.Docs[n].field(field)
+				if containsPhrase(analyze(v), phrase) {
+					r[n] += s
+				}
+			}
+		}
+
+	case QUERY_WILDCARD:
+		re := wildcardRegexp(strings.ToLower(q.Value))
+		for _, field := range queryFields(q.Field) {
+			for term := range b.data.Postings[field] {
+				if re.MatchString(term) {
+					b.termDocs(field, term, r)
+				}
+			}
+		}
+
+	case QUERY_RANGE:
+		return b.scan(func(d *localDoc) bool {
+			v, ok := d.field(q.Field)
+			if !ok || v == "" {
+				return false
+			}
+			if q.Lower != "" {
+				c := compareBound(v, q.Lower, q.Field)
+				if c < 0 || (c == 0 && !q.IncludeLower) {
+					return false
+				}
+			}
+			if q.Upper != "" {
+				c := compareBound(v, q.Upper, q.Field)
+				if c > 0 || (c == 0 && !q.IncludeUpper) {
+					return false
+				}
+			}
+			return true
+		})
+
+	case QUERY_BOOL:
+		if len(q.Must) > 0 {
+			r = nil
+			for _, c := range q.Must {
+				if r == nil {
+					r = b.eval(c)
+				} else {
+					r = intersect(r, b.eval(c))
+				}
+			}
+			for _, c := range q.Should {
+				for n, s := range b.eval(c) {
+					if _, ok := r[n]; ok {
+						r[n] += s
+					}
+				}
+			}
+		} else if len(q.Should) > 0 {
+			for _, c := range q.Should {
+				for n, s := range b.eval(c) {
+					r[n] += s
+				}
+			}
+		} else {
+			r = b.all()
+		}
+		for _, c := range q.MustNot {
+			for n := range b.eval(c) {
+				delete(r, n)
+			}
+		}
+	}
+	return r
+}
+
+// highlightMatcher returns a function telling whether a content token is
+// matched by the positive clauses of q
+func highlightMatcher(q *QueryNode) func(term string) bool {
+	terms := make(map[string]bool)
+	var patterns []*regexp.Regexp
+
+	var walk func(n *QueryNode)
+	walk = func(n *QueryNode) {
+		if n.Field != "" && n.Field != "*" && n.Field != "attachment.content" {
+			return
+		}
+		switch n.Kind {
+		case QUERY_TERM, QUERY_PHRASE:
+			for _, t := range analyze(n.Value) {
+				terms[t.term] = true
+			}
+		case QUERY_WILDCARD:
+			patterns = append(patterns, wildcardRegexp(strings.ToLower(n.Value)))
+		case QUERY_BOOL:
+			for _, c := range n.Must {
+				walk(c)
+			}
+			for _, c := range n.Should {
+				walk(c)
+			}
+		}
+	}
+	walk(q)
+
+	return func(term string) bool {
+		if terms[term] {
+			return true
+		}
+		for _, re := range patterns {
+			if re.MatchString(term) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// fragments returns snippets of content around the matching terms, with the
+// terms surrounded by <em></em> as Elasticsearch does
+func fragments(content string, match func(term string) bool) []string {
+	var frags []string
+	tokens := analyze(content)
+	end := -1
+	for i := 0; i < len(tokens) && len(frags) < LOCAL_FRAGMENTS; i++ {
+		if tokens[i].start < end || !match(tokens[i].term) {
+			continue
+		}
+		start := tokens[i].start - LOCAL_FRAGMENT_SIZE/3
+		if start < 0 {
+			start = 0
+		}
+		for start > 0 && !utf8.RuneStart(content[start]) {
+			start--
+		}
+		end = start + LOCAL_FRAGMENT_SIZE
+		if end > len(content) {
+			end = len(content)
+		}
+		for end < len(content) && !utf8.RuneStart(content[end]) {
+			end++
+		}
+
+		var b strings.Builder
+		last := start
+		for j := i; j < len(tokens) && tokens[j].start < end; j++ {
+			if tokens[j].start < start || !match(tokens[j].term) {
+				continue
+			}
+			if tokens[j].end > end {
+				end = tokens[j].end
+			}
+			b.WriteString(content[last:tokens[j].start])
+			b.WriteString("<em>" + content[tokens[j].start:tokens[j].end] + "</em>")
+			last = tokens[j].end
+		}
+		b.WriteString(content[last:end])
+		frags = append(frags, strings.TrimSpace(b.String()))
+	}
+	return frags
+}
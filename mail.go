@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Mail. When mail is set, each message of mbox files, and each .eml file or
+// Maildir message, is indexed with its headers in the mail fields and its
+// decoded text as content. The messages of an mbox file are members of it,
+// as those of an archive, with fullpath the mbox file, ARCHIVE_SEPARATOR and
+// the number of the message, as in /mail/inbox.mbox!/12.eml. Attachments
+// are members of their message, as in /mail/inbox.mbox!/12.eml!/invoice.pdf,
+// and their content is extracted as for any other file.
+
+// Messages are read in memory, up to this size
+const MAIL_MAX_SIZE = 64 * 1024 * 1024
+
+// Formats of the mail files
+const MAIL_MBOX = "mbox"
+const MAIL_MESSAGE = "message"
+
+// Mail holds the headers of a message
+type Mail struct {
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Cc        string `json:"cc,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Date      string `json:"date,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// mailMessage is a parsed message
+type mailMessage struct {
+	mail        Mail
+	text        string
+	attachments []mailAttachment
+}
+
+type mailAttachment struct {
+	name string
+	data []byte
+}
+
+// mailFormat tells whether p is a mail file, returning its format: mbox for
+// .mbox and .mbx files and files without extension starting as mbox files
+// do, message for .eml files and the messages of Maildir folders
+func (gotrovi *Gotrovi) mailFormat(p string) string {
+	if !gotrovi.conf.Mail {
+		return ""
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".mbox", ".mbx":
+		return MAIL_MBOX
+	case ".eml":
+		return MAIL_MESSAGE
+	}
+	if gotrovi.isMaildirMessage(p) {
+		return MAIL_MESSAGE
+	}
+	if filepath.Ext(p) == "" {
+		f, err := os.Open(p)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(f, head); err == nil && string(head) == "From " {
+			return MAIL_MBOX
+		}
+	}
+	return ""
+}
+
+// maildirCache keeps whether each cur and new folder found is in a
+// Maildir, so that it is checked once for all the messages in it
+type maildirCache struct {
+	lock sync.Mutex
+	dirs map[string]bool
+}
+
+// isMaildirMessage tells whether p is in the cur or new folder of a Maildir
+func (gotrovi *Gotrovi) isMaildirMessage(p string) bool {
+	dir := filepath.Dir(p)
+	name := filepath.Base(dir)
+	if name != "cur" && name != "new" {
+		return false
+	}
+	c := &gotrovi.maildirs
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if maildir, ok := c.dirs[dir]; ok {
+		return maildir
+	}
+	if c.dirs == nil {
+		c.dirs = make(map[string]bool)
+	}
+	c.dirs[dir] = isMaildir(filepath.Dir(dir))
+	return c.dirs[dir]
+}
+
+// isMaildir tells whether dir has the cur, new and tmp folders of a Maildir
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// readMbox calls fn with each message of the mbox r, numbered from 1,
+// without its From_ line and with the >From quoting removed
+func readMbox(r io.Reader, fn func(n int, msg []byte)) error {
+	br := bufio.NewReader(r)
+	var msg bytes.Buffer
+	n := 0
+	blank := true
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case blank && bytes.HasPrefix(line, []byte("From ")):
+				if n > 0 {
+					fn(n, msg.Bytes())
+					msg.Reset()
+				}
+				n = n + 1
+			case n > 0:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				if msg.Len()+len(line) <= MAIL_MAX_SIZE {
+					msg.Write(line)
+				}
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			if n > 0 {
+				fn(n, msg.Bytes())
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Single byte charsets decoded, by name
+var mailCharsets = map[string]*charmap.Charmap{
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-2":   charmap.ISO8859_2,
+	"latin2":       charmap.ISO8859_2,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"latin9":       charmap.ISO8859_15,
+	"windows-1250": charmap.Windows1250,
+	"cp1250":       charmap.Windows1250,
+	"windows-1251": charmap.Windows1251,
+	"cp1251":       charmap.Windows1251,
+	"windows-1252": charmap.Windows1252,
+	"cp1252":       charmap.Windows1252,
+	"koi8-r":       charmap.KOI8R,
+}
+
+// decodeCharset converts text in charset to UTF-8. UTF-8, ASCII and the
+// charsets of mailCharsets are converted, other charsets keep their valid
+// UTF-8.
+func decodeCharset(data []byte, charset string) string {
+	if c, ok := mailCharsets[strings.ToLower(charset)]; ok {
+		text, err := c.NewDecoder().Bytes(data)
+		if err == nil {
+			return string(text)
+		}
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(decodeCharset(data, charset)), nil
+	},
+}
+
+// decodeHeader decodes the encoded words of a header, as =?utf-8?q?...?=
+func decodeHeader(v string) string {
+	d, err := headerDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return d
+}
+
+// parseMail parses the message data
+func parseMail(data []byte) (*mailMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	msg := &mailMessage{
+		mail: Mail{
+			From:      decodeHeader(m.Header.Get("From")),
+			To:        decodeHeader(m.Header.Get("To")),
+			Cc:        decodeHeader(m.Header.Get("Cc")),
+			Subject:   decodeHeader(m.Header.Get("Subject")),
+			MessageID: strings.Trim(m.Header.Get("Message-Id"), "<> "),
+		},
+	}
+	if t, err := m.Header.Date(); err == nil {
+		msg.mail.Date = fileDate(t)
+	}
+
+	var html []string
+	var text []string
+	err = walkMailPart(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Header.Get("Content-Disposition"), m.Body, msg, &text, &html)
+	if len(text) == 0 {
+		for _, h := range html {
+			t, herr := extractHTML([]byte(h))
+			if herr == nil {
+				text = append(text, t)
+			}
+		}
+	}
+	msg.text = strings.TrimSpace(strings.Join(text, "\n\n"))
+	return msg, err
+}
+
+// walkMailPart reads a part of a message, looking into multipart parts,
+// adding its text to text or html or to the attachments of msg
+func walkMailPart(contentType string, encoding string, disposition string, body io.Reader, msg *mailMessage, text *[]string, html *[]string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// NextPart already decodes quoted-printable
+			err = walkMailPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part, msg, text, html)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disp, dparams, _ := mime.ParseMediaType(disposition)
+	name := decodeHeader(dparams["filename"])
+	if name == "" {
+		name = decodeHeader(params["name"])
+	}
+	if disp == "attachment" || name != "" || !strings.HasPrefix(mediaType, "text/") {
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", len(msg.attachments)+1)
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				name = name + exts[0]
+			}
+		}
+		msg.attachments = append(msg.attachments, mailAttachment{name: path.Base(name), data: data})
+		return nil
+	}
+	if mediaType == "text/html" {
+		*html = append(*html, decodeCharset(data, params["charset"]))
+	} else {
+		*text = append(*text, decodeCharset(data, params["charset"]))
+	}
+	return nil
+}
+
+// base64Cleaner drops the line breaks base64.NewDecoder would otherwise
+// choke on when they are not at the end of a 4 byte group
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	kept := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			p[kept] = b
+			kept = kept + 1
+		}
+	}
+	return kept, err
+}
+
+// mailReader builds the documents of messages and their attachments
+type mailReader struct {
+	h       hash.Hash
+	extract bool
+	// attachments bigger than this are indexed without content
+	maxSize int64
+	fn      func(doc *FileDescriptionDoc)
+}
+
+// attachments sends the documents of the attachments of msg, stored in p
+func (m *mailReader) attachments(p string, msg *mailMessage) {
+	seen := make(map[string]bool)
+	for i, a := range msg.attachments {
+		name := a.name
+		if seen[name] {
+			name = strconv.Itoa(i+1) + "-" + name
+		}
+		seen[name] = true
+
+		m.h.Reset()
+		m.h.Write(a.data)
+		doc := &FileDescriptionDoc{
+			FileName:  name,
+			FullName:  p + ARCHIVE_SEPARATOR + name,
+			Path:      p,
+			Size:      int64(len(a.data)),
+			Extension: path.Ext(name),
+			Hash:      fmt.Sprintf("%x", m.h.Sum(nil)),
+			Date:      msg.mail.Date,
+			Archive:   p,
+		}
+		m.h.Reset()
+		if doc.Size <= m.maxSize || metadataOnly(name) {
+			setContent(doc, name, a.data, m.extract)
+		}
+		m.fn(doc)
+	}
+}
+
+// message fills doc with the message data and sends the documents of its
+// attachments
+func (m *mailReader) message(doc *FileDescriptionDoc, data []byte) {
+	msg, err := parseMail(data)
+	if msg == nil {
+		Warning.Println("Unable to read the message", doc.FullName, ":", err)
+		doc.Attachment = &Attachment{Error: err.Error()}
+		return
+	}
+	if err != nil {
+		Warning.Println("Unable to read all of the message", doc.FullName, ":", err)
+	}
+	text := msg.text
+	if utf8.RuneCountInString(text) > INDEXED_CHARS {
+		text = string([]rune(text)[:INDEXED_CHARS])
+	}
+	doc.Mail = &msg.mail
+	doc.Attachment = &Attachment{Content: text, ContentType: "message/rfc822", Language: detectLanguage(text)}
+	doc.Members = len(msg.attachments)
+	m.attachments(doc.FullName, msg)
+}
+
+// encodeMail builds the documents of the mail file p, calling fn for each:
+// the attachments and messages first, the file last
+func (gotrovi *Gotrovi) encodeMail(h hash.Hash, info os.FileInfo, p string, format string, extract bool, fn func(doc *FileDescriptionDoc)) error {
+	sum, err := hashFile(h, p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file := &FileDescriptionDoc{
+		FileName:  info.Name(),
+		FullName:  p,
+		Path:      filepath.Dir(p),
+		Size:      info.Size(),
+		Extension: filepath.Ext(info.Name()),
+		Hash:      sum,
+		Date:      fileDate(info.ModTime()),
+		Mode:      info.Mode().String(),
+	}
+	m := &mailReader{h: h, extract: extract, maxSize: gotrovi.conf.Exclude.Size, fn: fn}
+
+	if format == MAIL_MESSAGE {
+		data, err := ioutil.ReadAll(io.LimitReader(f, MAIL_MAX_SIZE))
+		if err != nil {
+			return err
+		}
+		m.message(file, data)
+		fn(file)
+		return nil
+	}
+
+	err = readMbox(f, func(n int, data []byte) {
+		name := strconv.Itoa(n) + ".eml"
+		h.Reset()
+		h.Write(data)
+		doc := &FileDescriptionDoc{
+			FileName:  name,
+			FullName:  p + ARCHIVE_SEPARATOR + name,
+			Path:      p,
+			Size:      int64(len(data)),
+			Extension: ".eml",
+			Hash:      fmt.Sprintf("%x", h.Sum(nil)),
+			Date:      file.Date,
+			Archive:   p,
+		}
+		h.Reset()
+		m.message(doc, data)
+		if doc.Mail != nil && doc.Mail.Date != "" {
+			doc.Date = doc.Mail.Date
+		}
+		fn(doc)
+		file.Members = n
+	})
+	if err != nil {
+		Warning.Println("Unable to read the mbox", p, ":", err)
+		file.Attachment = &Attachment{Error: err.Error()}
+	}
+	fn(file)
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadMbox(t *testing.T) {
+	mbox := "From alice@example.com Mon Jan  1 10:00:00 2024\n" +
+		"Subject: one\n\n" +
+		"first body\n" +
+		">From the start\n" +
+		">>From quoted twice\n" +
+		"From inside a paragraph is kept\n" +
+		"\n" +
+		"From bob@example.com Tue Jan  2 10:00:00 2024\n" +
+		"Subject: two\n\n" +
+		"second body\n" +
+		"\n" +
+		"From carol@example.com Wed Jan  3 10:00:00 2024\n" +
+		"Subject: three\n\n" +
+		"last body without newline"
+	var got []string
+	err := readMbox(strings.NewReader(mbox), func(n int, msg []byte) {
+		if n != len(got)+1 {
+			t.Errorf("message %d numbered %d", len(got)+1, n)
+		}
+		got = append(got, string(msg))
+	})
+	want := []string{
+		"Subject: one\n\nfirst body\nFrom the start\n>From quoted twice\nFrom inside a paragraph is kept\n\n",
+		"Subject: two\n\nsecond body\n\n",
+		"Subject: three\n\nlast body without newline",
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("%v\n%q\nwant\n%q", err, got, want)
+	}
+
+	got = nil
+	readMbox(strings.NewReader("no From_ line\n\nFrom x\n"), func(n int, msg []byte) {
+		got = append(got, string(msg))
+	})
+	if len(got) != 1 || got[0] != "" {
+		t.Errorf("text before the first From_ line: %q", got)
+	}
+}
+
+func TestMailFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testIgnoreTree(t, dir, map[string]string{
+		"Mail/INBOX/cur/1700000000.M1.host:2,S": "Subject: read\n\nbody",
+		"Mail/INBOX/new/1700000001.M2.host":     "Subject: new\n\nbody",
+		"Mail/INBOX/tmp/1700000002.M3.host":     "Subject: tmp\n\nbody",
+		"project/cur/notes":                     "not a Maildir",
+		"archive/inbox":                         "From alice@example.com Mon Jan  1 10:00:00 2024\n",
+		"archive/readme":                        "plain text",
+		"archive/old.mbx":                       "",
+		"archive/saved.EML":                     "",
+	})
+	tests := map[string]string{
+		"Mail/INBOX/cur/1700000000.M1.host:2,S": MAIL_MESSAGE,
+		"Mail/INBOX/new/1700000001.M2.host":     MAIL_MESSAGE,
+		"Mail/INBOX/tmp/1700000002.M3.host":     "",
+		"project/cur/notes":                     "",
+		"archive/inbox":                         MAIL_MBOX,
+		"archive/readme":                        "",
+		"archive/old.mbx":                       MAIL_MBOX,
+		"archive/saved.EML":                     MAIL_MESSAGE,
+	}
+
+	var g Gotrovi
+	for name := range tests {
+		if format := g.mailFormat(filepath.Join(dir, name)); format != "" {
+			t.Errorf("%s: %s with mail off", name, format)
+		}
+	}
+	g.conf.Mail = true
+	for name, want := range tests {
+		if format := g.mailFormat(filepath.Join(dir, name)); format != want {
+			t.Errorf("%s: %q, want %q", name, format, want)
+		}
+	}
+
+	// the Maildir check is cached per folder
+	os.RemoveAll(filepath.Join(dir, "Mail/INBOX/tmp"))
+	if !g.isMaildirMessage(filepath.Join(dir, "Mail/INBOX/cur/other")) {
+		t.Error("Maildir folder checked again")
+	}
+	if len(g.maildirs.dirs) != 3 {
+		t.Errorf("cached folders: %v", g.maildirs.dirs)
+	}
+}
+
+func TestParseMail(t *testing.T) {
+	message := "From: =?utf-8?q?Jos=C3=A9?= <jose@example.com>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: =?iso-8859-1?q?Factura_de_mayo?=\r\n" +
+		"Date: Mon, 20 May 2024 12:00:00 +0000\r\n" +
+		"Message-ID: <1234@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=windows-1252\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Adjunto la =93factura=94 de 120 =80.\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>Adjunto la factura</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf; name=\"factura.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"../factura.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0x\r\nLjQK\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw==\r\n" +
+		"--outer--\r\n"
+	msg, err := parseMail([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Mail{
+		From:      "José <jose@example.com>",
+		To:        "alice@example.com",
+		Subject:   "Factura de mayo",
+		Date:      "2024-05-20T12:00:00Z",
+		MessageID: "1234@example.com",
+	}
+	if msg.mail != want {
+		t.Errorf("headers %+v, want %+v", msg.mail, want)
+	}
+	if msg.text != "Adjunto la “factura” de 120 €." {
+		t.Errorf("text %q", msg.text)
+	}
+	if len(msg.attachments) != 2 {
+		t.Fatalf("attachments %+v", msg.attachments)
+	}
+	if a := msg.attachments[0]; a.name != "factura.pdf" || string(a.data) != "%PDF-1.4\n" {
+		t.Errorf("first attachment %s %q", a.name, a.data)
+	}
+	if a := msg.attachments[1]; a.name != "attachment-2.png" || string(a.data) != "\x89PNG" {
+		t.Errorf("second attachment %s %q", a.name, a.data)
+	}
+
+	// the html part is the text when there is no plain part
+	msg, err = parseMail([]byte("Content-Type: text/html\r\n\r\n<html><body><p>Solo <b>html</b></p></body></html>"))
+	if err != nil || !strings.Contains(msg.text, "Solo") || strings.Contains(msg.text, "<b>") {
+		t.Errorf("html only: %q %v", msg.text, err)
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		data    string
+		charset string
+		want    string
+	}{
+		{"\x93caf\xe9\x94 \x80", "windows-1252", "“café” €"},
+		{"caf\xe9 \xa4", "ISO-8859-15", "café €"},
+		{"caf\xe9 \xa4", "latin1", "café ¤"},
+		{"\xd0\xd2\xc9\xd7\xc5\xd4", "koi8-r", "привет"},
+		{"café", "utf-8", "café"},
+		{"café", "", "café"},
+		{"caf\xe9", "unknown", "caf"},
+	}
+	for _, test := range tests {
+		if got := decodeCharset([]byte(test.data), test.charset); got != test.want {
+			t.Errorf("%q in %s: %q, want %q", test.data, test.charset, got, test.want)
+		}
+	}
+}
@@ -14,12 +14,10 @@ import (
 	"os"
 	"os/user"
 	"reflect"
-	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/apoorvam/goterminal"
-	"github.com/elastic/go-elasticsearch"
 	"github.com/pborman/getopt"
 )
 
@@ -34,7 +32,19 @@ type GotroviConf struct {
 	Index         []Index  `json:"index"`
 	Exclude       Exclude  `json:"exclude"`
 	Hash          string   `json:"hash"`
+	Backend       string   `json:"backend"`
+	Extractor     string   `json:"extractor"`
 	ElasticSearch ESConfig `json:"elasticsearch"`
+	// text files bigger than Exclude.Size are indexed in chunks of this
+	// size instead of being skipped, 0 to skip them
+	ChunkSize int64 `json:"chunk_size"`
+	// levels of archives whose members are indexed, 0 to index archives
+	// as plain files
+	ArchiveDepth int `json:"archive_depth"`
+	// bytes read from compressed files, DECOMPRESS_MAX_SIZE if 0
+	DecompressSize int64 `json:"decompress_size"`
+	// index the messages of mbox, Maildir and .eml files
+	Mail bool `json:"mail"`
 }
 type Index struct {
 	Folder  string   `json:"folder"`
@@ -44,38 +54,93 @@ type Exclude struct {
 	Extension []string `json:"extension"`
 	Folder    []string `json:"folder"`
 	Size      int64    `json:"size"`
+	// gitignore patterns for every indexed folder, see ignore.go
+	Patterns []string `json:"patterns"`
+	// also read the .gitignore files in the indexed folders
+	GitIgnore bool `json:"gitignore"`
 }
 type ESConfig struct {
 	Host string `json:"host"`
 	Port int    `json:"port"`
+	// nodes of the cluster, as http(s)://host:port, instead of host and port
+	URLs     []string `json:"urls"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	// API key, base64 encoded or as id:key
+	APIKey string `json:"api_key"`
+	// PEM files of the CA to trust and of the client certificate and key
+	CACert             string `json:"ca_cert"`
+	ClientCert         string `json:"client_cert"`
+	ClientKey          string `json:"client_key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
 type FileDescriptionDoc struct {
-	FileName  string `json:"filename"`
-	FullName  string `json:"fullpath"`
-	Path      string `json:"path"`
-	Size      int64  `json:"size"`
-	Extension string `json:"extension"`
-	Hash      string `json:"hash"`
-	Data      string `json:"data"`
-	IsFolder  bool   `json:"isfolder"`
-	Date      string `json:"date"`
-	Mode      string `json:"mode"`
+	FileName   string      `json:"filename"`
+	FullName   string      `json:"fullpath"`
+	Path       string      `json:"path"`
+	Size       int64       `json:"size"`
+	Extension  string      `json:"extension"`
+	Hash       string      `json:"hash"`
+	Data       string      `json:"data"`
+	IsFolder   bool        `json:"isfolder"`
+	Date       string      `json:"date"`
+	Mode       string      `json:"mode"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// chunked files, see chunk.go
+	Chunk  int   `json:"chunk,omitempty"`
+	Chunks int   `json:"chunks,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+	// archives and their members, see archive.go
+	Archive string `json:"archive,omitempty"`
+	Members int    `json:"members,omitempty"`
+	// compressed files, see compress.go
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	// mail messages, see mail.go
+	Mail *Mail `json:"mail,omitempty"`
+	// photos, music and documents, see metadata.go
+	Meta *Metadata `json:"meta,omitempty"`
+}
+
+// fileDate formats the modification time stored in the date field
+func fileDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
 }
 
 type Gotrovi struct {
-	conf   GotroviConf
-	count  int
-	total  int
-	added  int
-	hash   hash.Hash
-	es     *elasticsearch.Client
-	writer *goterminal.Writer
+	conf    GotroviConf
+	count   int
+	total   int
+	hash    hash.Hash
+	backend Backend
+	state   *syncState
+	writer  *goterminal.Writer
 	//	stdscr *gc.Window
 
-	wg   sync.WaitGroup
-	wait int
-	jobs int
+	indexer *indexer
+	jobs    int
+
+	// sync progress, see checkpoint.go
+	cp          *checkpoint
+	interrupted int32
+
+	// in watch mode the index is refreshed and the sync state saved at most
+	// once every saveEvery, see stopIndexer
+	saveEvery   time.Duration
+	saved       time.Time
+	unsaved     bool
+	unrefreshed bool
+
+	// update state, see SyncUpdate
+	created  []fileJob
+	vanished map[int64][]vanishedFile
+	summary  syncSummary
+
+	// exclusion rules, see ignore.go
+	ignores ignoreCache
+
+	// Maildir folders, see mail.go
+	maildirs maildirCache
 }
 
 var (
@@ -85,19 +150,40 @@ var (
 	Error   *log.Logger
 )
 
+// command runs a subcommand, args[0] being its name
+type command func(gotrovi *Gotrovi, args []string)
+
+var commands = map[string]command{
+	"dupes":  (*Gotrovi).Dupes,
+	"verify": (*Gotrovi).Verify,
+	"serve":  (*Gotrovi).Serve,
+	"stats":  (*Gotrovi).Stats,
+}
+
+// configCommands only need the config, they run without opening the index
+var configCommands = map[string]command{
+	"check-ignore": (*Gotrovi).CheckIgnore,
+}
+
 func usage() {
 	w := os.Stdout
 
 	getopt.PrintUsage(w)
+	fmt.Printf("\nCommands, see gotrovi <command> -h:\n\tdupes [options] [paths ...]\tList groups of identical files\n\tverify [options] [paths ...]\tDetect corrupt files by hashing them again\n\tserve [options]\t\t\tServe searches over HTTP\n\tstats [options] [paths ...]\tSummarize the index, or show folder sizes with --du\n\tcheck-ignore [options] paths ...\tTell which rule excludes the paths from the index\n")
 	fmt.Printf("\n[parameters ...] may contain paths to restrict the search to. You may also use lucene queries to do the same, but this is more convenient.\n")
 	fmt.Printf("You may search for the following fields: \n\t")
 
 	var b FileDescriptionDoc
 	val := reflect.ValueOf(b)
 	for i := 0; i < val.Type().NumField(); i++ {
-		fmt.Printf("%s, ", val.Type().Field(i).Tag.Get("json"))
+		name := strings.Split(val.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "attachment" && name != "mail" && name != "meta" {
+			fmt.Printf("%s, ", name)
+		}
 	}
-	fmt.Println("attachment.content, attachment.content_type, attachment.language")
+	fmt.Println("attachment.content, attachment.content_type, attachment.language, attachment.error, mail.from, mail.to, mail.cc, mail.subject, mail.date, mail.message_id,")
+	fmt.Println("\tmeta.title, meta.author, meta.subject, meta.keywords, meta.pages, meta.created, meta.camera, meta.taken, meta.gps, meta.width, meta.height, meta.artist, meta.album, meta.genre, meta.year, meta.track")
+	fmt.Printf("and the shorthands name, ext, size (with K, M, G, T), modified (date or age in h, d, w, mo, y), type (dir or file), in (folder), lang, content, from, to, cc, subject, sent (as modified), camera, taken (as modified), artist, album, genre, author and title. Bare words are looked for in the content, --raw passes Lucene queries as is.\n")
 
 	fmt.Printf("\nExamples:\n")
 
@@ -107,6 +193,8 @@ func usage() {
 	fmt.Printf("\t\tgotrovi -f \"filename:test AND isfolder:true\"\n\n")
 	fmt.Printf("\tFind files containing test\n")
 	fmt.Printf("\t\tgotrovi -f \"attachment.content:test\"\n\n")
+	fmt.Printf("\tFind Go files bigger than 10 KiB modified in the last week containing test\n")
+	fmt.Printf("\t\tgotrovi -f \"name:*.go size:>10K modified:<7d test\"\n\n")
 	fmt.Println("More info on the syntax used to find files in the Lucene query documentation: https://lucene.apache.org/core/2_9_4/queryparsersyntax.html")
 }
 
@@ -133,32 +221,22 @@ func InitLogs(
 		log.Ldate|log.Ltime|log.Lshortfile)
 }
 
-func (gotrovi *Gotrovi) ConnectElasticSearch() (err error) {
-
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://" + gotrovi.conf.ElasticSearch.Host + ":" + strconv.Itoa(gotrovi.conf.ElasticSearch.Port),
-		},
-	}
-
-	gotrovi.es, err = elasticsearch.NewClient(cfg)
-
-	if err != nil {
-		Error.Println("Error connecting to ElasticSearch " + cfg.Addresses[0])
-		Error.Println(err)
-		return err
-	}
-	res, err := gotrovi.es.Info()
+func (gotrovi *Gotrovi) newHash() hash.Hash {
+	switch gotrovi.conf.Hash {
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	default:
+		return md5.New()
 
-	Trace.Println(res)
-
-	if err != nil {
-		Trace.Println("Error connecting to ElasticSearch " + cfg.Addresses[0])
-		Trace.Println(err)
-		return err
 	}
+}
 
-	return nil
+func (gotrovi *Gotrovi) InitHash() {
+	gotrovi.hash = gotrovi.newHash()
 }
 
 func (gotrovi *Gotrovi) ParseConfig() (err error) {
@@ -245,14 +323,27 @@ func main() {
 	//    optName := getopt.StringLong("name", 'n', "Torpedo", "Your name")
 	optHelp := getopt.BoolLong("help", 'h', "Show this message")
 	optVerbose := getopt.IntLong("verbose", 'v', 0, "Set verbosity: 0 to 3")
-	optSync := getopt.StringLong("sync", 's', "", "Perform Sync. Options:\n\"forced\" this is the brute force sync type in which the ES index is deleted and the whole FS is processed\n\"update\" update existing documents in Elasticsearch\n\"updateFast\" same as update, only slightly faster")
+	optSync := getopt.StringLong("sync", 's', "", "Perform Sync. Options:\n\"forced\" this is the brute force sync type in which the whole FS is processed into a new index, replacing the current one when done\n\"update\" update existing documents in Elasticsearch\n\"updateFast\" same as update, only slightly faster")
 	optFind := getopt.StringLong("find", 'f', "", "Find file by name")
+	optRaw := getopt.BoolLong("raw", 0, "Pass the query in Lucene syntax as is, instead of the gotrovi query language")
+	optInteractive := getopt.BoolLong("interactive", 'I', "Interactive search, the query given with -f is optional. Ctrl-O prints the folder of the selected file on exit, for cd \"$(gotrovi -I)\"")
 	optScore := getopt.BoolLong("score", 'c', "Display elasticsearch score in searches")
 	optDelete := getopt.BoolLong("delete", 'd', "Delete elasticsearch index")
-	optHighlightString := getopt.StringLong("grep", 'g', "", "Grep style output showing the match in the content. Give the text to grep for in the highlights as parameter")
-	optHighlightBool := getopt.BoolLong("Grep", 'G', "Grep style output showing the match in the content")
+	optHighlightString := getopt.StringLong("grep", 'g', "", "Grep mode: print the lines containing the text given, with their line and column, in the files found. Without -f the files containing the text are searched")
+	optHighlightBool := getopt.BoolLong("Grep", 'G', "Grep mode: print the lines containing the terms matched by the -f query, with their line and column")
+	optAfter := getopt.IntLong("after-context", 'A', 0, "Grep mode: print this many lines after each match")
+	optBefore := getopt.IntLong("before-context", 'B', 0, "Grep mode: print this many lines before each match")
+	optContext := getopt.IntLong("context", 'C', 0, "Grep mode: print this many lines before and after each match")
+	optMaxCount := getopt.IntLong("max-count", 'm', 0, "Grep mode: stop after this many matching lines in each file")
+	optLimit := getopt.IntLong("limit", 0, 0, "Show at most this many search results. Default is all")
+	optOffset := getopt.IntLong("offset", 0, 0, "Skip this many search results")
+	optSort := getopt.ListLong("sort", 0, "Sort the search results by field[:asc|desc], may be repeated or comma separated. Fields: "+strings.Join(sortFields, ", ")+". Default is by score")
+	optOutput := getopt.StringLong("output", 'o', OUTPUT_TEXT, "Search output format: \"text\" (default), \"json\", \"ndjson\", \"csv\", \"tsv\" or \"null\" for NUL separated paths as used by xargs -0. Only text is shown in the pager")
 	optInstall := getopt.BoolLong("install", 'i', "Install the necessary config files in "+GOTROVI_SETTINGS_FOLDER+" and run the Elasticsearch container")
-	optJobs := getopt.IntLong("jobs", 'j', 32, "Set amount of sync jobs. Default is 32")
+	optJobs := getopt.IntLong("jobs", 'j', 32, "Set amount of sync workers hashing and encoding files. Default is 32")
+	optKeepPrevious := getopt.IntLong("keep-previous", 0, 0, "Amount of previous indexes kept by a forced sync, to roll back to. Default is 0")
+	optResume := getopt.BoolLong("resume", 0, "Continue an interrupted sync from its last checkpoint")
+	optWatch := getopt.BoolLong("watch", 'w', "Watch the indexed folders and keep the index updated until SIGTERM is received")
 	var searchPath []string
 
 	getopt.Parse()
@@ -266,19 +357,31 @@ func main() {
 		os.Exit(0)
 	}
 
+	if !validOutput(*optOutput) {
+		fmt.Fprintln(os.Stderr, "Unknown output format \""+*optOutput+"\", use one of:", strings.Join(outputFormats, ", "))
+		os.Exit(1)
+	}
+
+	// keep stdout clean for the structured output formats and the folder
+	// printed by the interactive search
+	var logOut io.Writer = os.Stdout
+	if *optOutput != OUTPUT_TEXT || *optInteractive {
+		logOut = os.Stderr
+	}
+
 	vw := ioutil.Discard
 	if *optVerbose > 0 {
-		vw = os.Stdout
+		vw = logOut
 	}
 
 	vi := ioutil.Discard
 	if *optVerbose > 1 {
-		vi = os.Stdout
+		vi = logOut
 	}
 
 	vt := ioutil.Discard
 	if *optVerbose > 2 {
-		vt = os.Stdout
+		vt = logOut
 	}
 
 	var gotrovi Gotrovi
@@ -298,12 +401,28 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = gotrovi.ConnectElasticSearch()
+	if *optFind == "" && !*optInteractive && len(searchPath) != 0 {
+		if cmd, ok := configCommands[searchPath[0]]; ok {
+			cmd(&gotrovi, searchPath)
+			return
+		}
+	}
+
+	err = gotrovi.OpenBackend()
 	if err != nil {
-		Error.Println("Unable to connect with Elasticsearch. Error: ")
+		Error.Println("Unable to open the index backend. Error: ")
 		Error.Println(err)
 		os.Exit(1)
 	}
+	defer gotrovi.backend.Close()
+	gotrovi.OpenState()
+
+	if *optFind == "" && !*optInteractive && len(searchPath) != 0 {
+		if cmd, ok := commands[searchPath[0]]; ok {
+			cmd(&gotrovi, searchPath)
+			return
+		}
+	}
 
 	if *optDelete {
 		for {
@@ -323,6 +442,21 @@ func main() {
 
 	gotrovi.writer = goterminal.New(os.Stdout)
 
+	if *optResume {
+		gotrovi.cp, err = loadCheckpoint(gotrovi.conf)
+		if err != nil {
+			Error.Println("Unable to resume the sync:", err)
+			os.Exit(1)
+		}
+		if *optSync == "" {
+			*optSync = gotrovi.cp.Mode
+		} else if *optSync != gotrovi.cp.Mode {
+			Error.Println("The interrupted sync was \"" + gotrovi.cp.Mode + "\", not \"" + *optSync + "\"")
+			os.Exit(1)
+		}
+		Info.Println("Resuming sync after", gotrovi.cp.Count, "files")
+	}
+
 	if *optSync != "" {
 		Info.Println("Using", gotrovi.jobs, "jobs")
 		for {
@@ -332,28 +466,34 @@ func main() {
 			text = strings.Replace(strings.ToLower(text), "\n", "", -1)
 			if text == "yes" || text == "y" {
 
-				switch gotrovi.conf.Hash {
-				case "md5":
-					gotrovi.hash = md5.New()
-				case "sha256":
-					gotrovi.hash = sha256.New()
-				case "sha512":
-					gotrovi.hash = sha512.New()
-				default:
-					gotrovi.hash = md5.New()
-
+				gotrovi.InitHash()
+				if gotrovi.cp == nil {
+					gotrovi.cp = newCheckpoint(*optSync)
 				}
+				gotrovi.catchInterrupt()
 
+				var err error
 				if *optSync == "forced" {
-					gotrovi.SyncForced()
+					err = gotrovi.SyncForced(*optKeepPrevious)
+				}
+				if *optSync == "update" || *optSync == "updateFast" {
+					gotrovi.startIndexer()
+					err = gotrovi.SyncUpdate(*optSync == "update")
+					if ierr := gotrovi.stopIndexer(); err == nil {
+						err = ierr
+					}
 				}
-				if *optSync == "update" {
-					gotrovi.SyncUpdate(true)
-					gotrovi.SyncAddMissing()
+				if err == errInterrupted {
+					gotrovi.exitInterrupted()
 				}
-				if *optSync == "updateFast" {
-					gotrovi.SyncUpdate(false)
-					gotrovi.SyncAddMissing()
+				removeCheckpoint()
+				gotrovi.cp = nil
+				if err != nil {
+					Error.Println("Sync failed:", err)
+					os.Exit(1)
+				}
+				if *optSync != "forced" {
+					fmt.Println("Update done:", gotrovi.summary)
 				}
 				break
 			} else if text == "no" || text == "n" {
@@ -362,7 +502,35 @@ func main() {
 		}
 	}
 
-	if *optFind != "" {
-		gotrovi.Find(*optFind, searchPath, *optScore, *optHighlightString, *optHighlightBool)
+	if *optHighlightString != "" && *optFind == "" {
+		*optFind = "attachment.content:\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(*optHighlightString) + "\""
+	}
+
+	sortBy, err := parseSort(*optSort)
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+	search := searchOptions{Limit: *optLimit, Offset: *optOffset, Sort: sortBy, Raw: *optRaw}
+
+	grep := *optOutput == OUTPUT_TEXT && (*optHighlightString != "" || *optHighlightBool)
+	if *optInteractive {
+		gotrovi.Interactive(*optFind, searchPath, *optRaw)
+	} else if *optFind != "" && grep {
+		opts := grepOptions{text: *optHighlightString, before: *optBefore, after: *optAfter, maxCount: *optMaxCount}
+		if *optBefore == 0 {
+			opts.before = *optContext
+		}
+		if *optAfter == 0 {
+			opts.after = *optContext
+		}
+		gotrovi.Grep(*optFind, searchPath, search, opts)
+	} else if *optFind != "" {
+		gotrovi.Find(*optFind, searchPath, search, *optScore, *optHighlightString, *optHighlightBool, *optOutput)
+	}
+
+	if *optWatch {
+		gotrovi.InitHash()
+		gotrovi.Watch()
 	}
 }
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	InitLogs(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	os.Exit(m.Run())
+}
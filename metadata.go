@@ -0,0 +1,1160 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// Metadata. The properties of photos, music, PDF and office documents are
+// read from their headers into the meta fields: the camera, date taken,
+// location and dimensions of photos from their EXIF data, the ID3, Vorbis
+// and MP4 tags of music, the info dictionary of PDF files and the document
+// properties of office files. Photos and music have no text, they are
+// indexed by their metadata alone whatever their size, without reading nor
+// sending their content.
+
+// Headers bigger than this are not read
+const META_MAX_SIZE = 1024 * 1024
+
+// Metadata holds the properties read from a file, by format
+type Metadata struct {
+	// documents, and the title of songs
+	Title    string `json:"title,omitempty"`
+	Author   string `json:"author,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+	Pages    int    `json:"pages,omitempty"`
+	Created  string `json:"created,omitempty"`
+	// photos, gps as latitude,longitude
+	Camera string `json:"camera,omitempty"`
+	Taken  string `json:"taken,omitempty"`
+	GPS    string `json:"gps,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// music
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Genre  string `json:"genre,omitempty"`
+	Year   int    `json:"year,omitempty"`
+	Track  int    `json:"track,omitempty"`
+}
+
+type metaExtractor struct {
+	contentType string
+	read        func(r io.ReaderAt, size int64) (*Metadata, error)
+	// the text of the file is extracted too, the metadata is all there is
+	// otherwise
+	text bool
+}
+
+var metaExtractors = map[string]metaExtractor{
+	".jpg":  {"image/jpeg", readJPEGMeta, false},
+	".jpeg": {"image/jpeg", readJPEGMeta, false},
+	".tif":  {"image/tiff", readTIFFMeta, false},
+	".tiff": {"image/tiff", readTIFFMeta, false},
+	".heic": {"image/heic", readHEIFMeta, false},
+	".heif": {"image/heif", readHEIFMeta, false},
+	".mp3":  {"audio/mpeg", readID3Meta, false},
+	".flac": {"audio/flac", readFLACMeta, false},
+	".ogg":  {"audio/ogg", readOggMeta, false},
+	".oga":  {"audio/ogg", readOggMeta, false},
+	".opus": {"audio/opus", readOggMeta, false},
+	".m4a":  {"audio/mp4", readMP4Meta, false},
+	".m4b":  {"audio/mp4", readMP4Meta, false},
+	".pdf":  {"application/pdf", readPDFMeta, true},
+	".docx": {"", readOOXMLMeta, true},
+	".xlsx": {"", readOOXMLMeta, true},
+	".pptx": {"", readOOXMLMeta, true},
+	".odt":  {"", readODFMeta, true},
+	".ods":  {"", readODFMeta, true},
+	".odp":  {"", readODFMeta, true},
+}
+
+func metaExtractorOf(name string) (metaExtractor, bool) {
+	e, ok := metaExtractors[strings.ToLower(filepath.Ext(name))]
+	return e, ok
+}
+
+// metadataOnly tells whether the file name is indexed by its metadata alone
+func metadataOnly(name string) bool {
+	e, ok := metaExtractorOf(name)
+	return ok && !e.text
+}
+
+// readMetadata returns the metadata of the file name, nil if it has none.
+// Files whose headers cannot be read are indexed without it.
+func readMetadata(name string, r io.ReaderAt, size int64) *Metadata {
+	e, ok := metaExtractorOf(name)
+	if !ok {
+		return nil
+	}
+	m, err := e.read(r, size)
+	if err != nil {
+		Trace.Println("Unable to read the metadata of", name, ":", err)
+	}
+	if m == nil || *m == (Metadata{}) {
+		return nil
+	}
+	return m
+}
+
+// setContent fills the content of doc from data, the content of the file
+// name: its metadata, and its text extracted or in Data for the ingest
+// pipeline, unless the metadata is all the format has
+func setContent(doc *FileDescriptionDoc, name string, data []byte, extract bool) {
+	doc.Meta = readMetadata(name, bytes.NewReader(data), int64(len(data)))
+	if e, ok := metaExtractorOf(name); ok && !e.text {
+		doc.Attachment = &Attachment{ContentType: e.contentType}
+		return
+	}
+	if extract {
+		var err error
+		doc.Attachment, err = Extract(name, data)
+		if err != nil {
+			Warning.Println("Unable to extract content of", doc.FullName, ":", err)
+			doc.Attachment.Error = err.Error()
+		}
+	} else {
+		doc.Data = base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+// encodeMetadata builds the document of p, a file indexed by its metadata
+// alone. Only its headers are read, besides hashing it.
+func encodeMetadata(h hash.Hash, info os.FileInfo, p string) (*FileDescriptionDoc, error) {
+	sum, err := hashFile(h, p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e, _ := metaExtractorOf(p)
+	return &FileDescriptionDoc{
+		FileName:   info.Name(),
+		FullName:   p,
+		Path:       filepath.Dir(p),
+		Size:       info.Size(),
+		Extension:  filepath.Ext(info.Name()),
+		Hash:       sum,
+		Date:       fileDate(info.ModTime()),
+		Mode:       info.Mode().String(),
+		Attachment: &Attachment{ContentType: e.contentType},
+		Meta:       readMetadata(p, f, info.Size()),
+	}, nil
+}
+
+// readAt reads n bytes at offset of r
+func readAt(r io.ReaderAt, offset int64, n int64) ([]byte, error) {
+	if n < 0 || n > META_MAX_SIZE {
+		return nil, fmt.Errorf("header of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err := r.ReadAt(b, offset)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// metaYear returns the year a date starts with, 0 if none
+func metaYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+// metaNumber returns the number a value as 3/12 starts with, 0 if none
+func metaNumber(v string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(strings.SplitN(v, "/", 2)[0]))
+	return n
+}
+
+// metaDate formats the dates of the document properties as the date field
+func metaDate(v string) string {
+	t, ok := parseDate(strings.TrimSpace(v))
+	if !ok {
+		return ""
+	}
+	return fileDate(t)
+}
+
+// EXIF
+
+// tiffReader reads the IFDs of a TIFF structure, the format of EXIF data.
+// Offsets are relative to base, where the TIFF header is.
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	value []byte
+}
+
+// Sizes of the TIFF types, by type
+var tiffTypeSizes = map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd reads the entries of the IFD at offset, by tag
+func (t *tiffReader) ifd(offset int64) (map[uint16]tiffEntry, error) {
+	b, err := readAt(t.r, t.base+offset, 2)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(t.order.Uint16(b))
+	b, err = readAt(t.r, t.base+offset+2, 12*n)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) < 12*n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	entries := make(map[uint16]tiffEntry)
+	for i := int64(0); i < n; i++ {
+		e := b[12*i : 12*i+12]
+		typ := t.order.Uint16(e[2:])
+		size := tiffTypeSizes[typ] * int64(t.order.Uint32(e[4:]))
+		var value []byte
+		if size > 4 {
+			if size > META_MAX_SIZE {
+				continue
+			}
+			value, err = readAt(t.r, t.base+int64(t.order.Uint32(e[8:])), size)
+			if err != nil || int64(len(value)) < size {
+				continue
+			}
+		} else {
+			value = e[8 : 8+size]
+		}
+		entries[t.order.Uint16(e)] = tiffEntry{typ: typ, value: value}
+	}
+	return entries, nil
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	v := e.value
+	if i := bytes.IndexByte(v, 0); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(string(v), ""))
+}
+
+func (t *tiffReader) uint(e tiffEntry) int {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return int(t.order.Uint16(e.value))
+	case (e.typ == 4 || e.typ == 9) && len(e.value) >= 4:
+		return int(t.order.Uint32(e.value))
+	}
+	return 0
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	var r []float64
+	for v := e.value; len(v) >= 8; v = v[8:] {
+		num, den := t.order.Uint32(v), t.order.Uint32(v[4:])
+		if den == 0 {
+			return nil
+		}
+		r = append(r, float64(num)/float64(den))
+	}
+	return r
+}
+
+// EXIF tags read
+const (
+	exifImageWidth       = 0x100
+	exifImageLength      = 0x101
+	exifMake             = 0x10f
+	exifModel            = 0x110
+	exifDateTime         = 0x132
+	exifIFD              = 0x8769
+	exifGPSIFD           = 0x8825
+	exifDateTimeOriginal = 0x9003
+	exifOffsetOriginal   = 0x9011
+	exifPixelXDimension  = 0xa002
+	exifPixelYDimension  = 0xa003
+	exifGPSLatitudeRef   = 1
+	exifGPSLatitude      = 2
+	exifGPSLongitudeRef  = 3
+	exifGPSLongitude     = 4
+)
+
+// readEXIF reads the EXIF data whose TIFF header is at base
+func readEXIF(r io.ReaderAt, base int64) (*Metadata, error) {
+	head, err := readAt(r, base, 8)
+	if err != nil {
+		return nil, err
+	}
+	t := &tiffReader{r: r, base: base}
+	switch string(head[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid TIFF header")
+	}
+	ifd0, err := t.ifd(int64(t.order.Uint32(head[4:])))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{
+		Camera: cameraName(t.str(ifd0[exifMake]), t.str(ifd0[exifModel])),
+		Width:  t.uint(ifd0[exifImageWidth]),
+		Height: t.uint(ifd0[exifImageLength]),
+	}
+	taken, offset := t.str(ifd0[exifDateTime]), ""
+	if e, ok := ifd0[exifIFD]; ok {
+		exif, err := t.ifd(int64(t.uint(e)))
+		if err == nil {
+			if v := t.str(exif[exifDateTimeOriginal]); v != "" {
+				taken, offset = v, t.str(exif[exifOffsetOriginal])
+			}
+			if w := t.uint(exif[exifPixelXDimension]); w > 0 {
+				m.Width, m.Height = w, t.uint(exif[exifPixelYDimension])
+			}
+		}
+	}
+	m.Taken = exifDate(taken, offset)
+	if e, ok := ifd0[exifGPSIFD]; ok {
+		gps, err := t.ifd(int64(t.uint(e)))
+		if err == nil {
+			lat, lon := t.rationals(gps[exifGPSLatitude]), t.rationals(gps[exifGPSLongitude])
+			if len(lat) == 3 && len(lon) == 3 {
+				la := lat[0] + lat[1]/60 + lat[2]/3600
+				lo := lon[0] + lon[1]/60 + lon[2]/3600
+				if t.str(gps[exifGPSLatitudeRef]) == "S" {
+					la = -la
+				}
+				if t.str(gps[exifGPSLongitudeRef]) == "W" {
+					lo = -lo
+				}
+				m.GPS = fmt.Sprintf("%.6f,%.6f", la, lo)
+			}
+		}
+	}
+	return m, nil
+}
+
+// cameraName joins the make and model of a camera, which often repeats
+// the make, as Canon and Canon EOS 5D
+func cameraName(make string, model string) string {
+	if first := strings.Fields(make); len(first) > 0 && strings.HasPrefix(strings.ToLower(model), strings.ToLower(first[0])) {
+		return model
+	}
+	return strings.TrimSpace(make + " " + model)
+}
+
+// exifDate formats an EXIF date, in local time without zone unless its
+// offset was recorded, as the date field. Dates without offset are taken
+// as UTC.
+func exifDate(v string, offset string) string {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", v+offset); err == nil {
+			return fileDate(t)
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", v)
+	if err != nil {
+		return ""
+	}
+	return fileDate(t)
+}
+
+func readTIFFMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	return readEXIF(r, 0)
+}
+
+// readJPEGMeta reads the EXIF segment and the dimensions of a JPEG file
+func readJPEGMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	head, err := readAt(r, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+	if head[0] != 0xff || head[1] != 0xd8 {
+		return nil, errors.New("not a JPEG file")
+	}
+	m := &Metadata{}
+	width, height := 0, 0
+	exif := false
+	for pos := int64(2); pos+4 <= size; {
+		head, err = readAt(r, pos, 4)
+		if err != nil {
+			return m, err
+		}
+		if head[0] != 0xff {
+			return m, errors.New("invalid JPEG marker")
+		}
+		marker := head[1]
+		if marker == 0xff {
+			pos = pos + 1
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd8 {
+			pos = pos + 2
+			continue
+		}
+		length := int64(binary.BigEndian.Uint16(head[2:]))
+		switch {
+		case marker == 0xe1 && !exif:
+			sig, err := readAt(r, pos+4, 6)
+			if err == nil && string(sig) == "Exif\x00\x00" {
+				exif = true
+				if e, err := readEXIF(r, pos+10); err == nil {
+					m = e
+				}
+			}
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// start of frame: precision, height and width
+			sof, err := readAt(r, pos+4, 5)
+			if err == nil {
+				height, width = int(binary.BigEndian.Uint16(sof[1:])), int(binary.BigEndian.Uint16(sof[3:]))
+			}
+		}
+		pos = pos + 2 + length
+	}
+	if width > 0 {
+		m.Width, m.Height = width, height
+	}
+	return m, nil
+}
+
+// ISO base media files: HEIF and MP4
+
+// isoBox is a box of the ISO base media file format, by the offset and size
+// of its content
+type isoBox struct {
+	typ    string
+	offset int64
+	size   int64
+}
+
+// isoBoxes returns the boxes between start and end of r
+func isoBoxes(r io.ReaderAt, start int64, end int64) ([]isoBox, error) {
+	var boxes []isoBox
+	for pos := start; pos+8 <= end; {
+		head, err := readAt(r, pos, 8)
+		if err != nil {
+			return boxes, err
+		}
+		size, headSize := int64(binary.BigEndian.Uint32(head)), int64(8)
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			large, err := readAt(r, pos+8, 8)
+			if err != nil {
+				return boxes, err
+			}
+			size, headSize = int64(binary.BigEndian.Uint64(large)), 16
+		}
+		if size < headSize || size > end-pos {
+			return boxes, errors.New("invalid box size")
+		}
+		boxes = append(boxes, isoBox{typ: string(head[4:]), offset: pos + headSize, size: size - headSize})
+		pos = pos + size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []isoBox, typ string) (isoBox, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return isoBox{}, false
+}
+
+// findPath finds the box at the path of box types, from the top level
+func findPath(r io.ReaderAt, size int64, path ...string) (isoBox, error) {
+	box := isoBox{size: size}
+	for _, typ := range path {
+		start := box.offset
+		// meta is a full box, with version and flags, except in QuickTime
+		if box.typ == "meta" {
+			if head, err := readAt(r, start+4, 4); err == nil && string(head) != "hdlr" {
+				start = start + 4
+			}
+		}
+		boxes, err := isoBoxes(r, start, box.offset+box.size)
+		if err != nil && len(boxes) == 0 {
+			return box, err
+		}
+		var ok bool
+		box, ok = findBox(boxes, typ)
+		if !ok {
+			return box, fmt.Errorf("no %s box", typ)
+		}
+	}
+	return box, nil
+}
+
+// beBytes reads big endian numbers of any size from b
+type beBytes struct {
+	b   []byte
+	err error
+}
+
+func (p *beBytes) uint(n int) uint64 {
+	if n < 0 || n > 8 || n > len(p.b) {
+		p.b, p.err = nil, io.ErrUnexpectedEOF
+		return 0
+	}
+	v := uint64(0)
+	for _, c := range p.b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+// readHEIFMeta reads the EXIF data of a HEIF file, stored as an item
+// located by the iinf and iloc boxes
+func readHEIFMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	iinf, err := findPath(r, size, "meta", "iinf")
+	if err != nil {
+		return nil, err
+	}
+	iloc, err := findPath(r, size, "meta", "iloc")
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := readAt(r, iinf.offset, iinf.size)
+	if err != nil {
+		return nil, err
+	}
+	start := int64(6)
+	if len(b) > 0 && b[0] > 0 {
+		start = 8
+	}
+	entries, _ := isoBoxes(bytes.NewReader(b), start, int64(len(b)))
+	id := uint64(0)
+	for _, e := range entries {
+		if e.offset < 0 || e.offset+e.size > int64(len(b)) {
+			break
+		}
+		p := &beBytes{b: b[e.offset : e.offset+e.size]}
+		version := p.uint(1)
+		p.uint(3)
+		if e.typ != "infe" || version < 2 {
+			continue
+		}
+		itemID := p.uint(2)
+		if version > 2 {
+			itemID = itemID<<16 | p.uint(2)
+		}
+		p.uint(2)
+		if p.err == nil && len(p.b) >= 4 && string(p.b[:4]) == "Exif" {
+			id = itemID
+			break
+		}
+	}
+	if id == 0 {
+		return nil, errors.New("no Exif item")
+	}
+
+	b, err = readAt(r, iloc.offset, iloc.size)
+	if err != nil {
+		return nil, err
+	}
+	p := &beBytes{b: b}
+	version := p.uint(1)
+	p.uint(3)
+	sizes := p.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&15)
+	sizes = p.uint(1)
+	baseSize, indexSize := int(sizes>>4), int(sizes&15)
+	if version == 0 {
+		indexSize = 0
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := p.uint(idSize)
+	for i := uint64(0); i < count && p.err == nil; i++ {
+		itemID := p.uint(idSize)
+		method := uint64(0)
+		if version > 0 {
+			method = p.uint(2) & 15
+		}
+		p.uint(2)
+		base := p.uint(baseSize)
+		extents := p.uint(2)
+		offset := uint64(0)
+		for j := uint64(0); j < extents && p.err == nil; j++ {
+			p.uint(indexSize)
+			o := p.uint(offsetSize)
+			p.uint(lengthSize)
+			if j == 0 {
+				offset = o
+			}
+		}
+		if itemID != id || p.err != nil {
+			continue
+		}
+		if method != 0 {
+			return nil, errors.New("unsupported Exif item location")
+		}
+		if base > uint64(size) || offset > uint64(size)-base {
+			return nil, errors.New("invalid Exif item location")
+		}
+		// the item starts with the offset of the TIFF header
+		head, err := readAt(r, int64(base+offset), 4)
+		if err != nil {
+			return nil, err
+		}
+		return readEXIF(r, int64(base+offset)+4+int64(binary.BigEndian.Uint32(head)))
+	}
+	return nil, errors.New("no location for the Exif item")
+}
+
+// readMP4Meta reads the iTunes tags of MP4 audio files
+func readMP4Meta(r io.ReaderAt, size int64) (*Metadata, error) {
+	ilst, err := findPath(r, size, "moov", "udta", "meta", "ilst")
+	if err != nil {
+		return nil, err
+	}
+	items, err := isoBoxes(r, ilst.offset, ilst.offset+ilst.size)
+	m := &Metadata{}
+	for _, item := range items {
+		children, _ := isoBoxes(r, item.offset, item.offset+item.size)
+		data, ok := findBox(children, "data")
+		if !ok || data.size <= 8 {
+			continue
+		}
+		b, derr := readAt(r, data.offset+8, data.size-8)
+		if derr != nil {
+			continue
+		}
+		switch item.typ {
+		case "\xa9nam":
+			m.Title = string(b)
+		case "\xa9ART":
+			m.Artist = string(b)
+		case "\xa9alb":
+			m.Album = string(b)
+		case "\xa9gen":
+			m.Genre = string(b)
+		case "gnre":
+			if len(b) >= 2 {
+				m.Genre = id3Genre(strconv.Itoa(int(binary.BigEndian.Uint16(b)) - 1))
+			}
+		case "\xa9day":
+			m.Year = metaYear(string(b))
+		case "trkn":
+			if len(b) >= 4 {
+				m.Track = int(binary.BigEndian.Uint16(b[2:]))
+			}
+		}
+	}
+	return m, err
+}
+
+// Audio tags
+
+// ID3v2 frames read, by version 2.2 and 2.3 or 2.4 frame id
+var id3Frames = map[string]string{
+	"TT2": "title", "TP1": "artist", "TAL": "album", "TCO": "genre", "TYE": "year", "TRK": "track",
+	"TIT2": "title", "TPE1": "artist", "TALB": "album", "TCON": "genre", "TYER": "year", "TDRC": "year", "TRCK": "track",
+}
+
+// The genres of ID3v1, by number
+var id3Genres = strings.Split("Blues|Classic Rock|Country|Dance|Disco|Funk|Grunge|Hip-Hop|Jazz|Metal|New Age|Oldies|Other|Pop|R&B|Rap|Reggae|Rock|Techno|Industrial|Alternative|Ska|Death Metal|Pranks|Soundtrack|Euro-Techno|Ambient|Trip-Hop|Vocal|Jazz+Funk|Fusion|Trance|Classical|Instrumental|Acid|House|Game|Sound Clip|Gospel|Noise|AlternRock|Bass|Soul|Punk|Space|Meditative|Instrumental Pop|Instrumental Rock|Ethnic|Gothic|Darkwave|Techno-Industrial|Electronic|Pop-Folk|Eurodance|Dream|Southern Rock|Comedy|Cult|Gangsta|Top 40|Christian Rap|Pop/Funk|Jungle|Native American|Cabaret|New Wave|Psychadelic|Rave|Showtunes|Trailer|Lo-Fi|Tribal|Acid Punk|Acid Jazz|Polka|Retro|Musical|Rock & Roll|Hard Rock", "|")
+
+// id3Genre returns the name of a genre given by its ID3v1 number, as 17 or
+// (17), or by name
+func id3Genre(v string) string {
+	n := strings.TrimSuffix(strings.TrimPrefix(v, "("), ")")
+	if i, err := strconv.Atoi(n); err == nil {
+		if i >= 0 && i < len(id3Genres) {
+			return id3Genres[i]
+		}
+		return ""
+	}
+	if i := strings.IndexByte(v, ')'); strings.HasPrefix(v, "(") && i > 0 && i < len(v)-1 {
+		return v[i+1:]
+	}
+	return v
+}
+
+// id3Text decodes a text frame, returning its first value
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var text string
+	switch b[0] {
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		b = b[1:]
+		if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			order, b = binary.LittleEndian, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			b = b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for ; len(b) >= 2; b = b[2:] {
+			u = append(u, order.Uint16(b))
+		}
+		text = string(utf16.Decode(u))
+	case 3:
+		text = strings.ToValidUTF8(string(b[1:]), "")
+	default:
+		text = decodeCharset(b[1:], "iso-8859-1")
+	}
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text)
+}
+
+// syncsafe decodes the 7 bits per byte integers of ID3v2
+func syncsafe(b []byte) int64 {
+	v := int64(0)
+	for _, c := range b {
+		v = v<<7 | int64(c&0x7f)
+	}
+	return v
+}
+
+// setTag sets the field of m named tag, unless it is already set
+func (m *Metadata) setTag(tag string, v string) {
+	if v == "" {
+		return
+	}
+	switch {
+	case tag == "title" && m.Title == "":
+		m.Title = v
+	case tag == "artist" && m.Artist == "":
+		m.Artist = v
+	case tag == "album" && m.Album == "":
+		m.Album = v
+	case tag == "genre" && m.Genre == "":
+		m.Genre = id3Genre(v)
+	case tag == "year" && m.Year == 0:
+		m.Year = metaYear(v)
+	case tag == "track" && m.Track == 0:
+		m.Track = metaNumber(v)
+	}
+}
+
+// readID3Meta reads the ID3v2 tag at the start of MP3 files, and the ID3v1
+// tag at their end for the fields it does not have
+func readID3Meta(r io.ReaderAt, size int64) (*Metadata, error) {
+	m := &Metadata{}
+	head, err := readAt(r, 0, 10)
+	if err == nil && len(head) == 10 && string(head[:3]) == "ID3" && head[3] >= 2 && head[3] <= 4 {
+		version := head[3]
+		end := 10 + syncsafe(head[6:10])
+		pos := int64(10)
+		if head[5]&0x40 != 0 && version > 2 {
+			// extended header
+			ext, err := readAt(r, pos, 4)
+			if err != nil || len(ext) < 4 {
+				return m, err
+			}
+			if version == 4 {
+				pos = pos + syncsafe(ext)
+			} else {
+				pos = pos + 4 + int64(binary.BigEndian.Uint32(ext))
+			}
+		}
+		idSize, headSize := 4, int64(10)
+		if version == 2 {
+			idSize, headSize = 3, 6
+		}
+		for pos+headSize <= end && pos+headSize <= size {
+			frame, err := readAt(r, pos, headSize)
+			if err != nil || int64(len(frame)) < headSize || frame[0] == 0 {
+				break
+			}
+			var frameSize int64
+			switch version {
+			case 2:
+				frameSize = int64(frame[3])<<16 | int64(frame[4])<<8 | int64(frame[5])
+			case 3:
+				frameSize = int64(binary.BigEndian.Uint32(frame[4:]))
+			default:
+				frameSize = syncsafe(frame[4:8])
+			}
+			pos = pos + headSize
+			if frameSize > end-pos {
+				break
+			}
+			if tag := id3Frames[string(frame[:idSize])]; tag != "" {
+				if b, err := readAt(r, pos, frameSize); err == nil {
+					m.setTag(tag, id3Text(b))
+				}
+			}
+			pos = pos + frameSize
+		}
+	}
+
+	if size >= 128 {
+		tag, err := readAt(r, size-128, 128)
+		if err == nil && len(tag) == 128 && string(tag[:3]) == "TAG" {
+			text := func(b []byte) string {
+				return strings.TrimSpace(strings.TrimRight(decodeCharset(b, "iso-8859-1"), "\x00"))
+			}
+			m.setTag("title", text(tag[3:33]))
+			m.setTag("artist", text(tag[33:63]))
+			m.setTag("album", text(tag[63:93]))
+			m.setTag("year", text(tag[93:97]))
+			if tag[125] == 0 && tag[126] != 0 {
+				m.setTag("track", strconv.Itoa(int(tag[126])))
+			}
+			if int(tag[127]) < len(id3Genres) {
+				m.setTag("genre", id3Genres[tag[127]])
+			}
+		}
+	}
+	return m, nil
+}
+
+// Vorbis comments read, by name
+var vorbisTags = map[string]string{"TITLE": "title", "ARTIST": "artist", "ALBUM": "album", "GENRE": "genre", "DATE": "year", "TRACKNUMBER": "track"}
+
+// readVorbisComment reads the tags of a Vorbis comment, as found in FLAC
+// and Ogg files
+func readVorbisComment(b []byte) *Metadata {
+	m := &Metadata{}
+	p := b
+	next := func() ([]byte, bool) {
+		if len(p) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(p)
+		if uint64(n) > uint64(len(p)-4) {
+			return nil, false
+		}
+		v := p[4 : 4+n]
+		p = p[4+n:]
+		return v, true
+	}
+	// the vendor, then the amount of comments
+	if _, ok := next(); !ok || len(p) < 4 {
+		return m
+	}
+	count := binary.LittleEndian.Uint32(p)
+	p = p[4:]
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		kv := strings.SplitN(strings.ToValidUTF8(string(c), ""), "=", 2)
+		if len(kv) == 2 {
+			m.setTag(vorbisTags[strings.ToUpper(kv[0])], strings.TrimSpace(kv[1]))
+		}
+	}
+	return m
+}
+
+// readFLACMeta reads the Vorbis comment block of FLAC files
+func readFLACMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	head, err := readAt(r, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	if string(head) != "fLaC" {
+		return nil, errors.New("not a FLAC file")
+	}
+	for pos := int64(4); pos+4 <= size; {
+		block, err := readAt(r, pos, 4)
+		if err != nil {
+			return nil, err
+		}
+		n := int64(block[1])<<16 | int64(block[2])<<8 | int64(block[3])
+		if block[0]&0x7f == 4 {
+			b, err := readAt(r, pos+4, n)
+			if err != nil {
+				return nil, err
+			}
+			return readVorbisComment(b), nil
+		}
+		if block[0]&0x80 != 0 {
+			break
+		}
+		pos = pos + 4 + n
+	}
+	return nil, nil
+}
+
+// readOggMeta reads the Vorbis comment of Ogg Vorbis and Opus files, the
+// second packet of their stream
+func readOggMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	var packet []byte
+	packets := 0
+	for pos := int64(0); pos+27 <= size && packets < 2; {
+		page, err := readAt(r, pos, 27)
+		if err != nil {
+			return nil, err
+		}
+		if string(page[:4]) != "OggS" {
+			return nil, errors.New("invalid Ogg page")
+		}
+		lacing, err := readAt(r, pos+27, int64(page[26]))
+		if err != nil {
+			return nil, err
+		}
+		pos = pos + 27 + int64(len(lacing))
+		for _, l := range lacing {
+			if packets == 1 && len(packet) < META_MAX_SIZE {
+				segment, err := readAt(r, pos, int64(l))
+				if err != nil {
+					return nil, err
+				}
+				packet = append(packet, segment...)
+			}
+			pos = pos + int64(l)
+			if l < 255 {
+				packets = packets + 1
+			}
+		}
+	}
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		return readVorbisComment(packet[7:]), nil
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		return readVorbisComment(packet[8:]), nil
+	}
+	return nil, errors.New("no Vorbis comment")
+}
+
+// Documents
+
+// readPDFMeta reads the info dictionary and the amount of pages of PDF
+// files. The PDF reader panics on some malformed files, as in safeExtract.
+func readPDFMeta(r io.ReaderAt, size int64) (m *Metadata, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			m, err = nil, fmt.Errorf("malformed PDF: %v", rec)
+		}
+	}()
+	pr, err := pdf.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	info := pr.Trailer().Key("Info")
+	return &Metadata{
+		Title:    strings.TrimSpace(info.Key("Title").Text()),
+		Author:   strings.TrimSpace(info.Key("Author").Text()),
+		Subject:  strings.TrimSpace(info.Key("Subject").Text()),
+		Keywords: strings.TrimSpace(info.Key("Keywords").Text()),
+		Created:  pdfDate(info.Key("CreationDate").Text()),
+		Pages:    pr.NumPage(),
+	}, nil
+}
+
+// pdfDate formats a PDF date, as D:20230102150405+01'00', as the date field
+func pdfDate(v string) string {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "D:")
+	n := 0
+	for n < len(v) && n < 14 && v[n] >= '0' && v[n] <= '9' {
+		n++
+	}
+	digits := v[:n&^1]
+	if len(digits) < 4 {
+		return ""
+	}
+	t, err := time.Parse("20060102150405"[:len(digits)], digits)
+	if err != nil {
+		return ""
+	}
+	zone := v[n:]
+	if len(zone) >= 3 && (zone[0] == '+' || zone[0] == '-') {
+		hours, _ := strconv.Atoi(zone[1:3])
+		minutes := 0
+		if len(zone) >= 6 {
+			minutes, _ = strconv.Atoi(zone[4:6])
+		}
+		offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if zone[0] == '+' {
+			offset = -offset
+		}
+		t = t.Add(offset)
+	}
+	return fileDate(t)
+}
+
+// zipEntry reads the file name of the zip archive zr, nil if it has none
+func zipEntry(zr *zip.Reader, name string) []byte {
+	for _, f := range zr.File {
+		if f.Name == name {
+			b, err := readZipFile(f)
+			if err != nil {
+				return nil
+			}
+			return b
+		}
+	}
+	return nil
+}
+
+// readOOXMLMeta reads the core and app properties of Office Open XML
+// documents
+func readOOXMLMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var core struct {
+		Title    string `xml:"title"`
+		Creator  string `xml:"creator"`
+		Subject  string `xml:"subject"`
+		Keywords string `xml:"keywords"`
+		Created  string `xml:"created"`
+	}
+	var app struct {
+		Pages  int `xml:"Pages"`
+		Slides int `xml:"Slides"`
+	}
+	if b := zipEntry(zr, "docProps/core.xml"); b != nil {
+		err = xml.Unmarshal(b, &core)
+	}
+	if b := zipEntry(zr, "docProps/app.xml"); b != nil {
+		xml.Unmarshal(b, &app)
+	}
+	m := &Metadata{
+		Title:    strings.TrimSpace(core.Title),
+		Author:   strings.TrimSpace(core.Creator),
+		Subject:  strings.TrimSpace(core.Subject),
+		Keywords: strings.TrimSpace(core.Keywords),
+		Created:  metaDate(core.Created),
+		Pages:    app.Pages,
+	}
+	if app.Slides > 0 {
+		m.Pages = app.Slides
+	}
+	return m, err
+}
+
+// readODFMeta reads the meta.xml properties of OpenDocument files
+func readODFMeta(r io.ReaderAt, size int64) (*Metadata, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	b := zipEntry(zr, "meta.xml")
+	if b == nil {
+		return nil, nil
+	}
+	var doc struct {
+		Meta struct {
+			Title          string   `xml:"title"`
+			InitialCreator string   `xml:"initial-creator"`
+			Creator        string   `xml:"creator"`
+			Subject        string   `xml:"subject"`
+			Keywords       []string `xml:"keyword"`
+			Created        string   `xml:"creation-date"`
+			Statistic      struct {
+				Pages int `xml:"page-count,attr"`
+			} `xml:"document-statistic"`
+		} `xml:"meta"`
+	}
+	err = xml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+	meta := doc.Meta
+	author := meta.InitialCreator
+	if author == "" {
+		author = meta.Creator
+	}
+	return &Metadata{
+		Title:    strings.TrimSpace(meta.Title),
+		Author:   strings.TrimSpace(author),
+		Subject:  strings.TrimSpace(meta.Subject),
+		Keywords: strings.TrimSpace(strings.Join(meta.Keywords, ", ")),
+		Created:  metaDate(meta.Created),
+		Pages:    meta.Statistic.Pages,
+	}, nil
+}
+
+// field returns the value of the meta field name for the local backend,
+// empty for unset numbers
+func (m *Metadata) field(name string) (string, bool) {
+	if m == nil {
+		m = &Metadata{}
+	}
+	number := func(v int) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.Itoa(v)
+	}
+	switch name {
+	case "title":
+		return m.Title, true
+	case "author":
+		return m.Author, true
+	case "subject":
+		return m.Subject, true
+	case "keywords":
+		return m.Keywords, true
+	case "pages":
+		return number(m.Pages), true
+	case "created":
+		return m.Created, true
+	case "camera":
+		return m.Camera, true
+	case "taken":
+		return m.Taken, true
+	case "gps":
+		return m.GPS, true
+	case "width":
+		return number(m.Width), true
+	case "height":
+		return number(m.Height), true
+	case "artist":
+		return m.Artist, true
+	case "album":
+		return m.Album, true
+	case "genre":
+		return m.Genre, true
+	case "year":
+		return number(m.Year), true
+	case "track":
+		return number(m.Track), true
+	}
+	return "", false
+}
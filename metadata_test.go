@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// testTIFF builds big endian EXIF data of a Canon camera with the date a
+// photo was taken and its GPS position
+func testTIFF() []byte {
+	const exifIFDAt, gpsIFDAt, dataAt = 70, 120, 180
+	var b bytes.Buffer
+	w16 := func(v uint16) { binary.Write(&b, binary.BigEndian, v) }
+	w32 := func(v uint32) { binary.Write(&b, binary.BigEndian, v) }
+	entry := func(tag uint16, typ uint16, count uint32, value uint32) {
+		w16(tag)
+		w16(typ)
+		w32(count)
+		w32(value)
+	}
+	pad := func(n int) {
+		for b.Len() < n {
+			b.WriteByte(0)
+		}
+	}
+
+	b.WriteString("MM\x00*")
+	w32(8)
+	w16(4)
+	entry(exifMake, 2, 6, dataAt)
+	entry(exifModel, 2, 13, dataAt+8)
+	entry(exifIFD, 4, 1, exifIFDAt)
+	entry(exifGPSIFD, 4, 1, gpsIFDAt)
+	w32(0)
+	pad(exifIFDAt)
+	w16(3)
+	entry(exifDateTimeOriginal, 2, 20, dataAt+24)
+	entry(exifOffsetOriginal, 2, 7, dataAt+48)
+	entry(exifPixelXDimension, 4, 1, 4000)
+	w32(0)
+	pad(gpsIFDAt)
+	w16(4)
+	entry(exifGPSLatitudeRef, 2, 2, 'N'<<24)
+	entry(exifGPSLatitude, 5, 3, dataAt+56)
+	entry(exifGPSLongitudeRef, 2, 2, 'W'<<24)
+	entry(exifGPSLongitude, 5, 3, dataAt+80)
+	w32(0)
+	pad(dataAt)
+	b.WriteString("Canon\x00\x00\x00")
+	b.WriteString("Canon EOS 5D\x00\x00\x00\x00")
+	b.WriteString("2023:07:14 10:20:30\x00\x00\x00\x00\x00")
+	b.WriteString("+02:00\x00\x00")
+	for _, v := range []uint32{48, 1, 51, 1, 30, 1, 2, 1, 21, 1, 0, 1} {
+		w32(v)
+	}
+	return b.Bytes()
+}
+
+// testJPEG builds a 64x48 JPEG image with testTIFF as its EXIF segment
+func testJPEG() []byte {
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil)
+	exif := append([]byte("Exif\x00\x00"), testTIFF()...)
+	b := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}
+	b = append(b, exif...)
+	return append(b, img.Bytes()[2:]...)
+}
+
+// testBox builds an ISO base media box
+func testBox(typ string, content ...[]byte) []byte {
+	c := bytes.Join(content, nil)
+	b := make([]byte, 8, 8+len(c))
+	binary.BigEndian.PutUint32(b, uint32(8+len(c)))
+	copy(b[4:], typ)
+	return append(b, c...)
+}
+
+// testHEIC builds a HEIF image whose Exif item is testTIFF
+func testHEIC() []byte {
+	item := append([]byte{0, 0, 0, 6, 'E', 'x', 'i', 'f', 0, 0}, testTIFF()...)
+	infe := testBox("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00"))
+	iinf := testBox("iinf", []byte{0, 0, 0, 0, 0, 1}, infe)
+	ftyp := testBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	head := func(offset uint32) []byte {
+		loc := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(loc[14:], offset)
+		binary.BigEndian.PutUint32(loc[18:], uint32(len(item)))
+		meta := testBox("meta", []byte{0, 0, 0, 0}, testBox("hdlr", make([]byte, 20)), iinf, testBox("iloc", loc))
+		return append(ftyp, meta...)
+	}
+	b := head(uint32(len(head(0)) + 8))
+	return append(b, testBox("mdat", item)...)
+}
+
+// testMP3 builds an ID3v2.3 tag, followed by some audio
+func testMP3() []byte {
+	frame := func(id string, text string) []byte {
+		b := append([]byte(id), 0, 0, 0, byte(len(text)+1), 0, 0, 0)
+		return append(b, text...)
+	}
+	frames := bytes.Join([][]byte{
+		frame("TIT2", "Giant Steps"),
+		frame("TPE1", "John Coltrane"),
+		frame("TALB", "Giant Steps"),
+		frame("TCON", "(8)"),
+		frame("TRCK", "1/7"),
+		frame("TYER", "1960"),
+		make([]byte, 20),
+	}, nil)
+	n := len(frames)
+	b := append([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, byte(n >> 7 & 0x7f), byte(n & 0x7f)}, frames...)
+	return append(b, make([]byte, 1000)...)
+}
+
+// testVorbis builds a Vorbis comment of tags
+func testVorbis(tags ...string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	b.WriteString("gov")
+	binary.Write(&b, binary.LittleEndian, uint32(len(tags)))
+	for _, t := range tags {
+		binary.Write(&b, binary.LittleEndian, uint32(len(t)))
+		b.WriteString(t)
+	}
+	return b.Bytes()
+}
+
+// testFLAC builds the stream info and the Vorbis comment blocks of a FLAC
+// file
+func testFLAC() []byte {
+	b := append([]byte("fLaC\x00\x00\x00\x22"), make([]byte, 34)...)
+	c := testVorbis("TITLE=Blue Train", "ARTIST=John Coltrane", "ALBUM=Blue Train", "DATE=1957-09-15", "TRACKNUMBER=1")
+	b = append(b, 0x84, 0, byte(len(c)>>8), byte(len(c)))
+	return append(b, c...)
+}
+
+// testOggPage builds an Ogg page holding packet
+func testOggPage(packet []byte) []byte {
+	var lacing []byte
+	n := len(packet)
+	for ; n >= 255; n = n - 255 {
+		lacing = append(lacing, 255)
+	}
+	lacing = append(lacing, byte(n))
+	b := append([]byte("OggS"), make([]byte, 22)...)
+	b = append(b, byte(len(lacing)))
+	b = append(b, lacing...)
+	return append(b, packet...)
+}
+
+// testOpus builds an Opus file with a comment packet spanning segments
+func testOpus() []byte {
+	tags := append([]byte("OpusTags"), testVorbis("TITLE=Naima", "ARTIST=John Coltrane", "ALBUM=Giant Steps", "GENRE=Jazz", "COMMENT="+string(make([]byte, 600)))...)
+	return append(testOggPage([]byte("OpusHead0123456789")), testOggPage(tags)...)
+}
+
+// testM4A builds the iTunes tags of an MP4 audio file
+func testM4A() []byte {
+	data := func(v []byte) []byte { return testBox("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, v) }
+	ilst := testBox("ilst",
+		testBox("\xa9nam", data([]byte("Alabama"))),
+		testBox("\xa9ART", data([]byte("John Coltrane"))),
+		testBox("\xa9alb", data([]byte("Live at Birdland"))),
+		testBox("trkn", data([]byte{0, 0, 0, 4, 0, 9, 0, 0})),
+		testBox("\xa9day", data([]byte("1963"))))
+	meta := testBox("meta", []byte{0, 0, 0, 0}, testBox("hdlr", make([]byte, 25)), ilst)
+	moov := testBox("moov", testBox("mvhd", make([]byte, 100)), testBox("udta", meta))
+	return append(testBox("ftyp", []byte("M4A \x00\x00\x00\x00")), moov...)
+}
+
+// testPDF builds a PDF of two pages with an info dictionary
+func testPDF() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 100 100] >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 100 100] >>",
+		"<< /Title (Annual Wombat Report) /Author (Jane Smith) /CreationDate (D:20210304050607+01'00') >>",
+	}
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	var offsets []int
+	for i, o := range objects {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+// testZip builds a zip archive of files, by name
+func testZip(files map[string]string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestReadMetadata(t *testing.T) {
+	photo := Metadata{Camera: "Canon EOS 5D", Taken: "2023-07-14T08:20:30Z", GPS: "48.858333,-2.350000", Width: 4000}
+	tests := []struct {
+		name string
+		data []byte
+		want Metadata
+	}{
+		{"photo.tif", testTIFF(), photo},
+		{"photo.jpg", testJPEG(), Metadata{Camera: photo.Camera, Taken: photo.Taken, GPS: photo.GPS, Width: 64, Height: 48}},
+		{"photo.heic", testHEIC(), photo},
+		{"song.mp3", testMP3(), Metadata{Title: "Giant Steps", Artist: "John Coltrane", Album: "Giant Steps", Genre: "Jazz", Year: 1960, Track: 1}},
+		{"song.flac", testFLAC(), Metadata{Title: "Blue Train", Artist: "John Coltrane", Album: "Blue Train", Year: 1957, Track: 1}},
+		{"song.opus", testOpus(), Metadata{Title: "Naima", Artist: "John Coltrane", Album: "Giant Steps", Genre: "Jazz"}},
+		{"song.m4a", testM4A(), Metadata{Title: "Alabama", Artist: "John Coltrane", Album: "Live at Birdland", Year: 1963, Track: 4}},
+		{"report.pdf", testPDF(), Metadata{Title: "Annual Wombat Report", Author: "Jane Smith", Created: "2021-03-04T04:06:07Z", Pages: 2}},
+		{"budget.docx", testZip(map[string]string{
+			"docProps/core.xml": `<cp:coreProperties xmlns:cp="c" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="t"><dc:title>Budget</dc:title><dc:creator>Bob Jones</dc:creator><cp:keywords>money</cp:keywords><dcterms:created>2022-02-03T04:05:06Z</dcterms:created></cp:coreProperties>`,
+			"docProps/app.xml":  `<Properties><Pages>12</Pages></Properties>`,
+		}), Metadata{Title: "Budget", Author: "Bob Jones", Keywords: "money", Created: "2022-02-03T04:05:06Z", Pages: 12}},
+		{"plan.odt", testZip(map[string]string{
+			"meta.xml": `<office:document-meta xmlns:office="o" xmlns:meta="m" xmlns:dc="d"><office:meta><dc:title>Plan</dc:title><meta:initial-creator>Ann</meta:initial-creator><meta:document-statistic meta:page-count="3"/></office:meta></office:document-meta>`,
+		}), Metadata{Title: "Plan", Author: "Ann", Pages: 3}},
+		{"photo.png", testJPEG(), Metadata{}},
+	}
+	for _, test := range tests {
+		var got Metadata
+		if m := readMetadata(test.name, bytes.NewReader(test.data), int64(len(test.data))); m != nil {
+			got = *m
+		}
+		if got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestReadMetadataTruncated reads every prefix and corrupted copies of the
+// files, which must be indexed without metadata or with part of it
+func TestReadMetadataTruncated(t *testing.T) {
+	files := map[string][]byte{
+		"photo.tif":  testTIFF(),
+		"photo.jpg":  testJPEG(),
+		"photo.heic": testHEIC(),
+		"song.mp3":   testMP3(),
+		"song.flac":  testFLAC(),
+		"song.opus":  testOpus(),
+		"song.m4a":   testM4A(),
+	}
+	for name, data := range files {
+		for n := 0; n < len(data) && n < 1024; n++ {
+			readMetadata(name, bytes.NewReader(data[:n]), int64(n))
+			corrupted := append([]byte(nil), data...)
+			corrupted[n] = 0xff
+			readMetadata(name, bytes.NewReader(corrupted), int64(len(corrupted)))
+		}
+	}
+}
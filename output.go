@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Search output formats selected with -o. Only text goes through the pager
+// with colors, the rest are written to stdout as the hits arrive.
+const OUTPUT_TEXT = "text"
+const OUTPUT_JSON = "json"
+const OUTPUT_NDJSON = "ndjson"
+const OUTPUT_CSV = "csv"
+const OUTPUT_TSV = "tsv"
+const OUTPUT_NULL = "null"
+
+var outputFormats = []string{OUTPUT_TEXT, OUTPUT_JSON, OUTPUT_NDJSON, OUTPUT_CSV, OUTPUT_TSV, OUTPUT_NULL}
+
+// sourceColumn is a column of the csv and tsv formats: a field of Source, or
+// of one of its structs, by its json name
+type sourceColumn struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// sourceColumns lists the fields of t, those of its structs flattened into
+// columns prefixed by the struct name, as mail.subject
+func sourceColumns(t reflect.Type, prefix string, index []int) []sourceColumn {
+	var columns []sourceColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			columns = append(columns, sourceColumns(field.Type.Elem(), prefix+tag[0]+".", fieldIndex)...)
+			continue
+		}
+		columns = append(columns, sourceColumn{name: prefix + tag[0], index: fieldIndex, omitEmpty: len(tag) > 1 && tag[1] == "omitempty"})
+	}
+	return columns
+}
+
+var outputSourceColumns = sourceColumns(reflect.TypeOf(Source{}), "", nil)
+
+// outputColumns are the columns of the csv and tsv formats, every field of
+// Source, the score and the highlights
+var outputColumns = func() []string {
+	var names []string
+	for _, c := range outputSourceColumns {
+		names = append(names, c.name)
+	}
+	return append(names, "score", "highlights")
+}()
+
+// outputEntry is a hit in the json and ndjson formats
+type outputEntry struct {
+	Source
+	Score      float64  `json:"score"`
+	Highlights []string `json:"highlights,omitempty"`
+}
+
+// entryFormatter writes the hits of a search in a structured format
+type entryFormatter struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	count  int
+}
+
+func validOutput(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func newEntryFormatter(format string, w io.Writer) *entryFormatter {
+	f := &entryFormatter{format: format, w: w}
+	switch format {
+	case OUTPUT_JSON:
+		fmt.Fprint(w, "[")
+	case OUTPUT_CSV:
+		f.csv = csv.NewWriter(w)
+		f.csv.Write(outputColumns)
+		f.csv.Flush()
+	case OUTPUT_TSV:
+		fmt.Fprintln(w, strings.Join(outputColumns, "\t"))
+	}
+	return f
+}
+
+// tsvEscape escapes the characters that would break a TSV line
+func tsvEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace(s)
+}
+
+// value formats the column c of s, empty when its struct is missing or it
+// is zero and omitted in json
+func (c sourceColumn) value(s Source) string {
+	v := reflect.ValueOf(s)
+	for _, i := range c.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return ""
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	if c.omitEmpty && v.IsZero() {
+		return ""
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (f *entryFormatter) columns(e SearchHit) []string {
+	columns := make([]string, 0, len(outputColumns))
+	for _, c := range outputSourceColumns {
+		columns = append(columns, c.value(e.Source))
+	}
+	return append(columns,
+		strconv.FormatFloat(e.Score, 'g', -1, 64),
+		strings.Join(e.Highlight.Field, "\n"),
+	)
+}
+
+// Entry is an ES_EntryFunc writing e
+func (f *entryFormatter) Entry(g *Gotrovi, total int, current int, e SearchHit, boolOption bool, stringOption string, buf io.Writer) {
+	switch f.format {
+	case OUTPUT_JSON, OUTPUT_NDJSON:
+		var data bytes.Buffer
+		enc := json.NewEncoder(&data)
+		// keep the <em> of the highlights readable
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(outputEntry{Source: e.Source, Score: e.Score, Highlights: e.Highlight.Field})
+		if err != nil {
+			Error.Println(err)
+			return
+		}
+		data.Truncate(data.Len() - 1)
+		if f.format == OUTPUT_NDJSON {
+			fmt.Fprintf(f.w, "%s\n", data.Bytes())
+		} else if f.count == 0 {
+			fmt.Fprintf(f.w, "\n%s", data.Bytes())
+		} else {
+			fmt.Fprintf(f.w, ",\n%s", data.Bytes())
+		}
+	case OUTPUT_CSV:
+		f.csv.Write(f.columns(e))
+		f.csv.Flush()
+	case OUTPUT_TSV:
+		columns := f.columns(e)
+		for i := range columns {
+			columns[i] = tsvEscape(columns[i])
+		}
+		fmt.Fprintln(f.w, strings.Join(columns, "\t"))
+	case OUTPUT_NULL:
+		fmt.Fprintf(f.w, "%s\x00", e.Source.FullName)
+	}
+	f.count = f.count + 1
+}
+
+func (f *entryFormatter) End() {
+	if f.format == OUTPUT_JSON {
+		fmt.Fprint(f.w, "\n]\n")
+	}
+}
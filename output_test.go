@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutputColumns(t *testing.T) {
+	want := "filename fullpath path size extension hash isfolder date mode chunk chunks offset archive members uncompressed_size " +
+		"mail.from mail.to mail.cc mail.subject mail.date mail.message_id " +
+		"meta.title meta.author meta.subject meta.keywords meta.pages meta.created meta.camera meta.taken meta.gps meta.width meta.height " +
+		"meta.artist meta.album meta.genre meta.year meta.track score highlights"
+	if got := strings.Join(outputColumns, " "); got != want {
+		t.Errorf("columns %s\nwant %s", got, want)
+	}
+
+	hits := []SearchHit{
+		{Score: 1.5, Source: Source{FileName: "big.log", FullName: "/a/big.log", Path: "/a", Size: 2048, Chunk: 2, Offset: 1024}, Highlight: Highlight{Field: []string{"one\ttab", "two"}}},
+		{Score: 1, Source: Source{FileName: "x.eml", FullName: "/a/b.zip!x.eml", Archive: "/a/b.zip", Mail: &Mail{From: "alice@example.com", Subject: "hi, there"}}},
+		{Score: 0.5, Source: Source{FileName: "song.mp3", FullName: "/a/song.mp3", IsFolder: false, Meta: &Metadata{Artist: "Band", Year: 1999}}},
+	}
+	var b bytes.Buffer
+	f := newEntryFormatter(OUTPUT_CSV, &b)
+	for i, hit := range hits {
+		f.Entry(nil, len(hits), i, hit, false, "", nil)
+	}
+	f.End()
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	wantLines := []string{
+		strings.Join(outputColumns, ","),
+		"big.log,/a/big.log,/a,2048,,,false,,,2,,1024,,,,,,,,,,,,,,,,,,,,,,,,,,1.5,\"one\ttab",
+		"two\"",
+		"x.eml,/a/b.zip!x.eml,,0,,,false,,,,,,/a/b.zip,,,alice@example.com,,,\"hi, there\",,,,,,,,,,,,,,,,,,,1,",
+		"song.mp3,/a/song.mp3,,0,,,false,,,,,,,,,,,,,,,,,,,,,,,,,,Band,,,1999,,0.5,",
+	}
+	if strings.Join(lines, "\n") != strings.Join(wantLines, "\n") {
+		t.Errorf("csv\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(wantLines, "\n"))
+	}
+
+	b.Reset()
+	f = newEntryFormatter(OUTPUT_TSV, &b)
+	f.Entry(nil, 1, 0, hits[0], false, "", nil)
+	if lines := strings.Split(b.String(), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], "\t1.5\tone\\ttab\\ntwo") {
+		t.Errorf("tsv %q", b.String())
+	}
+}
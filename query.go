@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Parser for the subset of the Lucene query syntax gotrovi supports when it
+// cannot hand the query over to Elasticsearch: terms, "phrases", field:value,
+// wildcards, ranges ([a TO b], {a TO b}, >=n...), AND/OR/NOT, +/- and
+// parenthesis. As in query_string, terms without operator are OR'ed, the
+// gotrovi query language AND's them.
+
+const (
+	QUERY_BOOL = iota
+	QUERY_ALL
+	QUERY_TERM
+	QUERY_PHRASE
+	QUERY_WILDCARD
+	QUERY_RANGE
+	QUERY_EXISTS
+)
+
+type QueryNode struct {
+	Kind  int
+	Field string // empty for the default fields
+	Value string
+	Pos   int
+	// QUERY_WILDCARD on a keyword field, matched ignoring case
+	CaseInsensitive bool
+
+	// QUERY_RANGE, empty bounds are open
+	Lower        string
+	Upper        string
+	IncludeLower bool
+	IncludeUpper bool
+
+	// QUERY_BOOL
+	Must    []*QueryNode
+	Should  []*QueryNode
+	MustNot []*QueryNode
+}
+
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query syntax error at position %d: %s", e.Pos+1, e.Msg)
+}
+
+type queryParser struct {
+	in  []rune
+	pos int
+	// terms without operator are AND'ed
+	and bool
+}
+
+const (
+	modNone = iota
+	modMust
+	modNot
+)
+
+func ParseQuery(q string) (*QueryNode, error) {
+	return parseQuery(q, false)
+}
+
+func parseQuery(q string, and bool) (*QueryNode, error) {
+	p := queryParser{in: []rune(q), and: and}
+	p.skipSpaces()
+	if p.eof() {
+		return &QueryNode{Kind: QUERY_ALL}, nil
+	}
+	n, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", string(p.in[p.pos]))
+	}
+	return n, nil
+}
+
+func (p *queryParser) errorf(format string, a ...interface{}) error {
+	return &QueryError{Pos: p.pos, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.in)
+}
+
+func (p *queryParser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(p.in[p.pos]) {
+		p.pos++
+	}
+}
+
+// keyword consumes op (AND, OR, NOT, &&, ||) if it is the next token
+func (p *queryParser) keyword(ops ...string) bool {
+	p.skipSpaces()
+	for _, op := range ops {
+		end := p.pos + len(op)
+		if end > len(p.in) || string(p.in[p.pos:end]) != op {
+			continue
+		}
+		if unicode.IsLetter([]rune(op)[0]) && end < len(p.in) && !unicode.IsSpace(p.in[end]) && p.in[end] != '(' {
+			continue
+		}
+		p.pos = end
+		return true
+	}
+	return false
+}
+
+// peekKeyword tells whether op is the next token, without consuming it
+func (p *queryParser) peekKeyword(ops ...string) bool {
+	pos := p.pos
+	found := p.keyword(ops...)
+	p.pos = pos
+	return found
+}
+
+func (p *queryParser) atGroupEnd() bool {
+	p.skipSpaces()
+	return p.eof() || p.in[p.pos] == ')'
+}
+
+type modClause struct {
+	mod  int
+	node *QueryNode
+}
+
+func wrapClauses(clauses []modClause) *QueryNode {
+	if len(clauses) == 1 && clauses[0].mod != modNot {
+		return clauses[0].node
+	}
+	b := &QueryNode{Kind: QUERY_BOOL}
+	for _, c := range clauses {
+		switch c.mod {
+		case modMust:
+			b.Must = append(b.Must, c.node)
+		case modNot:
+			b.MustNot = append(b.MustNot, c.node)
+		default:
+			b.Should = append(b.Should, c.node)
+		}
+	}
+	if len(clauses) > 0 {
+		b.Pos = clauses[0].node.Pos
+	}
+	return b
+}
+
+func (p *queryParser) parseOr(field string) (*QueryNode, error) {
+	var groups []modClause
+	for {
+		g, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+		if p.keyword("OR", "||") {
+			continue
+		}
+		if p.atGroupEnd() {
+			break
+		}
+	}
+	return wrapClauses(groups), nil
+}
+
+func (p *queryParser) parseAnd(field string) (modClause, error) {
+	var clauses []modClause
+	for {
+		c, err := p.parseClause(field)
+		if err != nil {
+			return c, err
+		}
+		clauses = append(clauses, c)
+		if p.keyword("AND", "&&") {
+			continue
+		}
+		if !p.and || p.atGroupEnd() || p.peekKeyword("OR", "||") {
+			break
+		}
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	for i := range clauses {
+		if clauses[i].mod == modNone {
+			clauses[i].mod = modMust
+		}
+	}
+	return modClause{node: wrapClauses(clauses)}, nil
+}
+
+func (p *queryParser) parseClause(field string) (modClause, error) {
+	c := modClause{}
+	p.skipSpaces()
+	if p.keyword("NOT", "!") {
+		c.mod = modNot
+	} else if !p.eof() && (p.in[p.pos] == '+' || p.in[p.pos] == '-') {
+		if p.in[p.pos] == '+' {
+			c.mod = modMust
+		} else {
+			c.mod = modNot
+		}
+		p.pos++
+	}
+	n, err := p.parsePrimary(field)
+	c.node = n
+	return c, err
+}
+
+func (p *queryParser) parsePrimary(field string) (*QueryNode, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of query")
+	}
+	start := p.pos
+
+	if p.in[p.pos] == '(' {
+		p.pos++
+		n, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.eof() || p.in[p.pos] != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return n, nil
+	}
+
+	if field == "" {
+		// field:value
+		name, ok := p.fieldName()
+		if ok {
+			if p.eof() || unicode.IsSpace(p.in[p.pos]) {
+				return nil, p.errorf("missing value for field %q", name)
+			}
+			n, err := p.parsePrimary(name)
+			if n != nil {
+				n.Pos = start
+			}
+			return n, err
+		}
+	}
+
+	switch p.in[p.pos] {
+	case '"':
+		s, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNode{Kind: QUERY_PHRASE, Field: field, Value: s, Pos: start}, nil
+	case '[', '{':
+		return p.parseRange(field)
+	case '>', '<':
+		return p.parseCompare(field)
+	case ')':
+		return nil, p.errorf("unexpected \")\"")
+	}
+
+	s, wildcard := p.word()
+	if s == "" {
+		return nil, p.errorf("unexpected %q", string(p.in[p.pos]))
+	}
+	if s == "*" {
+		if field == "" {
+			return &QueryNode{Kind: QUERY_ALL, Pos: start}, nil
+		}
+		return &QueryNode{Kind: QUERY_EXISTS, Field: field, Pos: start}, nil
+	}
+	if wildcard {
+		return &QueryNode{Kind: QUERY_WILDCARD, Field: field, Value: s, Pos: start}, nil
+	}
+	return &QueryNode{Kind: QUERY_TERM, Field: field, Value: s, Pos: start}, nil
+}
+
+// fieldName consumes "name:" if present
+func (p *queryParser) fieldName() (string, bool) {
+	i := p.pos
+	for i < len(p.in) && (unicode.IsLetter(p.in[i]) || unicode.IsDigit(p.in[i]) || p.in[i] == '_' || p.in[i] == '.') {
+		i++
+	}
+	if i == p.pos || i >= len(p.in) || p.in[i] != ':' {
+		return "", false
+	}
+	name := string(p.in[p.pos:i])
+	p.pos = i + 1
+	return name, true
+}
+
+func (p *queryParser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for !p.eof() && p.in[p.pos] != '"' {
+		if p.in[p.pos] == '\\' && p.pos+1 < len(p.in) {
+			p.pos++
+		}
+		b.WriteRune(p.in[p.pos])
+		p.pos++
+	}
+	if p.eof() {
+		p.pos = start
+		return "", p.errorf("unterminated quote")
+	}
+	p.pos++
+	return b.String(), nil
+}
+
+func isQuerySpecial(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("()[]{}\"", r)
+}
+
+// word reads an unquoted term, returns whether it has unescaped wildcards
+func (p *queryParser) word() (string, bool) {
+	var b strings.Builder
+	wildcard := false
+	for !p.eof() && !isQuerySpecial(p.in[p.pos]) {
+		r := p.in[p.pos]
+		if r == '\\' && p.pos+1 < len(p.in) {
+			p.pos++
+			r = p.in[p.pos]
+			if r == '*' || r == '?' || r == '\\' {
+				b.WriteRune('\\')
+			}
+		} else if r == '*' || r == '?' {
+			wildcard = true
+		}
+		b.WriteRune(r)
+		p.pos++
+	}
+	s := b.String()
+	if !wildcard {
+		s = strings.Replace(s, "\\", "", -1)
+	}
+	return s, wildcard
+}
+
+func (p *queryParser) bound() (string, error) {
+	p.skipSpaces()
+	if !p.eof() && p.in[p.pos] == '"' {
+		return p.quoted()
+	}
+	s, _ := p.word()
+	if s == "" {
+		return "", p.errorf("missing range bound")
+	}
+	if s == "*" {
+		s = ""
+	}
+	return s, nil
+}
+
+func (p *queryParser) parseRange(field string) (*QueryNode, error) {
+	n := &QueryNode{Kind: QUERY_RANGE, Field: field, Pos: p.pos}
+	n.IncludeLower = p.in[p.pos] == '['
+	p.pos++
+
+	var err error
+	n.Lower, err = p.bound()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("TO") {
+		return nil, p.errorf("expected TO in range")
+	}
+	// the closing bracket ends the word
+	p.skipSpaces()
+	start := p.pos
+	for !p.eof() && p.in[p.pos] != ']' && p.in[p.pos] != '}' {
+		p.pos++
+	}
+	if p.eof() {
+		return nil, p.errorf("unterminated range")
+	}
+	n.Upper = strings.Trim(strings.TrimSpace(string(p.in[start:p.pos])), "\"")
+	if n.Upper == "*" {
+		n.Upper = ""
+	}
+	n.IncludeUpper = p.in[p.pos] == ']'
+	p.pos++
+	return n, nil
+}
+
+func (p *queryParser) parseCompare(field string) (*QueryNode, error) {
+	n := &QueryNode{Kind: QUERY_RANGE, Field: field, Pos: p.pos}
+	less := p.in[p.pos] == '<'
+	p.pos++
+	inclusive := false
+	if !p.eof() && p.in[p.pos] == '=' {
+		inclusive = true
+		p.pos++
+	}
+	v, err := p.bound()
+	if err != nil {
+		return nil, err
+	}
+	if less {
+		n.Upper = v
+		n.IncludeUpper = inclusive
+	} else {
+		n.Lower = v
+		n.IncludeLower = inclusive
+	}
+	return n, nil
+}
@@ -1,18 +1,13 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/elastic/go-elasticsearch/esapi"
 	"github.com/gookit/color"
 )
 
@@ -26,6 +21,17 @@ type Source struct {
 	IsFolder  bool   `json:"isfolder"`
 	Date      string `json:"date"`
 	Mode      string `json:"mode"`
+	Chunk     int    `json:"chunk,omitempty"`
+	Chunks    int    `json:"chunks,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+	Archive   string `json:"archive,omitempty"`
+	Members   int    `json:"members,omitempty"`
+	// size of the content of compressed files
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	// headers of mail messages
+	Mail *Mail `json:"mail,omitempty"`
+	// properties of photos, music and documents
+	Meta *Metadata `json:"meta,omitempty"`
 }
 
 type Highlight struct {
@@ -36,6 +42,8 @@ type SearchHit struct {
 	Score     float64   `json:"_score"`
 	Source    Source    `json:"_source"`
 	Highlight Highlight `json:"highlight"`
+	// sort values, to continue the search after the hit
+	Sort []interface{} `json:"sort"`
 }
 
 type TotalHits struct {
@@ -49,8 +57,67 @@ type SearchHits struct {
 }
 
 type SearchResult struct {
-	ScrollId string     `json:"_scroll_id"`
-	Hits     SearchHits `json:"hits"`
+	PitId        string             `json:"pit_id"`
+	Hits         SearchHits         `json:"hits"`
+	Aggregations map[string]esValue `json:"aggregations"`
+}
+
+// Sort field for the relevance of the hits, the default
+const SORT_SCORE = "score"
+
+// Fields the hits can be sorted by
+var sortFields = []string{SORT_SCORE, "filename", "fullpath", "path", "size", "date", "extension"}
+
+type sortField struct {
+	Field string
+	Desc  bool
+}
+
+// searchOptions select which hits of a search are returned and their order
+type searchOptions struct {
+	Highlight bool
+	// maximum amount of hits, 0 for all
+	Limit int
+	// hits skipped
+	Offset int
+	// by relevance when empty
+	Sort []sortField
+	// query in Lucene syntax, the gotrovi query language otherwise
+	Raw bool
+}
+
+// parseSort parses sort specifications, field[:asc|desc] separated by
+// commas. Score is sorted descending by default, the rest ascending.
+func parseSort(specs []string) ([]sortField, error) {
+	var fields []sortField
+	for _, spec := range specs {
+		for _, spec := range strings.Split(spec, ",") {
+			if spec == "" {
+				continue
+			}
+			parts := strings.SplitN(spec, ":", 2)
+			f := sortField{Field: strings.ToLower(parts[0]), Desc: strings.ToLower(parts[0]) == SORT_SCORE}
+			valid := false
+			for _, name := range sortFields {
+				valid = valid || name == f.Field
+			}
+			if !valid {
+				return nil, fmt.Errorf("unknown sort field %q, use one of: %s", parts[0], strings.Join(sortFields, ", "))
+			}
+			if len(parts) == 2 {
+				switch strings.ToLower(parts[1]) {
+				case "asc":
+					f.Desc = false
+				case "desc":
+					f.Desc = true
+				default:
+					return nil, fmt.Errorf("unknown sort order %q, use asc or desc", parts[1])
+				}
+			}
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
 }
 
 type ES_EntryFunc func(g *Gotrovi, total int, current int, e SearchHit, boolOption bool, stringOption string, buf io.Writer)
@@ -59,16 +126,13 @@ func PrintEntry(g *Gotrovi, total int, current int, e SearchHit, bScore bool, sH
 	s := e.Source
 	score := e.Score
 
+	if current == total {
+		fmt.Fprintf(buf, "Found: %d entries\n", total)
+	}
+
 	highlightColorfn := color.FgRed.Render
-	colorfn := color.FgMagenta.Render
+	colorfn := entryColor(s)
 
-	if s.IsFolder {
-		colorfn = color.FgBlue.Render
-	} else {
-		if strings.Contains(s.Mode, "x") {
-			colorfn = color.FgGreen.Render
-		}
-	}
 	if len(e.Highlight.Field) == 0 {
 		fmt.Fprintf(buf, "%s\n", colorfn(s.FullName))
 	} else {
@@ -82,6 +146,18 @@ func PrintEntry(g *Gotrovi, total int, current int, e SearchHit, bScore bool, sH
 	}
 }
 
+// entryColor returns the color a hit is shown with: blue for folders, green
+// for executables and magenta for the rest
+func entryColor(s Source) func(a ...interface{}) string {
+	if s.IsFolder {
+		return color.FgBlue.Render
+	}
+	if strings.Contains(s.Mode, "x") {
+		return color.FgGreen.Render
+	}
+	return color.FgMagenta.Render
+}
+
 // https://stackoverflow.com/a/54198703/945568
 var pager io.WriteCloser
 
@@ -108,7 +184,14 @@ func runPager() (*exec.Cmd, io.WriteCloser) {
 	return cmd, out
 }
 
-func (gotrovi *Gotrovi) Find(name string, paths []string, score bool, highlightText string, highlightBool bool) {
+func (gotrovi *Gotrovi) Find(name string, paths []string, opts searchOptions, score bool, highlightText string, highlightBool bool, output string) {
+
+	if output != OUTPUT_TEXT {
+		f := newEntryFormatter(output, os.Stdout)
+		gotrovi.ES_Find(name, paths, opts, score, highlightText, highlightBool, f.Entry, os.Stdout)
+		f.End()
+		return
+	}
 
 	var cmd *exec.Cmd
 	cmd, pager = runPager()
@@ -117,7 +200,9 @@ func (gotrovi *Gotrovi) Find(name string, paths []string, score bool, highlightT
 		cmd.Wait()
 	}()
 
-	gotrovi.ES_Find(name, paths, score, highlightText, highlightBool, PrintEntry, pager)
+	if gotrovi.ES_Find(name, paths, opts, score, highlightText, highlightBool, PrintEntry, pager) == 0 {
+		fmt.Fprintf(pager, "Found: %d entries\n", 0)
+	}
 
 	//gotrovi.ES_Find(name, paths, score, highlightText, highlightBool, PrintEntry, os.Stdout)
 
@@ -136,130 +221,83 @@ func (gotrovi *Gotrovi) Find(name string, paths []string, score bool, highlightT
 	*/
 }
 
-func (gotrovi *Gotrovi) ES_Find(name string, paths []string, boolOption bool, highlightText string, highlightBool bool, entryFunc ES_EntryFunc, buf io.Writer) {
-	query := name
-
-	if len(paths) != 0 {
-		/*		var err error
-				dir, err = os.Getwd()
-				if err != nil {
-					Error.Println(err)
-					os.Exit(1)
-				}
-		*/
-		dir_query := "("
-		for i, element := range paths {
-			dir, err := filepath.Abs(element)
-			if err != nil {
-				Error.Println(err)
-				os.Exit(1)
-			}
-
-			dir_query = dir_query + "path:\"" + dir + "\""
-
-			if i != (len(paths) - 1) {
-				dir_query = dir_query + " OR "
-			}
+// pathsQuery builds the query restricting the results to the folders in paths
+func pathsQuery(paths []string) (string, error) {
+	dir_query := "("
+	for i, element := range paths {
+		dir, err := filepath.Abs(element)
+		if err != nil {
+			return "", err
 		}
-		dir_query = dir_query + ")"
-		query = dir_query + " AND " + query
-	}
-
-	Trace.Println(query)
-
-	highlighter := ""
-	Trace.Println("Highlight text: ", highlightText)
-	if highlightText != "" || highlightBool {
-		highlighter = "{ \"highlight\" : { \"fields\" : { \"attachment.content\" : {} } } }"
-	}
-
-	//	fmt.Println("searching " + name)
-	req := esapi.SearchRequest{
-		Index:          []string{GOTROVI_ES_INDEX}, // Index name
-		Query:          query,
-		TrackTotalHits: true,
-		Source:         []string{"filename", "fullname", "fullpath", "path", "size", "isfolder", "date", "extension", "hash", "mode"},
-		Scroll:         59 * time.Microsecond,
-		Body:           strings.NewReader(highlighter),
-		//DocvalueFields: []string{"filename", "fullname", "fullpath", "path", "size", "isfolder", "date", "extension", "hash"},
-	}
-	Trace.Println(req)
-	res, err := req.Do(context.Background(), gotrovi.es)
-	if err != nil {
-		Error.Println("Error getting response:", err)
-		os.Exit(1)
-	}
-	defer res.Body.Close()
-
-	Trace.Println(res)
 
-	body, err := ioutil.ReadAll(res.Body)
+		dir_query = dir_query + "path.tree:\"" + dir + "\""
 
-	if err != nil {
-		Error.Println(err)
-		os.Exit(1)
-	}
-
-	if res.IsError() {
-		Error.Println("ES returned Error", res)
-		Error.Println(string(body))
-		os.Exit(1)
-	}
-
-	Trace.Println(string(body))
-
-	var data SearchResult
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		Error.Println(err)
-		os.Exit(1)
+		if i != (len(paths) - 1) {
+			dir_query = dir_query + " OR "
+		}
 	}
-	total := data.Hits.Total.Value
-	current := total
+	return dir_query + ")", nil
+}
 
-	fmt.Fprintf(buf, "Found: %d entries\n", total)
+// findQuery restricts the query name to the folders in paths
+func findQuery(name string, paths []string) (string, error) {
+	query := name
 
-	for _, element := range data.Hits.Hits {
-		entryFunc(gotrovi, total, current, element, boolOption, highlightText, buf)
-		current = current - 1
-	}
-	for ok := current > 0; ok; ok = current > 0 {
-		scroll := esapi.ScrollRequest{
-			Scroll:   59 * time.Microsecond,
-			ScrollID: data.ScrollId,
-		}
-		Trace.Println(scroll)
-		res, err := scroll.Do(context.Background(), gotrovi.es)
+	if len(paths) != 0 {
+		dir_query, err := pathsQuery(paths)
 		if err != nil {
-			Error.Println("Error getting response:", err)
-			return
+			return "", err
 		}
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
+		query = dir_query + " AND (" + query + ")"
+	}
+	return query, nil
+}
 
+// find runs the query in paths calling fn for every hit, returning the amount
+// of hits
+func (gotrovi *Gotrovi) find(name string, paths []string, opts searchOptions, fn searchFunc) (int, error) {
+	// syntax errors point into name, before it is restricted to paths.
+	// Lucene queries are left for the backend to check.
+	if !opts.Raw {
+		_, err := ParseFriendlyQuery(name)
 		if err != nil {
-			Error.Println(err)
-			os.Exit(1)
+			return 0, err
 		}
+	}
+	query, err := findQuery(name, paths)
+	if err != nil {
+		return 0, err
+	}
+	Trace.Println(query)
 
-		if res.IsError() {
-			Error.Println("ES returned Error", res)
-			Error.Println(string(body))
-			os.Exit(1)
-		}
+	found := 0
+	err = gotrovi.backend.Search(query, opts, func(total int, e SearchHit) {
+		found = total
+		fn(total, e)
+	})
+	return found, err
+}
 
-		Trace.Println(string(body))
+// ES_Find calls entryFunc for every hit of the query in paths, returning the
+// amount of hits
+func (gotrovi *Gotrovi) ES_Find(name string, paths []string, opts searchOptions, boolOption bool, highlightText string, highlightBool bool, entryFunc ES_EntryFunc, buf io.Writer) int {
+	Trace.Println("Highlight text: ", highlightText)
 
-		var data SearchResult
-		err = json.Unmarshal(body, &data)
-		if err != nil {
-			Error.Println(err)
-			os.Exit(1)
+	current := -1
+	opts.Highlight = highlightText != "" || highlightBool
+	found, err := gotrovi.find(name, paths, opts, func(total int, e SearchHit) {
+		if current < 0 {
+			current = total
 		}
-
-		for _, element := range data.Hits.Hits {
-			entryFunc(gotrovi, total, current, element, boolOption, highlightText, buf)
-			current = current - 1
+		entryFunc(gotrovi, total, current, e, boolOption, highlightText, buf)
+		current = current - 1
+	})
+	if err != nil {
+		Error.Println("Error getting response:", err)
+		if mark, ok := queryErrorMark(name, err); ok {
+			fmt.Fprintln(os.Stderr, mark)
 		}
+		os.Exit(1)
 	}
+	return found
 }
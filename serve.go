@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/apoorvam/goterminal"
+	"github.com/pborman/getopt"
+)
+
+// gotrovi serve: HTTP/JSON search server with a small web page
+//
+//	GET  /                 search page
+//	GET  /api/search       q, path (repeatable), highlight, from, size, sort, raw
+//	GET  /api/doc          path, content to include the extracted text
+//	GET  /api/status       state of the last sync triggered
+//	POST /api/sync         mode, "updateFast" or "update" (default)
+//
+// Errors are returned as {"error": "..."}.
+
+const SERVE_LISTEN = "localhost:8080"
+
+// Hits returned by a search when no size is given, and the maximum size
+const SERVE_PAGE_SIZE = 20
+const SERVE_MAX_PAGE_SIZE = 1000
+
+type serveSearchResult struct {
+	Total int           `json:"total"`
+	From  int           `json:"from"`
+	Hits  []outputEntry `json:"hits"`
+}
+
+type serveSyncStatus struct {
+	ReadOnly   bool   `json:"readonly"`
+	Generation string `json:"generation"`
+	Running    bool   `json:"running"`
+	Mode       string `json:"mode,omitempty"`
+	Started    string `json:"started,omitempty"`
+	Finished   string `json:"finished,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Added      int    `json:"added"`
+	Updated    int    `json:"updated"`
+	Moved      int    `json:"moved"`
+	Deleted    int    `json:"deleted"`
+}
+
+type server struct {
+	g        *Gotrovi
+	readOnly bool
+
+	// sync status, the sync itself runs in the background
+	lock   sync.Mutex
+	status serveSyncStatus
+	// closed when the running sync is done
+	done chan struct{}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	// keep the <em> of the highlights readable
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// intParam returns the query parameter name, or def if it is not given
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func boolParam(r *http.Request, name string) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return b
+}
+
+func (s *server) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing query parameter q"))
+		return
+	}
+	from, err := intParam(r, "from", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	size, err := intParam(r, "size", SERVE_PAGE_SIZE)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if size > SERVE_MAX_PAGE_SIZE {
+		size = SERVE_MAX_PAGE_SIZE
+	}
+
+	sortBy, err := parseSort(r.URL.Query()["sort"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result := serveSearchResult{From: from, Hits: []outputEntry{}}
+	opts := searchOptions{Highlight: boolParam(r, "highlight"), Offset: from, Limit: size, Sort: sortBy, Raw: boolParam(r, "raw")}
+	result.Total, err = s.g.find(q, r.URL.Query()["path"], opts, func(total int, e SearchHit) {
+		result.Hits = append(result.Hits, outputEntry{Source: e.Source, Score: e.Score, Highlights: e.Highlight.Field})
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *server) doc(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing query parameter path"))
+		return
+	}
+	if !s.g.backend.Exists(p) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s is not indexed", p))
+		return
+	}
+	doc, err := s.g.backend.Get(p)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	doc.Data = ""
+	if doc.Attachment != nil && !boolParam(r, "content") {
+		doc.Attachment.Content = ""
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (s *server) syncStatus(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	status := s.status
+	s.lock.Unlock()
+	status.Generation = s.g.backend.Generation()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *server) startSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST to start a sync"))
+		return
+	}
+	if s.readOnly {
+		writeError(w, http.StatusForbidden, fmt.Errorf("the server is read only"))
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "update"
+	}
+	if mode != "update" && mode != "updateFast" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown sync mode %q, use update or updateFast", mode))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status.Running {
+		writeError(w, http.StatusConflict, fmt.Errorf("a sync is already running"))
+		return
+	}
+	s.status = serveSyncStatus{ReadOnly: s.readOnly, Running: true, Mode: mode, Started: fileDate(time.Now())}
+	s.done = make(chan struct{})
+	go s.sync(mode)
+	status := s.status
+	status.Generation = s.g.backend.Generation()
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// sync runs an update, as gotrovi -s does
+func (s *server) sync(mode string) {
+	g := s.g
+	Info.Println("Sync", mode, "started")
+	g.cp = newCheckpoint(mode)
+	g.startIndexer()
+	err := g.SyncUpdate(mode == "update")
+	if err == errInterrupted {
+		// the server is stopping, the sync is resumed with --resume
+		g.exitInterrupted()
+	}
+	if ierr := g.stopIndexer(); err == nil {
+		err = ierr
+	}
+	removeCheckpoint()
+	g.cp = nil
+	if err != nil {
+		Error.Println("Sync failed:", err)
+	} else {
+		Info.Println("Sync done:", g.summary)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Running = false
+	s.status.Finished = fileDate(time.Now())
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+	s.status.Added = g.summary.added
+	s.status.Updated = g.summary.updated
+	s.status.Moved = g.summary.moved
+	s.status.Deleted = g.summary.deleted
+	close(s.done)
+}
+
+func (s *server) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, SERVE_PAGE)
+}
+
+// logRequests logs every request at the trace level
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Trace.Println(r.RemoteAddr, r.Method, r.URL)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (gotrovi *Gotrovi) Serve(args []string) {
+	opts := getopt.New()
+	opts.SetProgram("gotrovi serve")
+	opts.SetParameters("")
+	optHelp := opts.BoolLong("help", 'h', "Show this message")
+	optListen := opts.StringLong("listen", 'l', SERVE_LISTEN, "Address to listen on. Default is "+SERVE_LISTEN+", use :8080 to listen on every interface")
+	optReadOnly := opts.BoolLong("read-only", 'r', "Do not allow starting syncs")
+	opts.Parse(args)
+
+	if *optHelp {
+		fmt.Println("Serves searches of the index over HTTP, with a search page at / and a JSON API at /api")
+		opts.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+
+	// progress counters make no sense for a long running process
+	gotrovi.writer = goterminal.New(ioutil.Discard)
+	gotrovi.InitHash()
+
+	s := &server{g: gotrovi, readOnly: *optReadOnly}
+	s.status.ReadOnly = s.readOnly
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.page)
+	mux.HandleFunc("/api/search", s.search)
+	mux.HandleFunc("/api/doc", s.doc)
+	mux.HandleFunc("/api/status", s.syncStatus)
+	mux.HandleFunc("/api/sync", s.startSync)
+	srv := &http.Server{Addr: *optListen, Handler: logRequests(mux)}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		Info.Println("Received", sig, "stopping server")
+		srv.Shutdown(context.Background())
+	}()
+
+	fmt.Println("Serving on http://" + *optListen)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		Error.Println(err)
+		os.Exit(1)
+	}
+
+	s.lock.Lock()
+	running := s.status.Running
+	done := s.done
+	s.lock.Unlock()
+	if running {
+		// the sync saves a checkpoint for --resume and exits, unless it is
+		// about to finish
+		atomic.StoreInt32(&gotrovi.interrupted, 1)
+		<-done
+	}
+}
+
+// Search page, the highlights are the only markup taken from the results
+const SERVE_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>gotrovi</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+form { display: flex; gap: .5em; }
+input[type=text] { flex: 1; font-size: 1.1em; padding: .3em; }
+#info { color: #777; margin: .8em 0; }
+.hit { margin: 1em 0; }
+.path { font-family: monospace; color: #a0a; word-break: break-all; }
+.folder { color: #22c; }
+.exec { color: #080; }
+.meta { color: #777; font-size: .85em; }
+.snippet { font-family: monospace; font-size: .9em; margin: .2em 0 .2em 1em; white-space: pre-wrap; }
+em { color: #c00; font-style: normal; font-weight: bold; }
+#pages button, #sync { margin-right: .5em; }
+</style>
+</head>
+<body>
+<form id="search">
+<input type="text" id="q" placeholder="query, e.g. test ext:txt modified:<7d" autofocus>
+<input type="text" id="path" placeholder="in folder" style="flex: .4">
+<button>Search</button>
+</form>
+<div id="info"></div>
+<div id="hits"></div>
+<div id="pages"><button id="prev">Previous</button><button id="next">Next</button></div>
+<p class="meta"><span id="status"></span> <button id="sync" hidden>Sync now</button></p>
+<script>
+var size = 20, from = 0;
+function $(id) { return document.getElementById(id); }
+function escape(s) {
+  return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+}
+function snippet(s) {
+  return escape(s).replace(/&lt;(\/?)em&gt;/g, "<$1em>");
+}
+function search() {
+  var params = new URLSearchParams({q: $("q").value, highlight: "true", from: from, size: size});
+  if ($("path").value) params.append("path", $("path").value);
+  fetch("api/search?" + params).then(function (r) { return r.json(); }).then(function (res) {
+    if (res.error) { $("info").textContent = res.error; $("hits").innerHTML = ""; return; }
+    $("info").textContent = res.total ? "Found " + res.total + ", showing " + (from + 1) + "-" + (from + res.hits.length) : "Found 0";
+    $("hits").innerHTML = res.hits.map(function (h) {
+      var cls = h.isfolder ? "path folder" : h.mode.indexOf("x") >= 0 ? "path exec" : "path";
+      return '<div class="hit"><div class="' + cls + '">' + escape(h.fullpath) + '</div>' +
+        '<div class="meta">' + h.size + ' bytes, ' + escape(h.date) + '</div>' +
+        (h.highlights || []).map(function (s) { return '<div class="snippet">' + snippet(s) + '</div>'; }).join("") + '</div>';
+    }).join("");
+    $("prev").disabled = from == 0;
+    $("next").disabled = from + size >= res.total;
+  });
+}
+function status() {
+  fetch("api/status").then(function (r) { return r.json(); }).then(function (s) {
+    var text = "Index " + s.generation;
+    if (s.running) text += ", sync running since " + s.started;
+    else if (s.error) text += ", last sync " + s.finished + " failed: " + s.error;
+    else if (s.finished) text += ", last sync " + s.finished + ": " + s.added + " added, " + s.updated + " updated, " + s.moved + " moved, " + s.deleted + " deleted";
+    $("status").textContent = text;
+    $("sync").hidden = s.readonly;
+    $("sync").disabled = s.running;
+    if (s.running) setTimeout(status, 2000);
+  });
+}
+$("search").onsubmit = function (e) { e.preventDefault(); from = 0; search(); };
+$("prev").onclick = function () { from = Math.max(0, from - size); search(); };
+$("next").onclick = function () { from += size; search(); };
+$("sync").onclick = function () { fetch("api/sync", {method: "POST"}).then(status); };
+$("prev").disabled = $("next").disabled = true;
+status();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Local record of the indexed files, so update can diff the filesystem
+// against it without querying the index. It is kept as a gob file in
+// GOTROVI_SETTINGS_FOLDER and rebuilt from the index when it is missing,
+// corrupt or belongs to another generation of the index. The files indexed
+// by a forced sync are kept apart until the new generation replaces the
+// current one, so an aborted or interrupted reindex leaves the state of the
+// current generation untouched.
+
+const STATE_FILE = "state.gob"
+const STATE_VERSION = 1
+
+type fileState struct {
+	Size     int64
+	Date     string
+	Inode    uint64
+	Hash     string
+	IsFolder bool
+	// chunk documents of the file, see chunk.go
+	Chunks int
+	// members of the archive, see archive.go
+	Members int
+	// index generation the file was indexed into
+	Generation string
+}
+
+type syncStateData struct {
+	Version int
+	Files   map[string]fileState
+	// generation being built by a forced sync and its files
+	Building string
+	Next     map[string]fileState
+}
+
+type syncState struct {
+	file  string
+	lock  sync.Mutex
+	data  syncStateData
+	dirty bool
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+func newSyncState(file string) *syncState {
+	s := &syncState{file: file}
+	s.reset()
+	return s
+}
+
+func (s *syncState) reset() {
+	s.data = syncStateData{Version: STATE_VERSION, Files: make(map[string]fileState)}
+	s.dirty = true
+}
+
+// load reads the state file, returning an error if it is missing or corrupt
+func (s *syncState) load() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.Open(s.file)
+	if err != nil {
+		s.reset()
+		return err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&s.data)
+	if err == nil && s.data.Version != STATE_VERSION {
+		err = fmt.Errorf("version %d, expected %d", s.data.Version, STATE_VERSION)
+	}
+	if err != nil || s.data.Files == nil {
+		s.reset()
+		return fmt.Errorf("sync state %s is corrupt or outdated: %v", s.file, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *syncState) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	tmp := s.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&s.data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, s.file)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *syncState) get(p string) (fileState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, ok := s.data.Files[p]
+	return f, ok
+}
+
+func (s *syncState) set(p string, f fileState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data.Files[p] = f
+	s.dirty = true
+}
+
+func (s *syncState) remove(p string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.data.Files[p]; ok {
+		delete(s.data.Files, p)
+		s.dirty = true
+	}
+}
+
+// getGeneration returns the state of p in generation, which may be the one
+// being built
+func (s *syncState) getGeneration(p string, generation string) (fileState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files := s.data.Files
+	if s.data.Building != "" && generation == s.data.Building {
+		files = s.data.Next
+	}
+	f, ok := files[p]
+	return f, ok
+}
+
+// paths returns every recorded path
+func (s *syncState) paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	paths := make([]string, 0, len(s.data.Files))
+	for p := range s.data.Files {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// pathsUnder returns the recorded paths inside the folder p
+func (s *syncState) pathsUnder(p string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var paths []string
+	for f := range s.data.Files {
+		if strings.HasPrefix(f, p+"/") {
+			paths = append(paths, f)
+		}
+	}
+	return paths
+}
+
+// prune drops the files indexed into other generations and returns the
+// amount of files left
+func (s *syncState) prune(generation string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for p, f := range s.data.Files {
+		if f.Generation != generation {
+			delete(s.data.Files, p)
+			s.dirty = true
+		}
+	}
+	return len(s.data.Files)
+}
+
+// begin starts recording the files of generation apart, keeping those
+// already recorded if it is resumed
+func (s *syncState) begin(generation string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.data.Building != generation || s.data.Next == nil {
+		s.data.Building = generation
+		s.data.Next = make(map[string]fileState)
+		s.dirty = true
+	}
+}
+
+// finish replaces the files with those of the generation built
+func (s *syncState) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.data.Next != nil {
+		s.data.Files = s.data.Next
+	}
+	s.data.Building = ""
+	s.data.Next = nil
+	s.dirty = true
+}
+
+// abort drops the files of the generation being built
+func (s *syncState) abort() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data.Building = ""
+	s.data.Next = nil
+	s.dirty = true
+}
+
+// indexed records a document stored in generation
+func (s *syncState) indexed(item bulkItem, generation string) {
+	f := fileState{
+		Size:       item.doc.Size,
+		Date:       item.doc.Date,
+		Hash:       item.doc.Hash,
+		IsFolder:   item.doc.IsFolder,
+		Chunks:     item.doc.Chunks,
+		Members:    item.doc.Members,
+		Generation: generation,
+	}
+	if item.info != nil {
+		f.Inode = fileInode(item.info)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.data.Building != "" && generation == s.data.Building {
+		s.data.Next[item.path] = f
+	} else {
+		s.data.Files[item.path] = f
+	}
+	s.dirty = true
+}
+
+// rebuild fills the state with the documents in the index
+func (s *syncState) rebuild(b Backend) error {
+	s.lock.Lock()
+	s.reset()
+	s.lock.Unlock()
+
+	generation := b.Generation()
+	return b.ScrollAll(func(total int, e SearchHit) {
+		if isArchived(e.Source) {
+			return
+		}
+		s.set(e.Source.FullName, fileState{
+			Size:       e.Source.Size,
+			Date:       e.Source.Date,
+			Hash:       e.Source.Hash,
+			IsFolder:   e.Source.IsFolder,
+			Chunks:     e.Source.Chunks,
+			Members:    e.Source.Members,
+			Generation: generation,
+		})
+	})
+}
+
+func (gotrovi *Gotrovi) OpenState() {
+	gotrovi.state = newSyncState(GOTROVI_SETTINGS_FOLDER + STATE_FILE)
+	err := gotrovi.state.load()
+	if err != nil && !os.IsNotExist(err) {
+		Warning.Println(err)
+	}
+}
+
+// checkState makes sure the state matches the current generation of the
+// index, rebuilding it from the index otherwise
+func (gotrovi *Gotrovi) checkState() error {
+	if gotrovi.state.prune(gotrovi.backend.Generation()) > 0 {
+		return nil
+	}
+	Info.Println("Rebuilding sync state from the index")
+	err := gotrovi.state.rebuild(gotrovi.backend)
+	if err != nil {
+		return fmt.Errorf("unable to rebuild sync state: %v", err)
+	}
+	return nil
+}
+
+func (gotrovi *Gotrovi) saveState() {
+	err := gotrovi.state.save()
+	if err != nil {
+		Error.Println("Unable to save sync state:", err)
+	}
+}
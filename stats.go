@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pborman/getopt"
+)
+
+// gotrovi stats: what is in the index, and with --du the space used by each
+// folder according to the index, without reading the disk
+
+// Extensions, content types and languages listed, the rest are counted
+// together as STATS_OTHER
+const STATS_TOP = 20
+const STATS_OTHER = "(other)"
+
+// Shown for files without extension, content type or language
+const STATS_NONE = "(none)"
+
+// Largest files listed
+const STATS_LARGEST = 10
+
+// Folder levels shown by --du below the given paths
+const STATS_DU_DEPTH = 2
+
+type statsCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"`
+}
+
+type statsFile struct {
+	FullName string `json:"fullpath"`
+	Size     int64  `json:"size"`
+}
+
+// indexStats counts the files, not the folders, except for Folders
+type indexStats struct {
+	Files   int   `json:"files"`
+	Folders int   `json:"folders"`
+	Size    int64 `json:"size"`
+	// dates of the oldest and newest files
+	Oldest string `json:"oldest,omitempty"`
+	Newest string `json:"newest,omitempty"`
+	// files indexed without content as the extraction failed
+	ExtractionFailed int          `json:"extraction_failed"`
+	Largest          []statsFile  `json:"largest"`
+	IndexFolders     []statsCount `json:"index_folders"`
+	Extensions       []statsCount `json:"extensions"`
+	ContentTypes     []statsCount `json:"content_types"`
+	Languages        []statsCount `json:"languages"`
+}
+
+// topCounts sorts counts by amount of files, adding up those beyond the
+// first n as STATS_OTHER
+func topCounts(counts map[string]*statsCount, n int) []statsCount {
+	list := make([]statsCount, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, *c)
+	}
+	sortCounts(list)
+	if len(list) <= n {
+		return list
+	}
+	other := statsCount{Key: STATS_OTHER}
+	for _, c := range list[n:] {
+		other.Count = other.Count + c.Count
+		other.Size = other.Size + c.Size
+	}
+	return append(list[:n], other)
+}
+
+func sortCounts(list []statsCount) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+}
+
+// duEntry is a folder of the --du tree, with the files below it
+type duEntry struct {
+	Path    string     `json:"path"`
+	Files   int        `json:"files"`
+	Size    int64      `json:"size"`
+	Folders []*duEntry `json:"folders,omitempty"`
+}
+
+// duTree adds up the files of each folder into its parents, returning the
+// entries of roots
+func duTree(roots []string, usage map[string]statsCount) []*duEntry {
+	all := make(map[string]*duEntry)
+	entry := func(p string) *duEntry {
+		e, ok := all[p]
+		if !ok {
+			e = &duEntry{Path: p}
+			all[p] = e
+		}
+		return e
+	}
+	for p, u := range usage {
+		for {
+			e := entry(p)
+			e.Files = e.Files + u.Count
+			e.Size = e.Size + u.Size
+			parent := filepath.Dir(p)
+			if parent == p {
+				break
+			}
+			p = parent
+		}
+	}
+	for p, e := range all {
+		if parent := filepath.Dir(p); parent != p {
+			all[parent].Folders = append(all[parent].Folders, e)
+		}
+	}
+	for _, e := range all {
+		sort.Slice(e.Folders, func(i, j int) bool {
+			if e.Folders[i].Size != e.Folders[j].Size {
+				return e.Folders[i].Size > e.Folders[j].Size
+			}
+			return e.Folders[i].Path < e.Folders[j].Path
+		})
+	}
+
+	var entries []*duEntry
+	for _, root := range roots {
+		e, ok := all[root]
+		if !ok {
+			e = &duEntry{Path: root}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// pruneDu keeps depth levels of folders, e being the first
+func pruneDu(e *duEntry, depth int) {
+	if depth == 1 {
+		e.Folders = nil
+		return
+	}
+	for _, f := range e.Folders {
+		pruneDu(f, depth-1)
+	}
+}
+
+func printDu(w *tabwriter.Writer, e *duEntry, indent string) {
+	fmt.Fprintf(w, "%s\t%d\t%s%s\n", humanSize(e.Size), e.Files, indent, e.Path)
+	for _, f := range e.Folders {
+		printDu(w, f, indent+"  ")
+	}
+}
+
+func noneKey(key string) string {
+	if key == "" {
+		return STATS_NONE
+	}
+	return key
+}
+
+func printCounts(w *tabwriter.Writer, title string, counts []statsCount) {
+	fmt.Fprintf(w, "\n%s\tFiles\tSize\n", title)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", noneKey(c.Key), c.Count, humanSize(c.Size))
+	}
+}
+
+func printStats(w *tabwriter.Writer, stats *indexStats) {
+	fmt.Fprintf(w, "Files\t%d\n", stats.Files)
+	fmt.Fprintf(w, "Folders\t%d\n", stats.Folders)
+	fmt.Fprintf(w, "Size\t%s\n", humanSize(stats.Size))
+	if stats.Oldest != "" {
+		fmt.Fprintf(w, "Oldest\t%s\n", stats.Oldest)
+		fmt.Fprintf(w, "Newest\t%s\n", stats.Newest)
+	}
+	fmt.Fprintf(w, "Extraction failed\t%d\n", stats.ExtractionFailed)
+
+	printCounts(w, "Index folder", stats.IndexFolders)
+	printCounts(w, "Extension", stats.Extensions)
+	printCounts(w, "Content type", stats.ContentTypes)
+	printCounts(w, "Language", stats.Languages)
+
+	fmt.Fprintf(w, "\nLargest files\n")
+	for _, f := range stats.Largest {
+		fmt.Fprintf(w, "%s\t%s\n", humanSize(f.Size), f.FullName)
+	}
+}
+
+func (gotrovi *Gotrovi) Stats(args []string) {
+	opts := getopt.New()
+	opts.SetProgram("gotrovi stats")
+	opts.SetParameters("[paths ...]")
+	optHelp := opts.BoolLong("help", 'h', "Show this message")
+	optDu := opts.BoolLong("du", 0, "Show the size of each folder as a tree, like du")
+	optDepth := opts.IntLong("depth", 'd', STATS_DU_DEPTH, fmt.Sprintf("Folder levels shown by --du, 0 for all. Default is %d", STATS_DU_DEPTH))
+	optOutput := opts.StringLong("output", 'o', OUTPUT_TEXT, "Output format: \"text\" (default) or \"json\"")
+	opts.Parse(args)
+
+	if *optHelp {
+		fmt.Println("Summarizes the indexed files in the given paths or the whole index: counts per index folder, extension, content type and language, sizes, dates and extraction failures. Only the index is read, not the disk")
+		opts.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if *optOutput != OUTPUT_TEXT && *optOutput != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "Unknown output format \""+*optOutput+"\", use text or json")
+		os.Exit(1)
+	}
+
+	// the index folders, or the paths given
+	var folders []string
+	for _, index := range gotrovi.conf.Index {
+		folders = append(folders, index.Folder)
+	}
+	query := "*"
+	if opts.NArgs() != 0 {
+		folders = nil
+		for _, p := range opts.Args() {
+			dir, err := filepath.Abs(p)
+			if err != nil {
+				Error.Println(err)
+				os.Exit(1)
+			}
+			folders = append(folders, dir)
+		}
+		dir_query, err := pathsQuery(folders)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		query = dir_query
+	}
+	Trace.Println(query)
+
+	output := func(result interface{}, print func(w *tabwriter.Writer)) {
+		if *optOutput == OUTPUT_JSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(result)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		print(w)
+		w.Flush()
+	}
+
+	reporter, ok := gotrovi.backend.(statsReporter)
+	if !ok {
+		Error.Println("The " + gotrovi.backendName() + " backend has no statistics")
+		os.Exit(1)
+	}
+
+	if *optDu {
+		usage := make(map[string]statsCount)
+		err := reporter.FolderUsage(query, func(path string, files int, size int64) {
+			usage[path] = statsCount{Key: path, Count: files, Size: size}
+		})
+		if err != nil {
+			Error.Println("Unable to get the folder sizes:", err)
+			os.Exit(1)
+		}
+		entries := duTree(folders, usage)
+		for _, e := range entries {
+			if *optDepth > 0 {
+				pruneDu(e, *optDepth+1)
+			}
+		}
+		output(entries, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Size\tFiles\tFolder\n")
+			for _, e := range entries {
+				printDu(w, e, "")
+			}
+		})
+		return
+	}
+
+	stats, err := reporter.Stats(query, folders)
+	if err != nil {
+		Error.Println("Unable to get the index statistics:", err)
+		os.Exit(1)
+	}
+	output(stats, func(w *tabwriter.Writer) {
+		printStats(w, stats)
+	})
+}
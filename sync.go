@@ -1,225 +1,78 @@
 package main
 
 import (
-	"bufio"
-	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
 
 	"path/filepath"
-
-	"github.com/elastic/go-elasticsearch/esapi"
+	"time"
 )
 
 type folderOperation func(*Gotrovi, os.FileInfo, string)
 
-func (gotrovi *Gotrovi) initializePipelineAttachment() {
-
-	// configure Elastic
-	body := "{ \"description\" : \"Extract attachment information\", \"processors\" : [ { \"attachment\" : { \"field\" : \"data\" }, \"remove\": { \"field\": \"data\" } } ] }"
-
-	req := esapi.IngestPutPipelineRequest{DocumentID: "attachment", Body: strings.NewReader(body)}
-	res, err := req.Do(context.Background(), gotrovi.es)
-	if err != nil {
-		Error.Println(err)
-	}
-	res.Body.Close()
+// vanishedFile is an indexed file no longer present
+type vanishedFile struct {
+	path  string
+	state fileState
+}
 
-	if res.IsError() {
-		Error.Println("Unable to set pipeline attachement")
-		Error.Println(err)
-		os.Exit(1)
-	}
+// syncSummary counts the changes done by an update
+type syncSummary struct {
+	added   int
+	updated int
+	moved   int
+	deleted int
+}
 
+func (s syncSummary) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d moved, %d deleted", s.added, s.updated, s.moved, s.deleted)
 }
 
 func (gotrovi *Gotrovi) DeleteIndex() {
-	Trace.Println("Deleting index" + GOTROVI_ES_INDEX)
-	// Delete index to start from scratch
-	req := esapi.IndicesDeleteRequest{Index: []string{GOTROVI_ES_INDEX}}
-	res, err := req.Do(context.Background(), gotrovi.es)
+	err := gotrovi.backend.DeleteIndex()
 	if err != nil {
 		Error.Println(err)
 	}
-	res.Body.Close()
 }
 
 func count(g *Gotrovi, info os.FileInfo, p string) {
 	g.total = g.total + 1
 }
 
-func putDoc(g *Gotrovi, r esapi.IndexRequest) (*http.Response, error) {
+func deleteFileDoc(g *Gotrovi, p string) error {
+	Info.Println("Delete file from index ", p)
+	Info.Println()
 
-	// initialize http client
-	client := &http.Client{}
-
-	// marshal User to json
-	//	json, err := json.Marshal(r.Body)
-	//	if err != nil {
-	//		panic(err)
-	//	}
-
-	// set the HTTP method, url, and request body
-	req, err := http.NewRequest(http.MethodPut, "http://"+g.conf.ElasticSearch.Host+":"+strconv.Itoa(g.conf.ElasticSearch.Port)+"/"+GOTROVI_ES_INDEX+"/_doc/"+string(r.DocumentID)+"?pipeline=attachment", r.Body)
+	err := g.backend.Delete(p)
 	if err != nil {
-		Error.Println(err)
-	}
-
-	// set the request header Content-Type for json
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	resp, err := client.Do(req)
-	if err != nil {
-		Error.Println(err)
-	}
-	return resp, err
-}
-
-func deleteDoc(g *Gotrovi, r esapi.DeleteRequest) (*http.Response, error) {
-
-	// initialize http client
-	client := &http.Client{}
-
-	// marshal User to json
-	//	json, err := json.Marshal(r.Body)
-	//	if err != nil {
-	//		panic(err)
-	//	}
-
-	// set the HTTP method, url, and request body
-	req, err := http.NewRequest(http.MethodDelete, "http://"+g.conf.ElasticSearch.Host+":"+strconv.Itoa(g.conf.ElasticSearch.Port)+"/"+GOTROVI_ES_INDEX+"/_doc/"+string(r.DocumentID), nil)
-	if err != nil {
-		Error.Println(err)
-	}
-
-	// set the request header Content-Type for json
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	resp, err := client.Do(req)
-	if err != nil {
-		Error.Println(err)
-	}
-	defer resp.Body.Close()
-	return resp, err
-}
-
-func docExists(g *Gotrovi, r esapi.GetRequest) (exists bool) {
-
-	// initialize http client
-	client := &http.Client{}
-
-	// set the HTTP method, url, and request body
-	req, err := http.NewRequest(http.MethodGet, "http://"+g.conf.ElasticSearch.Host+":"+strconv.Itoa(g.conf.ElasticSearch.Port)+"/"+GOTROVI_ES_INDEX+"/_doc/"+string(r.DocumentID), nil)
-	if err != nil {
-		Error.Println(err)
-		return false
+		Error.Println("Error deleting document:", p, err)
+		Error.Println()
+		return err
 	}
-
-	// set the request header Content-Type for json
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
+	if st, ok := g.state.get(p); ok && st.Chunks > 1 {
+		err = g.backend.DeleteChunks(p, 1)
 		if err != nil {
-			Error.Println(err)
+			Error.Println("Error deleting the chunks of:", p, err)
+			return err
 		}
-		return false
-	}
-	resp.Body.Close()
-	return true
-}
-
-func sendToEs(g *Gotrovi, req esapi.IndexRequest, p string) {
-	defer g.wg.Done()
-
-	// Cannot use the IndexRequest directly because esapi has issues handling forward slashes
-	res, err := putDoc(g, req)
-	if err != nil {
-		Error.Println("Sync", p, ": Error getting response:", err)
-		Error.Println()
-		return
 	}
-	defer res.Body.Close()
-
-	Trace.Println(res)
-	if res.StatusCode != 201 && res.StatusCode != 200 {
-		Error.Println("ES returned Error with file: ", p)
-		body, _ := ioutil.ReadAll(res.Body)
-		Error.Println("Error: ", string(body))
-		Error.Println()
-		return
+	if st, ok := g.state.get(p); ok && st.Members > 0 {
+		err = g.backend.DeleteMembers(p)
+		if err != nil {
+			Error.Println("Error deleting the members of:", p, err)
+			return err
+		}
 	}
+	g.state.remove(p)
+	return nil
 }
 
 func sync_file(g *Gotrovi, info os.FileInfo, p string) {
 	Trace.Println("Sync File: " + p)
 
-	var file FileDescriptionDoc
-
-	file.Data = ""
-	file.FileName = info.Name()
-	file.Path = filepath.Dir(p)
-	file.FullName = p
-	file.Size = 0
-	file.Extension = ""
-	file.Hash = ""
-	file.IsFolder = info.IsDir()
-	file.Date = info.ModTime().String()
-	file.Mode = info.Mode().String()
-
-	if !info.IsDir() {
-		f, err := os.Open(p)
-		if err != nil {
-			Error.Println(err)
-			Error.Println()
-		}
-		defer f.Close()
-
-		if _, err := io.Copy(g.hash, f); err != nil {
-			Error.Println(err)
-			Error.Println()
-		}
-		sum := g.hash.Sum(nil)
-
-		f.Seek(0, io.SeekStart)
-
-		// Read entire file into byte slice.
-		reader := bufio.NewReader(f)
-		content, _ := ioutil.ReadAll(reader)
-
-		// Encode as base64.
-		file.Data = base64.StdEncoding.EncodeToString(content)
-		file.Size = info.Size()
-		file.Extension = filepath.Ext(info.Name())
-		file.Hash = fmt.Sprintf("%x", sum)
-		g.hash.Reset()
-		f.Close()
-	}
-
-	b, err := json.Marshal(file)
-	if err != nil {
-		Error.Println(err)
-		Error.Println()
-		return
-	}
-
-	//	fmt.Println(string(b))
-	req := esapi.IndexRequest{
-		Index:      GOTROVI_ES_INDEX,             // Index name
-		Body:       strings.NewReader(string(b)), // Document body
-		DocumentID: url.QueryEscape(p),           // url.QueryEscape(fmt.Sprintf("%x", g.hash.Sum([]byte(p)))), // strings.Replace(p, "/", "%2F", -1), // Document ID
-		Pipeline:   "attachment",
-		Refresh:    "true", // Refresh
-	}
-
-	g.wg.Add(1)
-	g.wait = g.wait + 1
-	go sendToEs(g, req, p)
+	g.indexer.queue(info, p)
 
 	g.writer.Clear()
 	fmt.Fprintf(g.writer, "Synchronizing (%d/%d) files...\n", g.count, g.total)
@@ -227,73 +80,46 @@ func sync_file(g *Gotrovi, info os.FileInfo, p string) {
 	g.writer.Print()
 
 	g.count = g.count + 1
-
-	if g.wait >= g.jobs {
-		g.wg.Wait()
-		g.wait = 0
-	}
-
 }
 
-func addMissing(g *Gotrovi, info os.FileInfo, p string) {
-	Trace.Println("Checking if file exists in ES: " + p)
-
-	req := esapi.GetRequest{
-		Index:      GOTROVI_ES_INDEX,   // Index name
-		DocumentID: url.QueryEscape(p), // url.QueryEscape(fmt.Sprintf("%x", g.hash.Sum([]byte(p)))), // strings.Replace(p, "/", "%2F", -1), // Document ID
-	}
-	if !docExists(g, req) {
-		Info.Println("Adding file: ", p)
-		Info.Println()
-		sync_file(g, info, p)
-		g.added = g.added + 1
+// isExcluded applies the exclusion rules to path, see ignore.go. skipDir is
+// set when path is a folder whose contents should not be walked.
+func (gotrovi *Gotrovi) isExcluded(id int, info os.FileInfo, path string) (excluded bool, skipDir bool) {
+	r := gotrovi.exclusion(id, info, path)
+	if r == nil {
+		return false, false
 	}
-
-	g.writer.Clear()
-	fmt.Fprintf(g.writer, "Checking for new files (%d/%d). %d files added...\n", g.count, g.total, g.added)
-	// write to terminal
-	g.writer.Print()
-
-	g.count = g.count + 1
-
+	Trace.Println("Skipping "+path+" (", r, ")")
+	return true, info.IsDir()
 }
 
 func (gotrovi *Gotrovi) PerformFolderOperation(id int, fo folderOperation) {
 	f := gotrovi.conf.Index[id].Folder
+	cp := gotrovi.cp
+	if cp != nil && id < cp.Index {
+		// completed before the sync was interrupted
+		return
+	}
 
 	err := filepath.Walk(f, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			Error.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
 			return filepath.SkipDir
 		}
-		if info.Mode()&os.ModeSymlink != 0 {
-			Trace.Println("Skipping symlink: " + path)
-			return filepath.SkipDir
+		if gotrovi.isInterrupted() {
+			return errInterrupted
 		}
-		if info.IsDir() {
-			for i := 0; i < len(gotrovi.conf.Index[id].Exclude); i++ {
-				if path == gotrovi.conf.Index[id].Exclude[i] {
-					Trace.Println("Skipping Folder (fullpath) " + path)
-					return filepath.SkipDir
-				}
-			}
-			for i := 0; i < len(gotrovi.conf.Exclude.Folder); i++ {
-				if info.Name() == gotrovi.conf.Exclude.Folder[i] {
-					Trace.Println("Skipping Folder (name) " + path)
-					return filepath.SkipDir
-				}
+		if done, skipDir := cp.skip(id, path, info.IsDir()); done {
+			if skipDir {
+				return filepath.SkipDir
 			}
+			return nil
 		}
-		// exclude extensions
-		for i := 0; i < len(gotrovi.conf.Exclude.Extension); i++ {
-			if filepath.Ext(path) == gotrovi.conf.Exclude.Extension[i] {
-				Trace.Println("Skipping (ext) " + path)
-				return nil
-			}
+		excluded, skipDir := gotrovi.isExcluded(id, info, path)
+		if skipDir {
+			return filepath.SkipDir
 		}
-
-		if info.Size() > gotrovi.conf.Exclude.Size {
-			Trace.Println("Skipping (size) " + path)
+		if excluded {
 			return nil
 		}
 
@@ -301,84 +127,179 @@ func (gotrovi *Gotrovi) PerformFolderOperation(id int, fo folderOperation) {
 
 		fo(gotrovi, info, path)
 
+		if cp != nil && time.Since(cp.saved) >= CHECKPOINT_TIME {
+			gotrovi.saveCheckpoint()
+		}
 		return nil
 	})
-	if err != nil {
+	if err != nil && err != errInterrupted {
 		Error.Println(err)
 	}
 }
 
-func UpdateEntries(g *Gotrovi, total int, current int, e SearchHit, useHash bool, stringOption string, buf io.Writer) {
-	// check if entry still exists and delete it from ES if not
-
-	info, err := os.Stat(e.Source.FullName)
+func hashFile(h hash.Hash, p string) (string, error) {
+	f, err := os.Open(p)
 	if err != nil {
-		Error.Println("Error getting file Stat " + e.Source.FullName)
-		Error.Println("Error: ", err)
-		Error.Println()
-		return
+		return "", err
 	}
-	if os.IsNotExist(err) {
-		// file no longer present. Delete the document from ES
-		Info.Println("Delete file from ES ", e.Source.FullName)
-		Info.Println()
+	defer f.Close()
 
-		req := esapi.DeleteRequest{
-			Index:      GOTROVI_ES_INDEX, // Index name
-			DocumentID: url.QueryEscape(e.Source.FullName),
-		}
-		// Cannot use the DeleteRequest directly because esapi has issues handling forward slashes
-		res, err := deleteDoc(g, req)
-
-		if err != nil || res.StatusCode != 200 {
-			Error.Println("Error getting response:", err, res)
-			Error.Println()
-			return
-		}
-		res.Body.Close()
-	} else {
-		syncFile := false
-		// Check if file has changed
-		if useHash && !info.IsDir() {
-			f, err := os.Open(e.Source.FullName)
-			if err != nil {
-				Error.Println(err)
-			}
-			defer f.Close()
-
-			if _, err := io.Copy(g.hash, f); err != nil {
-				Error.Println(err)
-			}
-			sum := g.hash.Sum(nil)
+	h.Reset()
+	defer h.Reset()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-			f.Close()
+// updateEntry compares a file on disk with its sync state and resyncs it if
+// changed. Files not in the state are kept for addCreated.
+func updateEntry(g *Gotrovi, info os.FileInfo, p string, useHash bool) {
+	st, ok := g.state.get(p)
+	if !ok {
+		g.created = append(g.created, fileJob{info: info, path: p})
+	} else if g.changed(st, info, p, useHash) {
+		Info.Println("Resync file ", p)
+		Info.Println()
+		sync_file(g, info, p)
+		g.summary.updated = g.summary.updated + 1
+		return
+	} else if st.Inode == 0 {
+		// state rebuilt from the index
+		st.Inode = fileInode(info)
+		g.state.set(p, st)
+	}
 
-			g.hash.Reset()
+	g.writer.Clear()
+	fmt.Fprintf(g.writer, "Updating (%d/%d) files...\n", g.count, g.total)
+	// write to terminal
+	g.writer.Print()
 
-			if fmt.Sprintf("%x", sum) != e.Source.Hash {
-				syncFile = true
-			}
+	g.count = g.count + 1
+}
 
+func (g *Gotrovi) changed(st fileState, info os.FileInfo, p string, useHash bool) bool {
+	if st.IsFolder != info.IsDir() || st.Date != fileDate(info.ModTime()) {
+		return true
+	}
+	if info.IsDir() {
+		return false
+	}
+	if st.Size != info.Size() {
+		return true
+	}
+	if st.Inode != 0 && st.Inode != fileInode(info) {
+		return true
+	}
+	if useHash {
+		sum, err := hashFile(g.hash, p)
+		if err != nil {
+			Error.Println(err)
+			return false
 		}
+		return sum != st.Hash
+	}
+	return false
+}
 
-		if !syncFile && info.ModTime().String() != e.Source.Date {
-			syncFile = true
-		}
+// vanish keeps an indexed file no longer present, by size so moved files
+// can be matched. Folders, chunked files and archives are never matched.
+func (g *Gotrovi) vanish(p string, st fileState) {
+	size := st.Size
+	if st.IsFolder || st.Hash == "" || st.Chunks > 1 || st.Members > 0 {
+		size = -1
+	}
+	g.vanished[size] = append(g.vanished[size], vanishedFile{path: p, state: st})
+}
 
-		if syncFile {
-			Info.Println("Resync file ", e.Source.FullName)
-			Info.Println()
-			sync_file(g, info, e.Source.FullName)
+// moveVanished looks for a vanished file with the size and either the inode
+// and date or the hash of the new file p. If found, its document is moved
+// to p keeping its extracted content instead of indexing the file again.
+func (g *Gotrovi) moveVanished(info os.FileInfo, p string) bool {
+	if info.IsDir() {
+		return false
+	}
+	candidates := g.vanished[info.Size()]
+	if len(candidates) == 0 {
+		return false
+	}
 
+	match := -1
+	inode := fileInode(info)
+	date := fileDate(info.ModTime())
+	for i, v := range candidates {
+		if v.state.Inode != 0 && v.state.Inode == inode && v.state.Date == date {
+			match = i
+			break
+		}
+	}
+	if match < 0 {
+		sum, err := hashFile(g.hash, p)
+		if err != nil {
+			Error.Println(err)
+			return false
 		}
+		for i, v := range candidates {
+			if v.state.Hash == sum {
+				match = i
+				break
+			}
+		}
+	}
+	if match < 0 {
+		return false
+	}
 
+	v := candidates[match]
+	doc, err := g.backend.Get(v.path)
+	if err != nil {
+		Error.Println("Unable to move document:", err)
+		return false
 	}
+	doc.FileName = info.Name()
+	doc.FullName = p
+	doc.Path = filepath.Dir(p)
+	doc.Extension = filepath.Ext(info.Name())
+	doc.Date = date
+	doc.Mode = info.Mode().String()
+
+	Info.Println("Moved file: ", v.path, " -> ", p)
+	Info.Println()
+	g.indexer.queueDoc(bulkItem{path: p, info: info, doc: doc, extracted: true})
+	deleteFileDoc(g, v.path)
+
+	g.vanished[info.Size()] = append(candidates[:match], candidates[match+1:]...)
+	g.summary.moved = g.summary.moved + 1
+	return true
+}
 
-	g.writer.Clear()
-	fmt.Fprintf(g.writer, "Updating (%d/%d) files...\n", total-current+1, total)
-	// write to terminal
-	g.writer.Print()
+// addCreated indexes the files found by SyncUpdate which are not in the
+// sync state, unless they are moved files
+func (g *Gotrovi) addCreated() {
+	g.total = len(g.created)
+	g.count = 0
+	for _, job := range g.created {
+		if g.moveVanished(job.info, job.path) {
+			continue
+		}
+		Info.Println("Adding file: ", job.path)
+		Info.Println()
+		sync_file(g, job.info, job.path)
+		g.summary.added = g.summary.added + 1
+	}
+	g.created = nil
+}
 
+// deleteVanished deletes the documents of the files which were not moved
+func (g *Gotrovi) deleteVanished() {
+	for _, list := range g.vanished {
+		for _, v := range list {
+			if deleteFileDoc(g, v.path) == nil {
+				g.summary.deleted = g.summary.deleted + 1
+			}
+		}
+	}
+	g.vanished = make(map[int64][]vanishedFile)
 }
 
 func (gotrovi *Gotrovi) SyncFolder(i int) {
@@ -389,73 +310,126 @@ func (gotrovi *Gotrovi) SyncFolder(i int) {
 	gotrovi.PerformFolderOperation(i, count)
 	Info.Println("Found files: ", gotrovi.count)
 
-	gotrovi.PerformFolderOperation(i, sync_file)
+	gotrovi.cp.startFolder(i, f)
+	gotrovi.PerformFolderOperation(i, func(g *Gotrovi, info os.FileInfo, p string) {
+		sync_file(g, info, p)
+		g.cp.done(p)
+	})
 
 }
 
-func (gotrovi *Gotrovi) SyncUpdate(useHash bool) {
-	gotrovi.initializePipelineAttachment()
-
-	Info.Println("Deleting missing docs")
-
-	res, err := gotrovi.es.Search(
-		gotrovi.es.Search.WithIndex(GOTROVI_ES_INDEX),
-		//		gotrovi.es.Search.WithSort("timestamp:desc"),
-		gotrovi.es.Search.WithSize(1),
-		gotrovi.es.Search.WithContext(context.Background()),
-	)
-	if err != nil || res.IsError() {
-		Trace.Println(err)
-		return
-	}
-	defer res.Body.Close()
-
-	//var buf bytes.Buffer
-
+// SyncUpdate diffs the indexed folders against the sync state, indexing
+// the new and changed files and deleting the documents of the files no
+// longer present. It returns errInterrupted when interrupted, leaving the
+// caller to save the checkpoint with exitInterrupted.
+func (gotrovi *Gotrovi) SyncUpdate(useHash bool) error {
 	Info.Println("Update existing entries")
-	gotrovi.ES_Find("*", []string{}, useHash, "", false, UpdateEntries, os.Stdout)
-
-}
-
-func (gotrovi *Gotrovi) SyncAddMissing() {
-	gotrovi.initializePipelineAttachment()
 
-	Info.Println("Adding Missing files")
+	gotrovi.summary = syncSummary{}
+	gotrovi.vanished = make(map[int64][]vanishedFile)
+	gotrovi.created = gotrovi.cp.resumeCreated()
+	if gotrovi.cp != nil {
+		gotrovi.summary.updated = gotrovi.cp.Updated
+	}
+	err := gotrovi.checkState()
+	if err != nil {
+		return err
+	}
 
+	seen := make(map[string]bool)
 	for i := 0; i < len(gotrovi.conf.Index); i++ {
 		f := gotrovi.conf.Index[i].Folder
 		Info.Println("- " + f)
 		gotrovi.total = 0
 		gotrovi.count = 0
-		gotrovi.added = 0
 		gotrovi.PerformFolderOperation(i, count)
-		Info.Println("Found files: ", gotrovi.count)
+		Info.Println("Found files: ", gotrovi.total)
+
+		gotrovi.cp.startFolder(i, f)
+		gotrovi.PerformFolderOperation(i, func(g *Gotrovi, info os.FileInfo, p string) {
+			seen[p] = true
+			updateEntry(g, info, p, useHash)
+			g.cp.done(p)
+		})
+		if gotrovi.isInterrupted() {
+			return errInterrupted
+		}
+	}
+	if gotrovi.cp != nil {
+		gotrovi.cp.walkDone(len(gotrovi.conf.Index))
+		gotrovi.saveCheckpoint()
+	}
 
-		gotrovi.PerformFolderOperation(i, addMissing)
+	// indexed files the walk did not find: those still present are either
+	// excluded now, and deleted, or could not be read and are kept
+	for _, p := range gotrovi.state.paths() {
+		if seen[p] {
+			continue
+		}
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			st, _ := gotrovi.state.get(p)
+			gotrovi.vanish(p, st)
+		} else if check := gotrovi.checkIgnore(p); check.Excluded && check.Error == "" {
+			Trace.Println("Excluded:", p, check.Rule)
+			if deleteFileDoc(gotrovi, p) == nil {
+				gotrovi.summary.deleted = gotrovi.summary.deleted + 1
+			}
+		}
 	}
+
+	gotrovi.addCreated()
+	gotrovi.deleteVanished()
+	return nil
 }
 
-func (gotrovi *Gotrovi) SyncForced() {
+// SyncForced indexes every file into a new generation of the index, which
+// replaces the current one only once complete. keep previous generations
+// are retained. It returns errInterrupted when interrupted, as SyncUpdate.
+func (gotrovi *Gotrovi) SyncForced(keep int) error {
 	Info.Println("Performing Sync")
 
-	res, err := gotrovi.es.Search(
-		gotrovi.es.Search.WithIndex(GOTROVI_ES_INDEX),
-		//		gotrovi.es.Search.WithSort("timestamp:desc"),
-		gotrovi.es.Search.WithSize(1),
-		gotrovi.es.Search.WithContext(context.Background()),
-	)
-	if err != nil {
-		Error.Println(err)
+	if gotrovi.cp == nil {
+		gotrovi.cp = newCheckpoint("forced")
 	}
-	defer res.Body.Close()
-
-	if err == nil && !res.IsError() {
-		gotrovi.DeleteIndex()
+	r := gotrovi.reindexer()
+	var err error
+	if gotrovi.cp.Generation != "" {
+		err = r.ResumeReindex(gotrovi.cp.Generation)
+	} else {
+		err = r.BeginReindex()
+		gotrovi.cp.Generation = gotrovi.backend.Generation()
 	}
+	if err != nil {
+		return fmt.Errorf("unable to create the new index: %v", err)
+	}
+	gotrovi.state.begin(gotrovi.backend.Generation())
+	gotrovi.saveCheckpoint()
 
-	gotrovi.initializePipelineAttachment()
-
+	gotrovi.startIndexer()
 	for i := 0; i < len(gotrovi.conf.Index); i++ {
 		gotrovi.SyncFolder(i)
+		if gotrovi.isInterrupted() {
+			return errInterrupted
+		}
+	}
+	err = gotrovi.stopIndexer()
+	if err != nil {
+		Error.Println("Sync failed, keeping the current index")
+		aerr := r.AbortReindex()
+		if aerr != nil {
+			Error.Println(aerr)
+		}
+		gotrovi.state.abort()
+		gotrovi.saveState()
+		return err
+	}
+
+	err = r.FinishReindex(keep)
+	if err != nil {
+		return fmt.Errorf("unable to switch to the new index: %v", err)
 	}
+	// the files of the previous generation are dropped
+	gotrovi.state.finish()
+	gotrovi.saveState()
+	return nil
 }
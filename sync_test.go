@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apoorvam/goterminal"
+)
+
+// testSyncTree writes files in a temporary folder and indexes them with the
+// local backend, returning the settings folder the caller removes and the
+// indexed folder
+func testSyncTree(t *testing.T, files map[string]string) (*Gotrovi, string, string) {
+	settings, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	GOTROVI_SETTINGS_FOLDER = settings + "/"
+	root := filepath.Join(settings, "root")
+	testIgnoreTree(t, root, files)
+
+	g := &Gotrovi{}
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 1 << 30}, Backend: BACKEND_LOCAL, Hash: "md5"}
+	g.jobs = 2
+	g.writer = goterminal.New(ioutil.Discard)
+	g.OpenBackend()
+	g.OpenState()
+	g.InitHash()
+	err = g.SyncForced(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cp = nil
+	return g, settings, root
+}
+
+// testReopen opens the backend and the sync state again, as a new gotrovi
+// process would
+func testReopen(g *Gotrovi) {
+	g.backend.Close()
+	atomic.StoreInt32(&g.interrupted, 0)
+	g.writer = goterminal.New(ioutil.Discard)
+	g.OpenBackend()
+	g.OpenState()
+}
+
+// testUpdate runs an update sync
+func testUpdate(t *testing.T, g *Gotrovi) {
+	g.startIndexer()
+	err := g.SyncUpdate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.stopIndexer()
+}
+
+// interruptWriter counts the files whose progress is shown in shown, and
+// interrupts the sync once it reaches files if not 0
+type interruptWriter struct {
+	g     *Gotrovi
+	files int
+	shown int
+}
+
+func (w *interruptWriter) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("files...")) {
+		w.shown = w.shown + 1
+		if w.shown == w.files {
+			atomic.StoreInt32(&w.g.interrupted, 1)
+		}
+	}
+	return len(b), nil
+}
+
+func TestSyncForcedInterrupted(t *testing.T) {
+	g, settings, root := testSyncTree(t, map[string]string{
+		"a.txt": "one",
+		"b.txt": "two",
+		"c.txt": "three",
+		"d.txt": "four",
+	})
+	defer os.RemoveAll(settings)
+	generation := g.backend.Generation()
+
+	g.writer = goterminal.New(&interruptWriter{g: g, files: 3})
+	if err := g.SyncForced(0); err != errInterrupted {
+		t.Fatalf("forced sync: %v", err)
+	}
+	g.stopIndexer()
+	for _, name := range []string{"", "a.txt", "b.txt", "c.txt", "d.txt"} {
+		if st, ok := g.state.get(filepath.Join(root, name)); !ok || st.Generation != generation {
+			t.Errorf("%s: in the state %v, generation %s, want %s", name, ok, st.Generation, generation)
+		}
+	}
+
+	// an update instead of resuming finds nothing to do
+	testReopen(g)
+	if g.backend.Generation() != generation {
+		t.Fatalf("generation %s, want %s", g.backend.Generation(), generation)
+	}
+	testUpdate(t, g)
+	if g.summary != (syncSummary{}) {
+		t.Errorf("update after the interrupted sync: %v", g.summary)
+	}
+
+	// a complete forced sync replaces the state
+	if err := g.SyncForced(0); err != nil {
+		t.Fatal(err)
+	}
+	if g.backend.Generation() == generation || g.state.prune(g.backend.Generation()) != 5 || g.state.data.Next != nil {
+		t.Errorf("state after the forced sync: %+v", g.state.data)
+	}
+}
+
+func TestSyncUpdateMoved(t *testing.T) {
+	g, settings, root := testSyncTree(t, map[string]string{
+		"a/renamed.txt": "renamed with its inode",
+		"a/copied.txt":  "copied with its content",
+		"a/kept.txt":    "kept",
+	})
+	defer os.RemoveAll(settings)
+
+	// the content indexed is kept by the moves, not extracted again
+	for _, name := range []string{"a/renamed.txt", "a/copied.txt"} {
+		p := filepath.Join(root, name)
+		doc, err := g.backend.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc.Attachment.Content = "indexed " + name
+		g.backend.Index([]bulkItem{{path: p, doc: doc, extracted: true}})
+	}
+	g.backend.Refresh()
+
+	os.MkdirAll(filepath.Join(root, "b"), 0755)
+	if err := os.Rename(filepath.Join(root, "a/renamed.txt"), filepath.Join(root, "b/renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "a/copied.txt"))
+	testIgnoreTree(t, root, map[string]string{"b/copied.txt": "copied with its content"})
+	testUpdate(t, g)
+
+	// the folders changed may be updated too
+	if g.summary.added != 1 || g.summary.moved != 2 || g.summary.deleted != 0 {
+		t.Errorf("summary %v, want the b folder added and 2 moved", g.summary)
+	}
+	for _, name := range []string{"renamed.txt", "copied.txt"} {
+		from := filepath.Join(root, "a", name)
+		to := filepath.Join(root, "b", name)
+		if _, ok := g.state.get(from); ok || g.backend.Exists(from) {
+			t.Errorf("%s left after its move", from)
+		}
+		doc, err := g.backend.Get(to)
+		if err != nil {
+			t.Errorf("%s: %v", to, err)
+			continue
+		}
+		if doc.Attachment == nil || doc.Attachment.Content != "indexed a/"+name || doc.FullName != to || doc.Path != filepath.Dir(to) {
+			t.Errorf("%s moved as %+v", to, doc)
+		}
+		if _, ok := g.state.get(to); !ok {
+			t.Errorf("%s not in the state", to)
+		}
+	}
+}
+
+func TestSyncUpdateDeleted(t *testing.T) {
+	g, settings, root := testSyncTree(t, map[string]string{
+		"a.txt":     "deleted",
+		"sub/b.txt": "deleted with its folder",
+		"sub/c.txt": "deleted with its folder",
+		"keep.txt":  "kept",
+	})
+	defer os.RemoveAll(settings)
+
+	os.Remove(filepath.Join(root, "a.txt"))
+	os.RemoveAll(filepath.Join(root, "sub"))
+	testUpdate(t, g)
+	if g.summary.added != 0 || g.summary.moved != 0 || g.summary.deleted != 4 {
+		t.Errorf("summary %v, want 4 deleted", g.summary)
+	}
+
+	// the state saved no longer has them either
+	testReopen(g)
+	for name, indexed := range map[string]bool{"a.txt": false, "sub": false, "sub/b.txt": false, "sub/c.txt": false, "keep.txt": true} {
+		p := filepath.Join(root, name)
+		found := g.backend.Exists(p)
+		if _, ok := g.state.get(p); found != indexed || ok != indexed {
+			t.Errorf("%s: indexed %v, in the state %v, want %v", name, found, ok, indexed)
+		}
+	}
+	if paths, _ := testSearch(t, g.backend, "deleted", searchOptions{}); paths != "" {
+		t.Errorf("deleted files found: %s", paths)
+	}
+}
+
+// testInterrupted saves the checkpoint of the interrupted sync as
+// exitInterrupted does, and resumes it as gotrovi --resume does. The returned
+// writer counts the files synced from then on.
+func testInterrupted(t *testing.T, g *Gotrovi) *interruptWriter {
+	g.stopIndexer()
+	g.saveCheckpoint()
+	testReopen(g)
+	cp, err := loadCheckpoint(g.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cp = cp
+	w := &interruptWriter{g: g}
+	g.writer = goterminal.New(w)
+	return w
+}
+
+// testIndexed returns how many times each path is indexed
+func testIndexed(t *testing.T, b Backend) map[string]int {
+	indexed := make(map[string]int)
+	err := b.ScrollAll(func(total int, hit SearchHit) {
+		indexed[hit.Source.FullName] = indexed[hit.Source.FullName] + 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexed
+}
+
+func TestSyncResume(t *testing.T) {
+	g, settings, root := testSyncTree(t, map[string]string{
+		"a.txt": "one",
+		"b.txt": "two",
+		"c.txt": "three",
+		"d.txt": "four",
+		"e.txt": "five",
+	})
+	defer os.RemoveAll(settings)
+
+	// the root folder, a.txt and b.txt are done when interrupted
+	g.cp = newCheckpoint("forced")
+	g.writer = goterminal.New(&interruptWriter{g: g, files: 3})
+	if err := g.SyncForced(0); err != errInterrupted {
+		t.Fatalf("forced sync: %v", err)
+	}
+	generation := g.cp.Generation
+	w := testInterrupted(t, g)
+	if g.cp.Count != 3 || g.cp.Generation != generation {
+		t.Fatalf("checkpoint %+v", g.cp)
+	}
+	if err := g.SyncForced(0); err != nil {
+		t.Fatal(err)
+	}
+	if w.shown != 3 || g.backend.Generation() != generation {
+		t.Errorf("resumed forced sync synced %d files into %s, want 3 into %s", w.shown, g.backend.Generation(), generation)
+	}
+	indexed := testIndexed(t, g.backend)
+	for _, name := range []string{"", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"} {
+		if n := indexed[filepath.Join(root, name)]; n != 1 {
+			t.Errorf("%s indexed %d times after the forced sync", name, n)
+		}
+	}
+	if len(indexed) != 6 {
+		t.Errorf("indexed %v", indexed)
+	}
+
+	// the new files found before an update is interrupted are added once
+	// resumed
+	testIgnoreTree(t, root, map[string]string{"0new.txt": "new", "0next.txt": "next"})
+	g.cp = newCheckpoint("update")
+	g.writer = goterminal.New(&interruptWriter{g: g, files: 3})
+	g.startIndexer()
+	if err := g.SyncUpdate(false); err != errInterrupted {
+		t.Fatalf("update: %v", err)
+	}
+	testInterrupted(t, g)
+	if len(g.cp.Created) != 2 {
+		t.Fatalf("checkpoint %+v", g.cp)
+	}
+	testUpdate(t, g)
+	if g.summary.added != 2 || g.summary.deleted != 0 || g.summary.moved != 0 {
+		t.Errorf("resumed update: %v", g.summary)
+	}
+	indexed = testIndexed(t, g.backend)
+	for _, name := range []string{"0new.txt", "0next.txt", "a.txt", "e.txt"} {
+		if n := indexed[filepath.Join(root, name)]; n != 1 {
+			t.Errorf("%s indexed %d times after the update", name, n)
+		}
+	}
+	if len(indexed) != 8 {
+		t.Errorf("indexed %v", indexed)
+	}
+}
+
+func TestSyncSaveEvery(t *testing.T) {
+	g, settings, root := testSyncTree(t, map[string]string{"a.txt": "one"})
+	defer os.RemoveAll(settings)
+	saved := func(name string) bool {
+		s := newSyncState(GOTROVI_SETTINGS_FOLDER + STATE_FILE)
+		s.load()
+		_, ok := s.get(filepath.Join(root, name))
+		return ok
+	}
+	index, err := os.Stat(g.backend.(*localBackend).file())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the update saved within saveEvery is left for the next save
+	g.saveEvery = time.Hour
+	g.saved = time.Now()
+	testIgnoreTree(t, root, map[string]string{"b.txt": "two"})
+	testUpdate(t, g)
+	if g.summary.added != 1 || !g.unsaved || saved("b.txt") {
+		t.Fatalf("update saved: %v, summary %v", g.unsaved, g.summary)
+	}
+	if info, err := os.Stat(g.backend.(*localBackend).file()); err != nil || !info.ModTime().Equal(index.ModTime()) || info.Size() != index.Size() {
+		t.Errorf("index written before the save")
+	}
+
+	if err := g.save(); err != nil {
+		t.Fatal(err)
+	}
+	if g.unsaved || !saved("b.txt") {
+		t.Errorf("state not saved")
+	}
+	testReopen(g)
+	if !g.backend.Exists(filepath.Join(root, "b.txt")) {
+		t.Errorf("index not saved")
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gookit/color"
+	"golang.org/x/term"
+)
+
+// Interactive search, gotrovi -I. The screen is drawn on /dev/tty so stdout
+// is left for the folder printed by TUI_KEY_CD, as in cd "$(gotrovi -I)".
+
+// Time without typing before the query runs
+const TUI_DEBOUNCE = 150 * time.Millisecond
+
+// Results shown in the list
+const TUI_MAX_RESULTS = 1000
+
+const TUI_HELP = "Enter: edit  Ctrl-Y: copy path  Ctrl-O: cd to folder  Up/Down: select  Esc: quit"
+
+// Keys, as read from the terminal in raw mode
+const (
+	TUI_KEY_ENTER     = "\r"
+	TUI_KEY_ESC       = "\x1b"
+	TUI_KEY_CTRL_C    = "\x03"
+	TUI_KEY_BACKSPACE = "\x7f"
+	TUI_KEY_CTRL_H    = "\x08"
+	TUI_KEY_CTRL_U    = "\x15"
+	TUI_KEY_CTRL_W    = "\x17"
+	TUI_KEY_COPY      = "\x19" // Ctrl-Y
+	TUI_KEY_CD        = "\x0f" // Ctrl-O
+	TUI_KEY_CTRL_N    = "\x0e"
+	TUI_KEY_CTRL_P    = "\x10"
+	TUI_KEY_UP        = "\x1b[A"
+	TUI_KEY_DOWN      = "\x1b[B"
+	TUI_KEY_PGUP      = "\x1b[5~"
+	TUI_KEY_PGDN      = "\x1b[6~"
+)
+
+type tuiResult struct {
+	seq   int
+	hits  []SearchHit
+	total int
+	err   error
+}
+
+type tui struct {
+	g     *Gotrovi
+	paths []string
+	raw   bool
+	tty   *os.File
+	out   *bufio.Writer
+	state *term.State
+
+	input    []rune
+	seq      int
+	hits     []SearchHit
+	total    int
+	selected int
+	top      int
+	status   string
+	width    int
+	height   int
+}
+
+// liveQuery turns the text typed so far into a query: the last word matches
+// as a prefix, so results show up before it is complete
+func liveQuery(input string) string {
+	query := strings.TrimSpace(input)
+	if query == "" {
+		return ""
+	}
+	last := query[strings.LastIndexAny(query, " ()")+1:]
+	if last == "" || strings.ContainsAny(last, ":\"*?~^\\") {
+		return query
+	}
+	switch last {
+	case "AND", "OR", "NOT", "&&", "||":
+		return query
+	}
+	return query + "*"
+}
+
+// search runs query in the background, sending its hits to results
+func (t *tui) search(query string, results chan<- tuiResult) {
+	t.seq = t.seq + 1
+	r := tuiResult{seq: t.seq}
+	go func() {
+		opts := searchOptions{Highlight: true, Limit: TUI_MAX_RESULTS, Raw: t.raw}
+		_, r.err = t.g.find(liveQuery(query), t.paths, opts, func(total int, e SearchHit) {
+			r.total = total
+			r.hits = append(r.hits, e)
+		})
+		results <- r
+	}()
+}
+
+func (t *tui) start() error {
+	var err error
+	t.state, err = term.MakeRaw(int(t.tty.Fd()))
+	if err != nil {
+		return err
+	}
+	// alternate screen, hidden cursor
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	t.resize()
+	return nil
+}
+
+func (t *tui) stop() {
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	t.out.Flush()
+	term.Restore(int(t.tty.Fd()), t.state)
+}
+
+func (t *tui) resize() {
+	w, h, err := term.GetSize(int(t.tty.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		w, h = 80, 24
+	}
+	t.width = w
+	t.height = h
+}
+
+// listHeight is the amount of results shown, the preview gets the rest
+func (t *tui) listHeight() int {
+	h := (t.height - 4) / 2
+	if h < 1 {
+		h = 1
+	}
+	return h
+}
+
+// clip cuts s to the width of the screen
+func (t *tui) clip(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width-1]) + "…"
+}
+
+// line writes a screen line, clearing what was there
+func (t *tui) line(row int, s string) {
+	fmt.Fprintf(t.out, "\x1b[%d;1H\x1b[2K%s", row, s)
+}
+
+// highlight colors the <em> parts of fragment, clipped to the screen width
+func (t *tui) highlight(fragment string) string {
+	var b strings.Builder
+	width := t.width
+	em := false
+	for fragment != "" && width > 0 {
+		tag := "<em>"
+		if em {
+			tag = "</em>"
+		}
+		text := fragment
+		i := strings.Index(fragment, tag)
+		if i >= 0 {
+			text = fragment[:i]
+			fragment = fragment[i+len(tag):]
+		} else {
+			fragment = ""
+		}
+		text = t.clip(text, width)
+		width = width - utf8.RuneCountInString(text)
+		if em {
+			text = color.FgRed.Render(text)
+		}
+		b.WriteString(text)
+		em = !em
+	}
+	return b.String()
+}
+
+// preview renders the details and highlights of e
+func (t *tui) preview(e SearchHit) []string {
+	s := e.Source
+	lines := []string{
+		color.FgGray.Render(fmt.Sprintf("%s  %s  %s", humanSize(s.Size), s.Date, s.Mode)),
+	}
+	for _, fragment := range e.Highlight.Field {
+		lines = append(lines, t.highlight(strings.Join(strings.Fields(fragment), " ")))
+	}
+	return lines
+}
+
+func (t *tui) draw() {
+	fmt.Fprint(t.out, "\x1b[H")
+	t.line(1, "> "+t.clip(string(t.input), t.width-3)+"█")
+
+	status := t.status
+	if status == "" {
+		status = fmt.Sprintf("%d/%d", len(t.hits), t.total)
+		if t.total > len(t.hits) {
+			status = status + ", refine the query to see the rest"
+		}
+	}
+	t.line(2, color.FgGray.Render(t.clip(status, t.width)))
+
+	n := t.listHeight()
+	if t.selected < t.top {
+		t.top = t.selected
+	}
+	if t.selected >= t.top+n {
+		t.top = t.selected - n + 1
+	}
+	for i := 0; i < n; i++ {
+		row := 3 + i
+		if t.top+i >= len(t.hits) {
+			t.line(row, "")
+			continue
+		}
+		s := t.hits[t.top+i].Source
+		name := entryColor(s)(t.clip(s.FullName, t.width-2))
+		if t.top+i == t.selected {
+			t.line(row, "\x1b[7m>\x1b[0m "+name)
+		} else {
+			t.line(row, "  "+name)
+		}
+	}
+
+	row := 3 + n
+	t.line(row, color.FgGray.Render(strings.Repeat("─", t.width)))
+	var preview []string
+	if t.selected < len(t.hits) {
+		preview = t.preview(t.hits[t.selected])
+	}
+	for i := 0; row+1+i < t.height; i++ {
+		if i < len(preview) {
+			t.line(row+1+i, preview[i])
+		} else {
+			t.line(row+1+i, "")
+		}
+	}
+	t.line(t.height, color.FgGray.Render(t.clip(TUI_HELP, t.width)))
+	t.out.Flush()
+}
+
+func (t *tui) move(delta int) {
+	t.selected = t.selected + delta
+	if t.selected >= len(t.hits) {
+		t.selected = len(t.hits) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+// edit opens the selected file in $EDITOR
+func (t *tui) edit(p string) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	t.stop()
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], p)...)
+	cmd.Stdin = t.tty
+	cmd.Stdout = t.tty
+	cmd.Stderr = t.tty
+	err := cmd.Run()
+	if err != nil {
+		t.status = editor + ": " + err.Error()
+	}
+	err = t.start()
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+}
+
+// copyPath copies p to the clipboard with the first clipboard tool found, or
+// the OSC 52 escape understood by most terminals
+func (t *tui) copyPath(p string) {
+	tools := [][]string{{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}, {"pbcopy"}}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool[0], tool[1:]...)
+		cmd.Stdin = strings.NewReader(p)
+		if cmd.Run() == nil {
+			t.status = "Copied " + p
+			return
+		}
+	}
+	fmt.Fprintf(t.out, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(p)))
+	t.status = "Copied " + p
+}
+
+// readKeys sends the keys typed to keys, reading the next one once next is
+// signaled so the editor gets the terminal to itself
+func (t *tui) readKeys(keys chan<- string, next <-chan struct{}) {
+	buf := make([]byte, 256)
+	for range next {
+		n, err := t.tty.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		keys <- string(buf[:n])
+	}
+}
+
+// Interactive runs the interactive search in paths, starting with query
+func (gotrovi *Gotrovi) Interactive(query string, paths []string, raw bool) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		Error.Println("Interactive search needs a terminal:", err)
+		os.Exit(1)
+	}
+	defer tty.Close()
+
+	t := &tui{g: gotrovi, paths: paths, raw: raw, tty: tty, out: bufio.NewWriter(tty), input: []rune(query)}
+	err = t.start()
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+
+	keys := make(chan string)
+	next := make(chan struct{}, 1)
+	results := make(chan tuiResult)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	debounce := time.NewTimer(0)
+	go t.readKeys(keys, next)
+	next <- struct{}{}
+
+	var cd string
+	t.draw()
+loop:
+	for {
+		select {
+		case <-winch:
+			t.resize()
+		case <-debounce.C:
+			if liveQuery(string(t.input)) == "" {
+				t.seq = t.seq + 1
+				t.hits = nil
+				t.total = 0
+				break
+			}
+			t.search(string(t.input), results)
+		case r := <-results:
+			if r.seq != t.seq {
+				// superseded by a newer query
+				continue
+			}
+			t.hits = r.hits
+			t.total = r.total
+			t.selected = 0
+			t.top = 0
+			t.status = ""
+			if r.err != nil {
+				t.status = color.FgRed.Render(r.err.Error())
+			}
+		case key, ok := <-keys:
+			if !ok {
+				break loop
+			}
+			typed := false
+			var selected *Source
+			if t.selected < len(t.hits) {
+				selected = &t.hits[t.selected].Source
+			}
+			switch key {
+			case TUI_KEY_ESC, TUI_KEY_CTRL_C:
+				break loop
+			case TUI_KEY_UP, TUI_KEY_CTRL_P:
+				t.move(-1)
+			case TUI_KEY_DOWN, TUI_KEY_CTRL_N:
+				t.move(1)
+			case TUI_KEY_PGUP:
+				t.move(-t.listHeight())
+			case TUI_KEY_PGDN:
+				t.move(t.listHeight())
+			case TUI_KEY_BACKSPACE, TUI_KEY_CTRL_H:
+				if len(t.input) > 0 {
+					t.input = t.input[:len(t.input)-1]
+					typed = true
+				}
+			case TUI_KEY_CTRL_U:
+				t.input = t.input[:0]
+				typed = true
+			case TUI_KEY_CTRL_W:
+				i := len(t.input)
+				for i > 0 && t.input[i-1] == ' ' {
+					i--
+				}
+				for i > 0 && t.input[i-1] != ' ' {
+					i--
+				}
+				t.input = t.input[:i]
+				typed = true
+			case TUI_KEY_ENTER:
+				if selected != nil {
+					// members are opened with their archive
+					t.edit(containerPath(selected.FullName))
+				}
+			case TUI_KEY_COPY:
+				if selected != nil {
+					t.copyPath(selected.FullName)
+				}
+			case TUI_KEY_CD:
+				if selected != nil {
+					cd = selected.Path
+					if selected.IsFolder {
+						cd = selected.FullName
+					}
+					if isArchived(*selected) {
+						cd = filepath.Dir(containerPath(selected.FullName))
+					}
+					break loop
+				}
+			default:
+				if strings.HasPrefix(key, TUI_KEY_ESC) {
+					// unknown escape sequence
+					break
+				}
+				for _, r := range key {
+					if unicode.IsPrint(r) {
+						t.input = append(t.input, r)
+						typed = true
+					}
+				}
+			}
+			if typed {
+				t.status = ""
+				debounce.Reset(TUI_DEBOUNCE)
+			}
+			next <- struct{}{}
+		}
+		t.draw()
+	}
+	t.stop()
+
+	if cd != "" {
+		fmt.Println(filepath.Clean(cd))
+	}
+}
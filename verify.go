@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pborman/getopt"
+)
+
+// gotrovi verify: hashes the indexed files again to detect silent
+// corruption. Only files whose size and date did not change since they were
+// indexed are checked, a different hash on those cannot come from an edit.
+
+const VERIFY_OK = "ok"
+
+// changed since indexed, update resyncs them
+const VERIFY_MODIFIED = "modified"
+const VERIFY_MISSING = "missing"
+
+// same size and date but different hash
+const VERIFY_CORRUPT = "corrupt"
+
+// read errors while hashing
+const VERIFY_UNREADABLE = "unreadable"
+
+// Exit status of verify when corrupt or unreadable files are found
+const VERIFY_EXIT_CORRUPT = 2
+
+// integrityEvent records a file suspected to be corrupt
+type integrityEvent struct {
+	Timestamp   string `json:"timestamp"`
+	Host        string `json:"host"`
+	Event       string `json:"event"`
+	FullName    string `json:"fullpath"`
+	Size        int64  `json:"size"`
+	Date        string `json:"date"`
+	IndexedHash string `json:"indexed_hash"`
+	Hash        string `json:"hash,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type verifySummary struct {
+	Checked    int `json:"checked"`
+	Ok         int `json:"ok"`
+	Modified   int `json:"modified"`
+	Missing    int `json:"missing"`
+	Corrupt    int `json:"corrupt"`
+	Unreadable int `json:"unreadable"`
+}
+
+func (s verifySummary) String() string {
+	return fmt.Sprintf("%d checked, %d ok, %d corrupt, %d unreadable, %d modified, %d missing", s.Checked, s.Ok, s.Corrupt, s.Unreadable, s.Modified, s.Missing)
+}
+
+// verifyFile compares the file on disk with its indexed document, returning
+// the status and the hash computed, if any
+func (gotrovi *Gotrovi) verifyFile(s Source) (string, string, error) {
+	info, err := os.Stat(s.FullName)
+	if os.IsNotExist(err) {
+		return VERIFY_MISSING, "", nil
+	}
+	if err != nil {
+		return VERIFY_UNREADABLE, "", err
+	}
+	if info.Size() != s.Size || fileDate(info.ModTime()) != s.Date {
+		return VERIFY_MODIFIED, "", nil
+	}
+	sum, err := hashFile(gotrovi.hash, s.FullName)
+	if err != nil {
+		return VERIFY_UNREADABLE, "", err
+	}
+	if sum != s.Hash {
+		return VERIFY_CORRUPT, sum, nil
+	}
+	return VERIFY_OK, sum, nil
+}
+
+func (gotrovi *Gotrovi) Verify(args []string) {
+	opts := getopt.New()
+	opts.SetProgram("gotrovi verify")
+	opts.SetParameters("[paths ...]")
+	optHelp := opts.BoolLong("help", 'h', "Show this message")
+	optEvents := opts.BoolLong("events", 'e', "Record the corrupt and unreadable files in the integrity events index")
+	optOutput := opts.StringLong("output", 'o', OUTPUT_TEXT, "Output format: \"text\" (default) or \"json\"")
+	opts.Parse(args)
+
+	if *optHelp {
+		fmt.Println("Hashes the indexed files whose size and date are unchanged, in the given paths or the whole index, and reports those whose hash differs")
+		opts.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if *optOutput != OUTPUT_TEXT && *optOutput != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "Unknown output format \""+*optOutput+"\", use text or json")
+		os.Exit(1)
+	}
+
+	query := "isfolder:false"
+	if opts.NArgs() != 0 {
+		dir_query, err := pathsQuery(opts.Args())
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		query = query + " AND " + dir_query
+	}
+	Trace.Println(query)
+
+	// the files are hashed once the search is done, it may take long
+	var docs []Source
+	err := gotrovi.backend.Search(query, searchOptions{Sort: []sortField{{Field: "fullpath"}}}, func(total int, e SearchHit) {
+		// members are checked with their archive
+		if !isArchived(e.Source) {
+			docs = append(docs, e.Source)
+		}
+	})
+	if err != nil {
+		Error.Println("Unable to get the indexed files:", err)
+		os.Exit(1)
+	}
+
+	gotrovi.InitHash()
+	host, _ := os.Hostname()
+
+	var summary verifySummary
+	events := []integrityEvent{}
+	for i, s := range docs {
+		Info.Printf("Verifying (%d/%d) %s\n", i+1, len(docs), s.FullName)
+		status, sum, err := gotrovi.verifyFile(s)
+		switch status {
+		case VERIFY_MISSING:
+			summary.Missing = summary.Missing + 1
+			continue
+		case VERIFY_MODIFIED:
+			summary.Modified = summary.Modified + 1
+			continue
+		case VERIFY_OK:
+			summary.Ok = summary.Ok + 1
+		case VERIFY_CORRUPT:
+			summary.Corrupt = summary.Corrupt + 1
+		case VERIFY_UNREADABLE:
+			summary.Unreadable = summary.Unreadable + 1
+		}
+		summary.Checked = summary.Checked + 1
+		if status == VERIFY_OK {
+			continue
+		}
+
+		event := integrityEvent{
+			Timestamp:   fileDate(time.Now()),
+			Host:        host,
+			Event:       status,
+			FullName:    s.FullName,
+			Size:        s.Size,
+			Date:        s.Date,
+			IndexedHash: s.Hash,
+			Hash:        sum,
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		events = append(events, event)
+		if *optOutput == OUTPUT_TEXT {
+			if err != nil {
+				fmt.Printf("%s: %s: %v\n", status, s.FullName, err)
+			} else {
+				fmt.Printf("%s: %s: indexed hash %s, now %s\n", status, s.FullName, s.Hash, sum)
+			}
+		}
+	}
+
+	if *optEvents && len(events) != 0 {
+		if recorder, ok := gotrovi.backend.(eventRecorder); ok {
+			err = recorder.RecordEvents(events)
+			if err != nil {
+				Error.Println("Unable to record the integrity events:", err)
+			}
+		} else {
+			Warning.Println("The " + gotrovi.backendName() + " backend cannot record integrity events")
+		}
+	}
+
+	if *optOutput == OUTPUT_JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			verifySummary
+			Events []integrityEvent `json:"events"`
+		}{summary, events})
+	} else {
+		fmt.Println("Verify done:", summary)
+		if summary.Modified > 0 || summary.Missing > 0 {
+			fmt.Println("Modified and missing files are not verified, run \"gotrovi -s update\" to resync them")
+		}
+	}
+
+	if len(events) != 0 {
+		gotrovi.backend.Close()
+		os.Exit(VERIFY_EXIT_CORRUPT)
+	}
+}
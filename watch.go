@@ -0,0 +1,304 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apoorvam/goterminal"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Events are coalesced until no new event arrives for WATCH_COALESCE_TIME,
+// but never delayed more than WATCH_MAX_DELAY.
+const WATCH_COALESCE_TIME = 2 * time.Second
+const WATCH_MAX_DELAY = 10 * time.Second
+
+// The index and the sync state are saved at most once every WATCH_SAVE_TIME,
+// the local backend rewriting its whole index file on each save.
+const WATCH_SAVE_TIME = 30 * time.Second
+
+// Interval between full rescans once the inotify watch limit is exhausted.
+const WATCH_RESCAN_TIME = 10 * time.Minute
+
+type fsWatcher struct {
+	g       *Gotrovi
+	w       *fsnotify.Watcher
+	folders map[string]bool
+	pending map[string]fsnotify.Op
+	first   time.Time
+	limited bool
+}
+
+// indexForPath returns the position in conf.Index of the folder containing p, or -1
+func (gotrovi *Gotrovi) indexForPath(p string) int {
+	id := -1
+	for i := 0; i < len(gotrovi.conf.Index); i++ {
+		f := filepath.Clean(gotrovi.conf.Index[i].Folder)
+		if p == f || strings.HasPrefix(p, f+"/") {
+			if id < 0 || len(f) > len(gotrovi.conf.Index[id].Folder) {
+				id = i
+			}
+		}
+	}
+	return id
+}
+
+func (fw *fsWatcher) addWatch(p string) {
+	if fw.limited {
+		return
+	}
+	err := fw.w.Add(p)
+	if err == syscall.ENOSPC {
+		Warning.Println("inotify watch limit reached, falling back to a full rescan every", WATCH_RESCAN_TIME)
+		Warning.Println("Increase fs.inotify.max_user_watches to watch every folder")
+		fw.limited = true
+		return
+	}
+	if err != nil {
+		Error.Println("Unable to watch "+p+":", err)
+		return
+	}
+	fw.folders[p] = true
+}
+
+// addTree watches every folder under root not excluded by the config. When
+// syncNew is set, the files found are also sent to ES.
+func (fw *fsWatcher) addTree(id int, root string, syncNew bool) {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			Error.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
+			return filepath.SkipDir
+		}
+		excluded, skipDir := fw.g.isExcluded(id, info, path)
+		if skipDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			fw.addWatch(path)
+		}
+		if syncNew && !excluded {
+			Info.Println("Adding file: ", path)
+			sync_file(fw.g, info, path)
+		}
+		return nil
+	})
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+// removeTree deletes the documents of p and, for a folder, those of the
+// files the sync state has under it, and stops watching it and its
+// subfolders. inotify drops the watch of a deleted folder itself, not that
+// of a folder moved away.
+func (fw *fsWatcher) removeTree(p string) {
+	deleteFileDoc(fw.g, p)
+	for _, f := range fw.g.state.pathsUnder(p) {
+		deleteFileDoc(fw.g, f)
+	}
+	for f := range fw.folders {
+		if f == p || strings.HasPrefix(f, p+"/") {
+			delete(fw.folders, f)
+			err := fw.w.Remove(f)
+			if err != nil {
+				Trace.Println(err)
+			}
+		}
+	}
+}
+
+func (fw *fsWatcher) process(p string, op fsnotify.Op) {
+	id := fw.g.indexForPath(p)
+	if id < 0 {
+		return
+	}
+
+	if fw.g.isIgnoreFile(p) {
+		// files excluded or included by it are only synced on the next update
+		fw.g.forgetRules(filepath.Dir(p))
+	}
+
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		fw.removeTree(p)
+		return
+	}
+	if err != nil {
+		Error.Println("Error getting file Stat "+p+":", err)
+		return
+	}
+
+	if excluded, skipDir := fw.g.isExcluded(id, info, p); excluded || skipDir {
+		return
+	}
+
+	if info.IsDir() && op&(fsnotify.Create|fsnotify.Rename) != 0 {
+		fw.addTree(id, p, true)
+		return
+	}
+
+	Info.Println("Resync file ", p)
+	sync_file(fw.g, info, p)
+}
+
+func (fw *fsWatcher) queue(ev fsnotify.Event) {
+	Trace.Println(ev)
+	if len(fw.pending) == 0 {
+		fw.first = time.Now()
+	}
+	fw.pending[ev.Name] |= ev.Op
+}
+
+func (fw *fsWatcher) flush() {
+	if len(fw.pending) == 0 {
+		return
+	}
+
+	// parents sort before their children, so new folders are walked once
+	paths := make([]string, 0, len(fw.pending))
+	for p := range fw.pending {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// vanished paths go first: a folder moved within the tree keeps its
+	// inotify watch, which removing its old path after adding the new one
+	// would drop
+	fw.g.startIndexer()
+	var present []string
+	for _, p := range paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			fw.process(p, fw.pending[p])
+		} else {
+			present = append(present, p)
+		}
+	}
+	for _, p := range present {
+		fw.process(p, fw.pending[p])
+	}
+	fw.pending = make(map[string]fsnotify.Op)
+	err := fw.g.stopIndexer()
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+// save writes what the flushes since the last save left unsaved
+func (fw *fsWatcher) save() {
+	if !fw.g.unsaved {
+		return
+	}
+	err := fw.g.save()
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+func (fw *fsWatcher) rescan() {
+	Info.Println("Rescanning indexed folders")
+	fw.flush()
+	fw.g.startIndexer()
+	err := fw.g.SyncUpdate(false)
+	if ierr := fw.g.stopIndexer(); err == nil {
+		err = ierr
+	}
+	if err != nil {
+		Error.Println("Rescan failed:", err)
+		return
+	}
+	Info.Println("Rescan done:", fw.g.summary)
+}
+
+func (gotrovi *Gotrovi) Watch() {
+	// progress counters make no sense for a long running process
+	gotrovi.writer = goterminal.New(ioutil.Discard)
+	gotrovi.saveEvery = WATCH_SAVE_TIME
+
+	// the removed folders are cleared with the state
+	err := gotrovi.checkState()
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		Error.Println("Unable to create filesystem watcher:", err)
+		os.Exit(1)
+	}
+	defer w.Close()
+
+	fw := fsWatcher{
+		g:       gotrovi,
+		w:       w,
+		folders: make(map[string]bool),
+		pending: make(map[string]fsnotify.Op),
+	}
+	defer fw.save()
+
+	for i := 0; i < len(gotrovi.conf.Index); i++ {
+		Info.Println("Watching " + gotrovi.conf.Index[i].Folder)
+		fw.addTree(i, gotrovi.conf.Index[i].Folder, false)
+	}
+	Info.Println("Watching", len(fw.folders), "folders")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	timer := time.NewTimer(WATCH_COALESCE_TIME)
+	timer.Stop()
+	rescan := time.NewTicker(WATCH_RESCAN_TIME)
+	defer rescan.Stop()
+	save := time.NewTicker(WATCH_SAVE_TIME)
+	defer save.Stop()
+
+	for {
+		select {
+		case s := <-sigs:
+			Info.Println("Received", s, "stopping watcher")
+			fw.flush()
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			fw.queue(ev)
+			if time.Since(fw.first) >= WATCH_MAX_DELAY {
+				fw.flush()
+				break
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(WATCH_COALESCE_TIME)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			if err == fsnotify.ErrEventOverflow {
+				Warning.Println("Filesystem events were lost, rescanning")
+				fw.rescan()
+			} else {
+				Error.Println("Watcher error:", err)
+			}
+		case <-timer.C:
+			fw.flush()
+		case <-save.C:
+			fw.save()
+		case <-rescan.C:
+			if fw.limited {
+				fw.rescan()
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apoorvam/goterminal"
+	"github.com/fsnotify/fsnotify"
+)
+
+// testWatchEvents queues the events until none arrives for a while, then
+// syncs them
+func testWatchEvents(t *testing.T, fw *fsWatcher) {
+	for {
+		select {
+		case ev := <-fw.w.Events:
+			fw.queue(ev)
+		case err := <-fw.w.Errors:
+			t.Fatal(err)
+		case <-time.After(300 * time.Millisecond):
+			fw.flush()
+			return
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	settings, err := ioutil.TempDir("", "gotrovi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(settings)
+	GOTROVI_SETTINGS_FOLDER = settings + "/"
+	root := filepath.Join(settings, "root")
+	testIgnoreTree(t, root, map[string]string{"kept.txt": "kept"})
+
+	var g Gotrovi
+	g.conf = GotroviConf{Index: []Index{{Folder: root}}, Exclude: Exclude{Size: 1 << 30}, Backend: BACKEND_LOCAL, Hash: "md5"}
+	g.jobs = 2
+	g.writer = goterminal.New(ioutil.Discard)
+	g.OpenBackend()
+	g.OpenState()
+	g.InitHash()
+	g.SyncForced(0)
+	g.cp = nil
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fw := &fsWatcher{g: &g, w: w, folders: make(map[string]bool), pending: make(map[string]fsnotify.Op)}
+	fw.addTree(0, root, false)
+
+	check := func(step string, paths map[string]bool) {
+		for name, want := range paths {
+			p := filepath.Join(root, name)
+			if found := g.backend.Exists(p); found != want {
+				t.Errorf("%s: %s indexed %v, want %v", step, name, found, want)
+			}
+			if info, err := os.Stat(p); err == nil && info.IsDir() != fw.folders[p] || err != nil && fw.folders[p] {
+				t.Errorf("%s: %s watched %v", step, name, fw.folders[p])
+			}
+		}
+	}
+
+	testIgnoreTree(t, root, map[string]string{"new/a.txt": "a", "new/sub/b.txt": "b"})
+	testWatchEvents(t, fw)
+	// a file created in a folder found by the walk is seen by its watch
+	testIgnoreTree(t, root, map[string]string{"new/sub/c.txt": "c"})
+	testWatchEvents(t, fw)
+	check("create", map[string]bool{"kept.txt": true, "new": true, "new/a.txt": true, "new/sub": true, "new/sub/b.txt": true, "new/sub/c.txt": true})
+
+	err = os.Rename(filepath.Join(root, "new"), filepath.Join(root, "moved"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWatchEvents(t, fw)
+	check("rename", map[string]bool{"new": false, "new/a.txt": false, "new/sub": false, "new/sub/c.txt": false, "moved": true, "moved/a.txt": true, "moved/sub": true, "moved/sub/c.txt": true})
+	for _, name := range []string{"new", "new/sub"} {
+		if w.Remove(filepath.Join(root, name)) == nil {
+			t.Errorf("rename: %s still watched", name)
+		}
+	}
+
+	// the watches of the moved folders follow them
+	testIgnoreTree(t, root, map[string]string{"moved/sub/d.txt": "d"})
+	testWatchEvents(t, fw)
+	check("write", map[string]bool{"moved/sub/d.txt": true})
+
+	err = os.RemoveAll(filepath.Join(root, "moved"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWatchEvents(t, fw)
+	check("delete", map[string]bool{"kept.txt": true, "moved": false, "moved/a.txt": false, "moved/sub": false, "moved/sub/d.txt": false})
+	if len(fw.folders) != 1 || !fw.folders[root] {
+		t.Errorf("delete: watching %v", fw.folders)
+	}
+
+	// past the watch limit the files of a folder not watched are deleted
+	// with it too
+	fw.limited = true
+	testIgnoreTree(t, root, map[string]string{"unwatched/sub/e.txt": "e"})
+	testWatchEvents(t, fw)
+	if !g.backend.Exists(filepath.Join(root, "unwatched/sub/e.txt")) || fw.folders[filepath.Join(root, "unwatched")] {
+		t.Fatalf("limited: watching %v", fw.folders)
+	}
+	err = os.RemoveAll(filepath.Join(root, "unwatched"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWatchEvents(t, fw)
+	for _, name := range []string{"unwatched", "unwatched/sub", "unwatched/sub/e.txt"} {
+		p := filepath.Join(root, name)
+		if _, ok := g.state.get(p); ok || g.backend.Exists(p) {
+			t.Errorf("limited: %s left", name)
+		}
+	}
+}